@@ -0,0 +1,751 @@
+// Package ast contains the abstract syntax tree of a parsed recipe.
+//
+// Each primitive has its own statement type, which records the tokens it
+// was written with - so we know their positions - along with any comments
+// attached to it.  "Become" blocks contain the statements within them.
+package ast
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/skx/deployr/token"
+)
+
+// Position is a location within a recipe.
+type Position struct {
+	// Line is the line-number, starting from one.
+	Line int
+
+	// Column is the column, starting from one.
+	Column int
+}
+
+// String converts a position to a human-readable form.
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// IsValid returns true if the position is known.
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// Statement is the interface implemented by every statement.
+type Statement interface {
+
+	// Keyword returns the token which introduced the statement.
+	Keyword() token.Token
+
+	// Arguments returns the arguments of the statement, in the
+	// order they were written.
+	Arguments() []token.Token
+
+	// Pos returns the position of the statement's keyword.
+	Pos() Position
+
+	// Common returns the fields common to all statements, which
+	// include any attached comments.
+	Common() *Base
+
+	// String returns the statement in its source form.
+	String() string
+}
+
+// Program is the root of the tree.
+type Program struct {
+
+	// Statements holds the top-level statements.
+	Statements []Statement
+
+	// Comments holds any comments following the last statement,
+	// which are attached to nothing.
+	Comments []token.Token
+}
+
+// Base holds the fields common to all statements.
+type Base struct {
+
+	// Token is the keyword which introduced the statement.
+	Token token.Token
+
+	// Start is the position of the first token of the statement,
+	// which is that of its first prefix, such as "Sudo", if it has
+	// any.
+	Start Position
+
+	// Doc holds the comments upon the lines before the statement.
+	Doc []token.Token
+
+	// Comment holds the comment following the statement upon the
+	// same line, if any.
+	Comment *token.Token
+}
+
+// Keyword returns the token which introduced the statement.
+func (b *Base) Keyword() token.Token {
+	return b.Token
+}
+
+// Pos returns the position of the statement's keyword.
+func (b *Base) Pos() Position {
+	return Position{Line: b.Token.Line, Column: b.Token.Column}
+}
+
+// Common returns the fields common to all statements.
+func (b *Base) Common() *Base {
+	return b
+}
+
+// Prefix holds the "Sudo" and "Timeout" prefixes which may precede
+// some statements.
+type Prefix struct {
+
+	// Sudo is true if the statement was prefixed with "Sudo".
+	Sudo bool
+
+	// SudoUser is the user given via "Sudo -u user", if any.
+	SudoUser string
+
+	// Timeout is the duration given via "Timeout", or zero.
+	Timeout time.Duration
+}
+
+// Prefixes returns the prefixes.
+func (p *Prefix) Prefixes() Prefix {
+	return *p
+}
+
+// Prefixed is implemented by the statements which may be prefixed with
+// "Sudo" or "Timeout".
+type Prefixed interface {
+	Statement
+
+	// Prefixes returns the prefixes of the statement.
+	Prefixes() Prefix
+}
+
+// String returns the prefixes in their source form, with a trailing
+// space if there are any.
+func (p Prefix) String() string {
+	out := ""
+	if p.Timeout > 0 {
+		out += "Timeout " + duration(p.Timeout) + " "
+	}
+	if p.Sudo {
+		out += "Sudo "
+		if p.SudoUser != "" {
+			out += "-u " + p.SudoUser + " "
+		}
+	}
+	return out
+}
+
+// duration returns the given duration in its shortest form, such as "5m"
+// rather than "5m0s".
+func duration(d time.Duration) string {
+	out := d.String()
+	if strings.HasSuffix(out, "m0s") {
+		out = strings.TrimSuffix(out, "0s")
+	}
+	if strings.HasSuffix(out, "h0m") {
+		out = strings.TrimSuffix(out, "0m")
+	}
+	return out
+}
+
+// BecomeStatement is a block of statements, within which privileges
+// are escalated to the given user.
+type BecomeStatement struct {
+	Base
+
+	// User is the user to become.
+	User token.Token
+
+	// Body holds the statements within the block.
+	Body []Statement
+
+	// End is the "End" which closed the block.
+	End Base
+}
+
+// BecomeMethodStatement changes the method of privilege escalation.
+type BecomeMethodStatement struct {
+	Base
+
+	// Method is "sudo", "doas", or "su".
+	Method token.Token
+}
+
+// BlockInFileStatement ensures a remote file contains a block of lines,
+// between marker lines.
+type BlockInFileStatement struct {
+	Base
+	Prefix
+
+	// Path is the remote path.
+	Path token.Token
+
+	// Options holds the options, "marker" and "content".
+	Options []token.Token
+}
+
+// CopyFileStatement copies a file, or files, to the remote host.
+type CopyFileStatement struct {
+	Base
+	Prefix
+
+	// Source is the local path, or glob.
+	Source token.Token
+
+	// Destination is the remote path.
+	Destination token.Token
+}
+
+// CopyTemplateStatement expands a template, or templates, and copies
+// the result to the remote host.
+type CopyTemplateStatement struct {
+	Base
+	Prefix
+
+	// Source is the local path, or glob.
+	Source token.Token
+
+	// Destination is the remote path.
+	Destination token.Token
+}
+
+// DeployToStatement sets the host to connect to.
+type DeployToStatement struct {
+	Base
+
+	// Target is the host, as "[user@]host[:port]".
+	Target token.Token
+}
+
+// DirectoryStatement ensures a remote directory exists.
+type DirectoryStatement struct {
+	Base
+	Prefix
+
+	// Path is the remote path.
+	Path token.Token
+
+	// Options holds the options, "mode" and "owner".
+	Options []token.Token
+}
+
+// DownloadStatement downloads a URL to a file upon the remote host.
+type DownloadStatement struct {
+	Base
+	Prefix
+
+	// URL is the URL to download.
+	URL token.Token
+
+	// Destination is the remote path.
+	Destination token.Token
+
+	// Options holds the options, "sha256" and "mode".
+	Options []token.Token
+}
+
+// EnvStatement imports an environmental variable.
+type EnvStatement struct {
+	Base
+
+	// Name is the name of the variable.
+	Name token.Token
+}
+
+// FetchStatement downloads a file, or files, from the remote host.
+type FetchStatement struct {
+	Base
+	Prefix
+
+	// Source is the remote path, or glob.
+	Source token.Token
+
+	// Destination is the local path.
+	Destination token.Token
+}
+
+// GroupStatement ensures a group exists.
+type GroupStatement struct {
+	Base
+	Prefix
+
+	// Name is the name of the group.
+	Name token.Token
+
+	// Options holds the options, "system".
+	Options []token.Token
+}
+
+// IfChangedStatement runs a command if the previous copy changed
+// something.
+type IfChangedStatement struct {
+	Base
+	Prefix
+
+	// Command is the command to run.
+	Command token.Token
+}
+
+// LineInFileStatement ensures a remote file contains a line.
+type LineInFileStatement struct {
+	Base
+	Prefix
+
+	// Path is the remote path.
+	Path token.Token
+
+	// Options holds the options, "regexp" and "line".
+	Options []token.Token
+}
+
+// LoadSecretsStatement loads variables from an encrypted file.
+type LoadSecretsStatement struct {
+	Base
+
+	// Path is the path to the secrets file.
+	Path token.Token
+}
+
+// LocalStatement runs a command upon the local host.
+type LocalStatement struct {
+	Base
+	Prefix
+
+	// Command is the command to run.
+	Command token.Token
+
+	// Options holds the options, "set".
+	Options []token.Token
+}
+
+// PackageStatement ensures packages are installed, or removed.
+type PackageStatement struct {
+	Base
+	Prefix
+
+	// Names holds the names of the packages.
+	Names []token.Token
+
+	// Options holds the options, "state".
+	Options []token.Token
+}
+
+// RemoveStatement ensures a remote path doesn't exist.
+type RemoveStatement struct {
+	Base
+	Prefix
+
+	// Path is the remote path.
+	Path token.Token
+}
+
+// RunStatement runs a command.
+type RunStatement struct {
+	Base
+	Prefix
+
+	// Command is the command to run.
+	Command token.Token
+}
+
+// RunScriptStatement uploads a local script to the remote host, and
+// runs it.
+type RunScriptStatement struct {
+	Base
+	Prefix
+
+	// Script is the local path of the script.
+	Script token.Token
+
+	// Args holds the arguments passed to the script.
+	Args []token.Token
+
+	// Options holds the options, "interpreter" and "template".
+	Options []token.Token
+}
+
+// SecretStatement sets a variable whose value is redacted.
+type SecretStatement struct {
+	Base
+
+	// Name is the name of the variable.
+	Name token.Token
+
+	// Value is the value of the variable.
+	Value token.Token
+}
+
+// ServiceStatement ensures a systemd service is in the given state.
+type ServiceStatement struct {
+	Base
+	Prefix
+
+	// Name is the name of the service.
+	Name token.Token
+
+	// Options holds the options, "state" and "enabled".
+	Options []token.Token
+}
+
+// SetStatement sets a variable.
+type SetStatement struct {
+	Base
+
+	// Name is the name of the variable.
+	Name token.Token
+
+	// Value is the value of the variable.
+	Value token.Token
+}
+
+// SymlinkStatement ensures a remote symlink points to a target.
+type SymlinkStatement struct {
+	Base
+	Prefix
+
+	// Target is the path the link points to.
+	Target token.Token
+
+	// Link is the remote path of the link.
+	Link token.Token
+}
+
+// UserStatement ensures a user exists, with the given properties.
+type UserStatement struct {
+	Base
+	Prefix
+
+	// Name is the name of the user.
+	Name token.Token
+
+	// Options holds the options, "home", "shell", "system", and
+	// "groups".
+	Options []token.Token
+}
+
+// WriteFileStatement writes the given content to a file upon the
+// remote host.
+type WriteFileStatement struct {
+	Base
+	Prefix
+
+	// Destination is the remote path.
+	Destination token.Token
+
+	// Content is the content of the file.
+	Content token.Token
+}
+
+// Arguments returns the arguments of the statement.
+func (s *BecomeStatement) Arguments() []token.Token {
+	return []token.Token{s.User}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *BecomeMethodStatement) Arguments() []token.Token {
+	return []token.Token{s.Method}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *BlockInFileStatement) Arguments() []token.Token {
+	return append([]token.Token{s.Path}, s.Options...)
+}
+
+// Arguments returns the arguments of the statement.
+func (s *CopyFileStatement) Arguments() []token.Token {
+	return []token.Token{s.Source, s.Destination}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *CopyTemplateStatement) Arguments() []token.Token {
+	return []token.Token{s.Source, s.Destination}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *DeployToStatement) Arguments() []token.Token {
+	return []token.Token{s.Target}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *DirectoryStatement) Arguments() []token.Token {
+	return append([]token.Token{s.Path}, s.Options...)
+}
+
+// Arguments returns the arguments of the statement.
+func (s *DownloadStatement) Arguments() []token.Token {
+	return append([]token.Token{s.URL, s.Destination}, s.Options...)
+}
+
+// Arguments returns the arguments of the statement.
+func (s *EnvStatement) Arguments() []token.Token {
+	return []token.Token{s.Name}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *FetchStatement) Arguments() []token.Token {
+	return []token.Token{s.Source, s.Destination}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *GroupStatement) Arguments() []token.Token {
+	return append([]token.Token{s.Name}, s.Options...)
+}
+
+// Arguments returns the arguments of the statement.
+func (s *IfChangedStatement) Arguments() []token.Token {
+	return []token.Token{s.Command}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *LineInFileStatement) Arguments() []token.Token {
+	return append([]token.Token{s.Path}, s.Options...)
+}
+
+// Arguments returns the arguments of the statement.
+func (s *LoadSecretsStatement) Arguments() []token.Token {
+	return []token.Token{s.Path}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *LocalStatement) Arguments() []token.Token {
+	return append([]token.Token{s.Command}, s.Options...)
+}
+
+// Arguments returns the arguments of the statement.
+func (s *PackageStatement) Arguments() []token.Token {
+	args := append([]token.Token{}, s.Names...)
+	return append(args, s.Options...)
+}
+
+// Arguments returns the arguments of the statement.
+func (s *RemoveStatement) Arguments() []token.Token {
+	return []token.Token{s.Path}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *RunStatement) Arguments() []token.Token {
+	return []token.Token{s.Command}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *RunScriptStatement) Arguments() []token.Token {
+	args := []token.Token{s.Script}
+	args = append(args, s.Args...)
+	return append(args, s.Options...)
+}
+
+// Arguments returns the arguments of the statement.
+func (s *SecretStatement) Arguments() []token.Token {
+	return []token.Token{s.Name, s.Value}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *ServiceStatement) Arguments() []token.Token {
+	return append([]token.Token{s.Name}, s.Options...)
+}
+
+// Arguments returns the arguments of the statement.
+func (s *SetStatement) Arguments() []token.Token {
+	return []token.Token{s.Name, s.Value}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *SymlinkStatement) Arguments() []token.Token {
+	return []token.Token{s.Target, s.Link}
+}
+
+// Arguments returns the arguments of the statement.
+func (s *UserStatement) Arguments() []token.Token {
+	return append([]token.Token{s.Name}, s.Options...)
+}
+
+// Arguments returns the arguments of the statement.
+func (s *WriteFileStatement) Arguments() []token.Token {
+	return []token.Token{s.Destination, s.Content}
+}
+
+// String returns the statement in its source form.
+func (s *BecomeStatement) String() string { return source(s, Prefix{}) }
+
+// String returns the statement in its source form.
+func (s *BecomeMethodStatement) String() string { return source(s, Prefix{}) }
+
+// String returns the statement in its source form.
+func (s *BlockInFileStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *CopyFileStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *CopyTemplateStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *DeployToStatement) String() string { return source(s, Prefix{}) }
+
+// String returns the statement in its source form.
+func (s *DirectoryStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *DownloadStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *EnvStatement) String() string { return source(s, Prefix{}) }
+
+// String returns the statement in its source form.
+func (s *FetchStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *GroupStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *IfChangedStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *LineInFileStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *LoadSecretsStatement) String() string { return source(s, Prefix{}) }
+
+// String returns the statement in its source form.
+func (s *LocalStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *PackageStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *RemoveStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *RunStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *RunScriptStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *SecretStatement) String() string { return source(s, Prefix{}) }
+
+// String returns the statement in its source form.
+func (s *ServiceStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *SetStatement) String() string { return source(s, Prefix{}) }
+
+// String returns the statement in its source form.
+func (s *SymlinkStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *UserStatement) String() string { return source(s, s.Prefix) }
+
+// String returns the statement in its source form.
+func (s *WriteFileStatement) String() string { return source(s, s.Prefix) }
+
+// source returns the source form of the given statement, which is
+// written upon a single line.
+func source(s Statement, prefix Prefix) string {
+	words := []string{prefix.String() + s.Keyword().Literal}
+	for _, arg := range s.Arguments() {
+		words = append(words, Source(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// Source returns the source form of the given argument.
+//
+// If the token was read from a recipe this is the text it was written
+// as, otherwise strings are quoted.
+func Source(tok token.Token) string {
+	if tok.Raw != "" {
+		return tok.Raw
+	}
+	if tok.Type != token.STRING {
+		return tok.Literal
+	}
+
+	var out strings.Builder
+	out.WriteString("\"")
+	for _, r := range tok.Literal {
+		switch r {
+		case '\\':
+			out.WriteString(`\\`)
+		case '"':
+			out.WriteString(`\"`)
+		case '\n':
+			out.WriteString(`\n`)
+		case '\r':
+			out.WriteString(`\r`)
+		case '\t':
+			out.WriteString(`\t`)
+		default:
+			out.WriteRune(r)
+		}
+	}
+	out.WriteString("\"")
+	return out.String()
+}
+
+// Walk calls fn for each of the given statements in turn, including
+// those within blocks, in the order they appear in the recipe.
+func Walk(statements []Statement, fn func(Statement)) {
+	for _, s := range statements {
+		fn(s)
+		if b, ok := s.(*BecomeStatement); ok {
+			Walk(b.Body, fn)
+		}
+	}
+}
+
+// SplitOption returns the name and value of an option, which is written
+// as "name=value".
+func SplitOption(tok token.Token) (string, string) {
+	i := strings.Index(tok.Literal, "=")
+	if i < 0 {
+		return tok.Literal, ""
+	}
+	return tok.Literal[:i], tok.Literal[i+1:]
+}
+
+// Option returns the value of the named option, from the given options,
+// and whether it was present.
+func Option(options []token.Token, name string) (string, bool) {
+	for _, opt := range options {
+		n, v := SplitOption(opt)
+		if n == name {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// SplitReference splits the contents of a "${...}" reference into the
+// name of the variable, any modifier, and the modifier's argument.
+//
+// The modifiers are ":-" and ":?", which take an argument, and "^^" and
+// ",,", which don't.
+func SplitReference(ref string) (string, string, string) {
+
+	//
+	// Skip past any "env:" prefix, so its colon isn't mistaken for
+	// the start of a modifier.
+	//
+	start := 0
+	if strings.HasPrefix(ref, "env:") {
+		start = len("env:")
+	}
+
+	for i := start; i < len(ref)-1; i++ {
+		switch ref[i : i+2] {
+		case ":-", ":?":
+			return ref[:i], ref[i : i+2], ref[i+2:]
+		case "^^", ",,":
+			return ref[:i], ref[i : i+2], ""
+		}
+	}
+	return ref, "", ""
+}
@@ -0,0 +1,127 @@
+package ast
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skx/deployr/token"
+)
+
+// TestString tests that statements are converted to their source form.
+func TestString(t *testing.T) {
+
+	run := &RunStatement{
+		Base:    Base{Token: token.Token{Type: token.RUN, Literal: "Run", Line: 3, Column: 5}},
+		Prefix:  Prefix{Sudo: true, SudoUser: "app", Timeout: 30 * time.Second},
+		Command: token.Token{Type: token.STRING, Literal: "echo \"hi\"\n"},
+	}
+	if run.String() != `Timeout 30s Sudo -u app Run "echo \"hi\"\n"` {
+		t.Fatalf("Unexpected source-form: %s", run.String())
+	}
+	if run.Pos().String() != "3:5" {
+		t.Fatalf("Unexpected position: %s", run.Pos())
+	}
+
+	//
+	// Tokens read from a recipe keep the form they were written in.
+	//
+	set := &SetStatement{
+		Base:  Base{Token: token.Token{Type: token.SET, Literal: "Set"}},
+		Name:  token.Token{Type: token.IDENT, Literal: "A", Raw: "A"},
+		Value: token.Token{Type: token.STRING, Literal: "b c", Raw: "\"b \\\n c\""},
+	}
+	if set.String() != "Set A \"b \\\n c\"" {
+		t.Fatalf("Unexpected source-form: %s", set.String())
+	}
+	if set.Pos().IsValid() {
+		t.Fatalf("Position should be unknown")
+	}
+
+	//
+	// Durations are written in their shortest form.
+	//
+	for d, expected := range map[time.Duration]string{
+		5 * time.Minute:         "Timeout 5m ",
+		2 * time.Hour:           "Timeout 2h ",
+		90 * time.Minute:        "Timeout 1h30m ",
+		1500 * time.Millisecond: "Timeout 1.5s ",
+	} {
+		if (Prefix{Timeout: d}).String() != expected {
+			t.Errorf("Unexpected prefix for %s: '%s'", d, Prefix{Timeout: d})
+		}
+	}
+}
+
+// TestWalk tests that walking visits statements within blocks.
+func TestWalk(t *testing.T) {
+
+	inner := &RunStatement{Base: Base{Token: token.Token{Type: token.RUN, Literal: "Run"}}}
+	block := &BecomeStatement{
+		Base: Base{Token: token.Token{Type: token.BECOME, Literal: "Become"}},
+		Body: []Statement{inner},
+	}
+	last := &EnvStatement{Base: Base{Token: token.Token{Type: token.ENV, Literal: "Env"}}}
+
+	var seen []Statement
+	Walk([]Statement{block, last}, func(s Statement) {
+		seen = append(seen, s)
+	})
+
+	if len(seen) != 3 || seen[0] != block || seen[1] != inner || seen[2] != last {
+		t.Fatalf("Unexpected walk: %v", seen)
+	}
+}
+
+// TestOptions tests finding the values of options.
+func TestOptions(t *testing.T) {
+
+	options := []token.Token{
+		{Type: token.IDENT, Literal: "template=true"},
+		{Type: token.IDENT, Literal: "interpreter=/usr/bin/env bash"},
+		{Type: token.IDENT, Literal: "empty="},
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"template", "true", true},
+		{"interpreter", "/usr/bin/env bash", true},
+		{"empty", "", true},
+		{"missing", "", false},
+	}
+
+	for _, test := range tests {
+		value, ok := Option(options, test.name)
+		if value != test.value || ok != test.ok {
+			t.Errorf("Option %s gave '%s' %t, expected '%s' %t", test.name, value, ok, test.value, test.ok)
+		}
+	}
+}
+
+// TestSplitReference tests splitting references into their parts.
+func TestSplitReference(t *testing.T) {
+
+	tests := []struct {
+		ref      string
+		name     string
+		modifier string
+		arg      string
+	}{
+		{"name", "name", "", ""},
+		{"name:-default", "name", ":-", "default"},
+		{"name:?is required", "name", ":?", "is required"},
+		{"name^^", "name", "^^", ""},
+		{"name,,", "name", ",,", ""},
+		{"env:HOME", "env:HOME", "", ""},
+		{"env:HOME:-/root", "env:HOME", ":-", "/root"},
+	}
+
+	for _, test := range tests {
+		name, modifier, arg := SplitReference(test.ref)
+		if name != test.name || modifier != test.modifier || arg != test.arg {
+			t.Errorf("SplitReference(%s) gave '%s' '%s' '%s'", test.ref, name, modifier, arg)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+//
+// Rewrite the given recipe(s) in a canonical form.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/skx/deployr/format"
+	"github.com/skx/deployr/util"
+)
+
+//
+// fmtCmd is the structure for this sub-command.
+//
+type fmtCmd struct {
+	// check lists unformatted files, rather than rewriting them.
+	check bool
+
+	// diff shows the changes formatting would make, rather than
+	// rewriting the files.
+	diff bool
+}
+
+//
+// Glue
+//
+func (*fmtCmd) Name() string     { return "fmt" }
+func (*fmtCmd) Synopsis() string { return "Rewrite recipe(s) in a canonical form." }
+func (*fmtCmd) Usage() string {
+	return `fmt :
+  Rewrite the given file(s) in a canonical form, with consistent spacing,
+  quoting, and indentation.  Comments are preserved.
+
+  With -check the names of any files which need formatting are shown, and
+  with -diff the changes are shown; in either case no files are written.
+
+  Recipes with prefixes which have no effect are not formatted, since
+  those prefixes would be lost.
+
+  The exit code is 0 on success, 1 if -check or -diff found files which
+  need formatting, and 2 if a recipe could not be read, parsed, or
+  formatted.
+`
+}
+
+//
+// Flag setup
+//
+func (f *fmtCmd) SetFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&f.check, "check", false, "List files which need formatting, without rewriting them.")
+	fs.BoolVar(&f.diff, "diff", false, "Show the changes formatting would make, without rewriting files.")
+}
+
+//
+// Format the given file, returning the exit-code which should be used.
+//
+func (f *fmtCmd) Format(file string) subcommands.ExitStatus {
+
+	//
+	// Read the contents of the file.
+	//
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Printf("Error reading file %s - %s\n", file, err.Error())
+		return subcommands.ExitUsageError
+	}
+
+	//
+	// Format it.
+	//
+	out, err := format.Source(string(dat))
+	if err != nil {
+		showErrors(file+": error parsing program: ", err)
+		return subcommands.ExitUsageError
+	}
+
+	//
+	// Nothing to do?
+	//
+	if out == string(dat) {
+		return subcommands.ExitSuccess
+	}
+
+	if f.check || f.diff {
+		if f.check {
+			fmt.Printf("%s\n", file)
+		}
+		if f.diff {
+			fmt.Print(format.Diff(file, string(dat), out))
+		}
+		return subcommands.ExitFailure
+	}
+
+	//
+	// Rewrite the file, keeping its permissions.
+	//
+	info, err := os.Stat(file)
+	if err != nil {
+		fmt.Printf("Error reading file %s - %s\n", file, err.Error())
+		return subcommands.ExitUsageError
+	}
+	err = ioutil.WriteFile(file, []byte(out), info.Mode())
+	if err != nil {
+		fmt.Printf("Error writing file %s - %s\n", file, err.Error())
+		return subcommands.ExitUsageError
+	}
+
+	return subcommands.ExitSuccess
+}
+
+//
+// Entry-point.
+//
+func (f *fmtCmd) Execute(_ context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	//
+	// The worst result of any file.
+	//
+	result := subcommands.ExitSuccess
+
+	//
+	// For each file we were given.
+	//
+	files := fs.Args()
+
+	//
+	// Fallback.
+	//
+	if len(files) < 1 {
+		if util.FileExists("deploy.recipe") {
+			files = append(files, "deploy.recipe")
+		}
+	}
+
+	for _, file := range files {
+		ret := f.Format(file)
+		if ret > result {
+			result = ret
+		}
+	}
+
+	return result
+}
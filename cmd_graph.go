@@ -0,0 +1,117 @@
+//
+// Draw the given recipe(s) as a graph.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/google/subcommands"
+	"github.com/skx/deployr/graph"
+	"github.com/skx/deployr/lexer"
+	"github.com/skx/deployr/parser"
+	"github.com/skx/deployr/util"
+)
+
+//
+// graphCmd is the structure for this sub-command.
+//
+type graphCmd struct {
+	// format is the output format, "dot" or "mermaid".
+	format string
+}
+
+//
+// Glue
+//
+func (*graphCmd) Name() string     { return "graph" }
+func (*graphCmd) Synopsis() string { return "Draw recipe(s) as a graph." }
+func (*graphCmd) Usage() string {
+	return `graph :
+  Draw the given file(s) as a graph, showing the statements in order,
+  which copies each IfChanged depends upon, and where variables are
+  set and used.
+
+  The output is for Graphviz by default, for example:
+
+     $ deployr graph deploy.recipe | dot -Tsvg > deploy.svg
+
+  Use -format mermaid for a Mermaid flowchart instead.
+`
+}
+
+//
+// Flag setup
+//
+func (g *graphCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&g.format, "format", "dot", "The output format, either dot or mermaid.")
+}
+
+//
+// Draw the given file, returning the exit-code which should be used.
+//
+func (g *graphCmd) Graph(file string) subcommands.ExitStatus {
+
+	//
+	// Read the contents of the file.
+	//
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Printf("Error reading file %s - %s\n", file, err.Error())
+		return subcommands.ExitFailure
+	}
+
+	//
+	// Parse the program, looking for errors.
+	//
+	program, err := parser.New(lexer.New(string(dat))).Parse()
+	if err != nil {
+		showErrors(file+": error parsing program: ", err)
+		return subcommands.ExitFailure
+	}
+
+	if g.format == "mermaid" {
+		fmt.Print(graph.Mermaid(program))
+	} else {
+		fmt.Print(graph.DOT(program))
+	}
+	return subcommands.ExitSuccess
+}
+
+//
+// Entry-point.
+//
+func (g *graphCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	if g.format != "dot" && g.format != "mermaid" {
+		fmt.Printf("Unknown format '%s' - expected dot or mermaid\n", g.format)
+		return subcommands.ExitUsageError
+	}
+
+	//
+	// For each file we were given.
+	//
+	files := f.Args()
+
+	//
+	// Fallback.
+	//
+	if len(files) < 1 {
+		if util.FileExists("deploy.recipe") {
+			files = append(files, "deploy.recipe")
+		}
+	}
+
+	result := subcommands.ExitSuccess
+	for _, file := range files {
+		ret := g.Graph(file)
+		if ret != subcommands.ExitSuccess {
+			result = ret
+		}
+	}
+	return result
+}
@@ -0,0 +1,144 @@
+//
+// Look for likely mistakes in the given recipe(s).
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/skx/deployr/lexer"
+	"github.com/skx/deployr/lint"
+	"github.com/skx/deployr/parser"
+	"github.com/skx/deployr/util"
+)
+
+//
+// lintCmd is the structure for this sub-command.
+//
+type lintCmd struct {
+	// vars holds the names of variables which will be set on the
+	// command-line at run-time.
+	vars arrayFlags
+}
+
+//
+// Glue
+//
+func (*lintCmd) Name() string     { return "lint" }
+func (*lintCmd) Synopsis() string { return "Look for likely mistakes in recipe(s)." }
+func (*lintCmd) Usage() string {
+	return `lint :
+  Examine the given file(s) for likely mistakes, such as variables which
+  are used but never set.
+
+  The exit code is 0 if no problems were found, 1 if there were warnings,
+  and 2 if a recipe could not be read or parsed.
+`
+}
+
+//
+// Flag setup
+//
+func (l *lintCmd) SetFlags(f *flag.FlagSet) {
+	f.Var(&l.vars, "set", "Note that a variable will be set on the command-line, either as NAME or NAME=value.  (May be repeated.)")
+}
+
+//
+// Lint the given file, returning the exit-code which should be used.
+//
+func (l *lintCmd) Lint(file string) subcommands.ExitStatus {
+
+	//
+	// Read the contents of the file.
+	//
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Printf("Error reading file %s - %s\n", file, err.Error())
+		return subcommands.ExitUsageError
+	}
+
+	//
+	// Create a lexer object with those contents.
+	//
+	lx := lexer.New(string(dat))
+
+	//
+	// Create a parser, using the lexer.
+	//
+	p := parser.New(lx)
+
+	//
+	// Parse the program, looking for errors.
+	//
+	statements, err := p.Parse()
+	if err != nil {
+		showErrors(file+": error parsing program: ", err)
+		return subcommands.ExitUsageError
+	}
+
+	//
+	// Now run the linter.
+	//
+	linter := lint.New(statements)
+	for _, set := range l.vars {
+		linter.AddKnown(strings.SplitN(set, "=", 2)[0])
+	}
+
+	//
+	// Show any warnings from the parser, and the linter.
+	//
+	count := 0
+	for _, warning := range p.Warnings() {
+		fmt.Printf("%s: %s\n", file, warning)
+		count++
+	}
+	for _, warning := range linter.Lint() {
+		fmt.Printf("%s: %s\n", file, warning)
+		count++
+	}
+
+	if count > 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+//
+// Entry-point.
+//
+func (l *lintCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	//
+	// The worst result of any file.
+	//
+	result := subcommands.ExitSuccess
+
+	//
+	// For each file we were given.
+	//
+	files := f.Args()
+
+	//
+	// Fallback.
+	//
+	if len(files) < 1 {
+		if util.FileExists("deploy.recipe") {
+			files = append(files, "deploy.recipe")
+		}
+	}
+
+	for _, file := range files {
+		ret := l.Lint(file)
+		if ret > result {
+			result = ret
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,58 @@
+//
+// Run a language server for editors.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/skx/deployr/lsp"
+)
+
+//
+// lspCmd is the structure for this sub-command.
+//
+type lspCmd struct {
+}
+
+//
+// Glue
+//
+func (*lspCmd) Name() string     { return "lsp" }
+func (*lspCmd) Synopsis() string { return "Run a language server for editors." }
+func (*lspCmd) Usage() string {
+	return `lsp :
+  Run a language server, speaking the Language Server Protocol over
+  STDIN and STDOUT.  Configure your editor to launch "deployr lsp" for
+  recipe files.
+
+  The server offers diagnostics, completion of primitives and of local
+  paths for copies, documentation of primitives upon hover, and
+  go-to-definition for variables.
+`
+}
+
+//
+// Flag setup
+//
+func (l *lspCmd) SetFlags(f *flag.FlagSet) {
+}
+
+//
+// Entry-point.
+//
+func (l *lspCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	err := lsp.New(os.Stdin, os.Stdout).Serve()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "language server failed: %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 
 	"github.com/google/subcommands"
+	"github.com/skx/deployr/ast"
 	"github.com/skx/deployr/lexer"
 	"github.com/skx/deployr/parser"
 	"github.com/skx/deployr/util"
@@ -30,6 +31,9 @@ func (*parseCmd) Synopsis() string { return "Show our parser output." }
 func (*parseCmd) Usage() string {
 	return `parser :
   Show the output of running our parser on the given file(s).
+
+  Each statement is shown with its position, and any attached comments.
+  Statements within blocks are indented.
 `
 }
 
@@ -53,9 +57,10 @@ func (p *parseCmd) Parse(file string) {
 	}
 
 	//
-	// Create a lexer object with those contents.
+	// Create a lexer object with those contents, which will return
+	// comments so we can show where they're attached.
 	//
-	l := lexer.New(string(dat))
+	l := lexer.NewWithComments(string(dat))
 
 	//
 	// Create a parser, using the lexer.
@@ -65,9 +70,9 @@ func (p *parseCmd) Parse(file string) {
 	//
 	// Parse the program, looking for errors.
 	//
-	statements, err := pa.Parse()
+	program, err := pa.Parse()
 	if err != nil {
-		fmt.Printf("Error parsing program: %s\n", err.Error())
+		showErrors("Error parsing program: ", err)
 		return
 	}
 
@@ -76,9 +81,38 @@ func (p *parseCmd) Parse(file string) {
 	//
 	// We can dump the parsed statements.
 	//
+	p.dump(program.Statements, "")
+
+	for _, comment := range program.Comments {
+		fmt.Printf("%d:%d\t%s\n", comment.Line, comment.Column, comment.Literal)
+	}
+}
+
+//
+// Show the given statements, and those within any blocks.
+//
+func (p *parseCmd) dump(statements []ast.Statement, indent string) {
 	for _, statement := range statements {
-		fmt.Printf("%v\n", statement)
+		p.show(statement.Common(), indent, statement.String())
+
+		if block, ok := statement.(*ast.BecomeStatement); ok {
+			p.dump(block.Body, indent+"    ")
+			p.show(&block.End, indent, block.End.Token.Literal)
+		}
+	}
+}
+
+//
+// Show a single statement, with its comments.
+//
+func (p *parseCmd) show(base *ast.Base, indent string, text string) {
+	for _, comment := range base.Doc {
+		fmt.Printf("%d:%d\t%s%s\n", comment.Line, comment.Column, indent, comment.Literal)
+	}
+	if base.Comment != nil {
+		text += " " + base.Comment.Literal
 	}
+	fmt.Printf("%s\t%s%s\n", base.Pos(), indent, text)
 }
 
 //
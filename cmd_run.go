@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/google/subcommands"
 	"github.com/skx/deployr/evaluator"
@@ -33,6 +34,15 @@ func (i *arrayFlags) Set(value string) error {
 	return nil
 }
 
+// defaultSecretPatterns match the names of variables which are assumed
+// to hold sensitive values.
+var defaultSecretPatterns = []string{
+	"*_KEY",
+	"*_PASSWORD",
+	"*_SECRET",
+	"*_TOKEN",
+}
+
 //
 // runCmd holds the state for this sub-command.
 //
@@ -44,13 +54,55 @@ type runCmd struct {
 	// identity holds the SSH identity file to use.
 	identity string
 
+	// connectTimeout is the maximum time to wait when connecting.
+	connectTimeout time.Duration
+
+	// connectRetries is the number of times to retry a failed connection.
+	connectRetries int
+
+	// keepAlive is the interval between SSH keepalive messages.
+	keepAlive time.Duration
+
+	// strict is true if references to undefined variables are errors.
+	strict bool
+
 	// target allows the target against which the recipe runs to be
 	// set on the command-line.
 	target string
 
+	// becomeMethod is the method used for privilege escalation.
+	becomeMethod string
+
+	// secrets holds the paths of any encrypted secrets files to load.
+	secrets arrayFlags
+
+	// secretsIdentity is the age identity-file used to decrypt secrets.
+	secretsIdentity string
+
+	// sudoNoPasswd is true if sudo should be invoked without a password.
+	sudoNoPasswd bool
+
+	// sudoPasswordEnv is the name of a variable holding the sudo password.
+	sudoPasswordEnv string
+
+	// sudoPasswordFD is a file-descriptor to read the sudo password from.
+	sudoPasswordFD int
+
+	// sudoPasswordFile is a file holding the sudo password.
+	sudoPasswordFile string
+
+	// sudoAskPass is a command to run to fetch the sudo password.
+	sudoAskPass string
+
 	// vars stores any variables which are specified on the command-line.
 	vars arrayFlags
 
+	// secretVars stores any secret variables specified on the command-line.
+	secretVars arrayFlags
+
+	// secretPatterns holds patterns matching the names of secret variables.
+	secretPatterns arrayFlags
+
 	// verbose is true if we should be extra-verbose when running.
 	verbose bool
 }
@@ -73,8 +125,22 @@ func (r *runCmd) SetFlags(f *flag.FlagSet) {
 	f.BoolVar(&r.nop, "nop", false, "No operation - just pretend to run.")
 	f.BoolVar(&r.verbose, "verbose", false, "Run verbosely.")
 	f.StringVar(&r.identity, "identity", "", "The identity file to use for key-based authentication.")
+	f.DurationVar(&r.connectTimeout, "connect-timeout", 30*time.Second, "The maximum time to wait when connecting to the target.")
+	f.IntVar(&r.connectRetries, "connect-retries", 3, "The number of times to retry a failed connection.")
+	f.DurationVar(&r.keepAlive, "keepalive", 30*time.Second, "The interval between SSH keepalive messages, 0 to disable.")
+	f.BoolVar(&r.strict, "strict", false, "Treat references to undefined variables as errors.")
 	f.StringVar(&r.target, "target", "", "The target host to execute the recipe against.")
+	f.Var(&r.secrets, "secrets", "Load variables from the given encrypted secrets file.  (May be repeated.)")
+	f.StringVar(&r.secretsIdentity, "secrets-identity", "", "The age identity file used to decrypt secrets, instead of a passphrase.")
+	f.StringVar(&r.becomeMethod, "become-method", "sudo", "The method used for privilege escalation: sudo, doas, or su.")
+	f.BoolVar(&r.sudoNoPasswd, "sudo-nopasswd", false, "Escalate privileges non-interactively (e.g. 'sudo -n'), never prompting for a password.")
+	f.StringVar(&r.sudoPasswordEnv, "sudo-password-env", "", "Read the sudo password from the named environmental variable.")
+	f.IntVar(&r.sudoPasswordFD, "sudo-password-fd", -1, "Read the sudo password from the given file-descriptor.")
+	f.StringVar(&r.sudoPasswordFile, "sudo-password-file", "", "Read the sudo password from the given file.")
+	f.StringVar(&r.sudoAskPass, "sudo-askpass", "", "Run the given command to fetch the sudo password.")
 	f.Var(&r.vars, "set", "Set the value of a particular variable.  (May be repeated.)")
+	f.Var(&r.secretVars, "secret", "Set the value of a particular variable, redacting it from all output.  (May be repeated.)")
+	f.Var(&r.secretPatterns, "secret-pattern", "Redact the values of variables whose names match the given pattern.  (May be repeated.)")
 }
 
 //
@@ -106,7 +172,7 @@ func (r *runCmd) Run(file string) {
 	//
 	statements, err := p.Parse()
 	if err != nil {
-		fmt.Printf("Error parsing program: %s\n", err.Error())
+		showErrors("Error parsing program: ", err)
 		return
 	}
 
@@ -117,9 +183,52 @@ func (r *runCmd) Run(file string) {
 	//
 	e := evaluator.New(statements)
 
+	//
+	// Set our flags verbosity-level
+	//
+	e.SetVerbose(r.verbose)
+	if r.nop {
+		e.SetVerbose(true)
+		e.SetNOP(true)
+	}
+
+	//
+	// Should undefined variables be errors?
+	//
+	e.SetStrict(r.strict)
+
+	//
+	// Save the identity-flag - the default is ~/.ssh/id_rsa
+	//
+	e.SetIdentity(r.identity)
+
+	//
+	// Save our connection settings.
+	//
+	e.SetConnectTimeout(r.connectTimeout)
+	e.SetConnectRetries(r.connectRetries)
+	e.SetKeepAlive(r.keepAlive)
+
+	//
+	// Save our sudo settings.
+	//
+	err = e.SetBecomeMethod(r.becomeMethod)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return
+	}
+	e.SetSudoNoPasswd(r.sudoNoPasswd)
+	e.SetSudoPasswordEnv(r.sudoPasswordEnv)
+	e.SetSudoPasswordFD(r.sudoPasswordFD)
+	e.SetSudoPasswordFile(r.sudoPasswordFile)
+	e.SetSudoAskPass(r.sudoAskPass)
+
 	//
 	// Set the target, if we've been given one.
 	//
+	// This happens after the identity, and connection settings, have
+	// been configured so that they're used.
+	//
 	if r.target != "" {
 		err = e.ConnectTo(r.target)
 		if err != nil {
@@ -130,18 +239,19 @@ func (r *runCmd) Run(file string) {
 	}
 
 	//
-	// Set our flags verbosity-level
+	// Setup the patterns of secret variable-names, before any
+	// variables are set.
 	//
-	e.SetVerbose(r.verbose)
-	if r.nop {
-		e.SetVerbose(true)
-		e.SetNOP(true)
+	for _, pattern := range defaultSecretPatterns {
+		e.AddSecretPattern(pattern)
+	}
+	for _, pattern := range r.secretPatterns {
+		err = e.AddSecretPattern(pattern)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			return
+		}
 	}
-
-	//
-	// Save the identity-flag - the default is ~/.ssh/id_rsa
-	//
-	e.SetIdentity(r.identity)
 
 	//
 	// Are there any variables set on the command-line?
@@ -155,6 +265,29 @@ func (r *runCmd) Run(file string) {
 		}
 	}
 
+	//
+	// Are there any secret variables set on the command-line?
+	//
+	for _, set := range r.secretVars {
+
+		matches := re.FindStringSubmatch(set)
+		if len(matches) == 3 {
+			e.SetSecretVariable(matches[1], matches[2])
+		}
+	}
+
+	//
+	// Load any secrets we've been given.
+	//
+	e.SetSecretsIdentity(r.secretsIdentity)
+	for _, file := range r.secrets {
+		err = e.LoadSecrets(file)
+		if err != nil {
+			fmt.Printf("Error loading secrets: %s\n", err.Error())
+			return
+		}
+	}
+
 	//
 	// Now run the program.  Hurrah!
 	//
@@ -0,0 +1,26 @@
+//
+// Reporting the errors found in a recipe.
+//
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/skx/deployr/parser"
+)
+
+//
+// Show the error(s) returned from parsing a recipe, one per line with
+// the given prefix.
+//
+func showErrors(prefix string, err error) {
+	list, ok := err.(parser.ErrorList)
+	if !ok {
+		fmt.Printf("%s%s\n", prefix, err.Error())
+		return
+	}
+	for _, e := range list {
+		fmt.Printf("%s%s\n", prefix, e.Error())
+	}
+}
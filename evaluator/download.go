@@ -0,0 +1,182 @@
+package evaluator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sumMarker prefixes the checksum of a remote file, and downloadMarker
+// the outcome of a download, so that they can't be confused with any
+// warnings from sudo.
+const (
+	sumMarker      = "deployr_sha256"
+	downloadMarker = "deployr_download"
+)
+
+// remoteChecksum returns the SHA256 checksum of the given remote file.
+func remoteChecksum(c *commandFS, remote string) (string, error) {
+	line, found, err := c.marked("s=$(sha256sum < "+shellQuote(remote)+") && printf '"+sumMarker+" %s\\n' \"$s\"", sumMarker)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if !found || len(fields) == 0 {
+		return "", fmt.Errorf("failed to find checksum of '%s'", remote)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// downloadScript returns a shell script which fetches the given URL, via
+// curl or wget, to a temporary file beside dst.
+//
+// The download is discarded if it doesn't match the checksum sum, if that
+// is given, or if it matches current, in which case dst takes its
+// modification time.  Otherwise it is given the mode and
+// where permitted the ownership of dst, if it exists, or the given mode,
+// and then renamed over dst.
+//
+// If conditional is true, and curl is used, the URL is only fetched if it
+// has been modified since dst was.
+//
+// The outcome is shown upon a line prefixed by downloadMarker.
+func downloadScript(url string, dst string, sum string, current string, mode string, conditional bool) string {
+	curl := "curl -fsSL -R -w '%{http_code}' -o \"$t\""
+	if conditional {
+		curl += " -z " + shellQuote(dst)
+	}
+
+	chmod := `if [ -e ` + shellQuote(dst) + ` ]; then
+	chown "$(stat -c %u:%g ` + shellQuote(dst) + `)" "$t" 2>/dev/null || :
+	chmod "$(stat -c %a ` + shellQuote(dst) + `)" "$t"
+else
+	chmod 644 "$t"
+fi`
+	if mode != "" {
+		chmod += "\nchmod " + shellQuote(mode) + ` "$t"`
+	}
+
+	return `set -e
+t=$(mktemp "$(dirname ` + shellQuote(dst) + `)/.deployr.XXXXXX")
+trap 'rm -f "$t"' EXIT
+if command -v curl >/dev/null 2>&1; then
+	code=$(` + curl + ` ` + shellQuote(url) + `)
+elif command -v wget >/dev/null 2>&1; then
+	wget -nv -O "$t" ` + shellQuote(url) + `
+	code=200
+else
+	echo "neither curl nor wget is installed" >&2
+	exit 1
+fi
+if [ "$code" = 304 ]; then
+	echo "` + downloadMarker + ` unmodified"
+	exit 0
+fi
+s=$(sha256sum < "$t")
+s=${s%% *}
+if [ -n ` + shellQuote(sum) + ` ] && [ "$s" != ` + shellQuote(sum) + ` ]; then
+	echo "` + downloadMarker + ` mismatch $s"
+	exit 0
+fi
+if [ "$s" = ` + shellQuote(current) + ` ]; then
+	touch -r "$t" ` + shellQuote(dst) + ` 2>/dev/null || :
+	echo "` + downloadMarker + ` unchanged"
+	exit 0
+fi
+` + chmod + `
+mv -f "$t" ` + shellQuote(dst) + `
+echo "` + downloadMarker + ` replaced"`
+}
+
+// download fetches the given URL to the remote host, via curl or wget
+// upon it, returning whether a change was made.
+//
+// If a checksum is given the transfer is skipped when the destination
+// already matches it, and the download must match it.  Otherwise the
+// destination is only fetched if it has been modified, where curl
+// allows, and only replaced if the download differs.
+//
+// The download is written beside the destination, then renamed over it
+// so that it is never seen in a partially-written state.  If we're not
+// running for real the changes are only reported.
+func (e *Evaluator) download(c *commandFS, url string, remote string, sum string, mode string) (bool, error) {
+
+	object := "Download " + remote
+
+	sum = strings.ToLower(sum)
+	if sum != "" {
+		if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+			return false, fmt.Errorf("invalid value for sha256 '%s' - expected %d hexadecimal characters", sum, sha256.Size*2)
+		}
+	}
+
+	perm, err := parseMode(mode)
+	if err != nil {
+		return false, err
+	}
+
+	fi, err := c.Stat(remote)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	current := ""
+	if fi != nil {
+		current, err = remoteChecksum(c, remote)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	//
+	// setMode ensures the destination has the requested mode.
+	//
+	setMode := func() (bool, error) {
+		if mode == "" || (fi != nil && fi.Mode().Perm() == perm) {
+			return false, nil
+		}
+		e.report(object, fmt.Sprintf("changed to mode %04o", perm))
+		if !e.NOP {
+			err := c.Chmod(remote, perm)
+			if err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	if sum != "" && current == sum {
+		if e.Verbose {
+			e.printf("\tFile on remote host already matches the checksum.\n")
+		}
+		return setMode()
+	}
+
+	if e.NOP {
+		e.report(object, "downloaded from "+url)
+		return true, nil
+	}
+
+	outcome, found, err := c.marked(downloadScript(url, remote, sum, current, mode, sum == "" && fi != nil), downloadMarker)
+	if err != nil {
+		return false, fmt.Errorf("failed to download %s: %s", url, err.Error())
+	}
+	if !found {
+		return false, fmt.Errorf("failed to download %s", url)
+	}
+
+	switch {
+	case strings.HasPrefix(outcome, "mismatch "):
+		return false, fmt.Errorf("checksum mismatch for %s - expected %s, got %s", url, sum, strings.TrimPrefix(outcome, "mismatch "))
+	case outcome == "unmodified" || outcome == "unchanged":
+		if e.Verbose {
+			e.printf("\tFile on remote host doesn't need to be changed.\n")
+		}
+		return setMode()
+	}
+
+	e.report(object, "downloaded from "+url)
+	return true, nil
+}
@@ -0,0 +1,203 @@
+package evaluator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skx/deployr/ast"
+	"github.com/skx/deployr/token"
+)
+
+// TestDownload tests downloading files to the remote host.
+func TestDownload(t *testing.T) {
+
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("curl is not installed")
+	}
+
+	//
+	// Our server counts the requests made, and those which were
+	// answered with the release.
+	//
+	var m sync.Mutex
+	content := "#!/bin/sh\necho release\n"
+	modified := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	var requests, fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/release" {
+			http.NotFound(w, r)
+			return
+		}
+		m.Lock()
+		defer m.Unlock()
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	e, bin, stop := sshServer(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	c := &commandFS{run: e.execute}
+	url := server.URL + "/release"
+	app := filepath.Join(dir, "app")
+
+	//
+	// check tests the outcome of a download, and that no temporary
+	// files were left behind.
+	//
+	check := func(changed bool, err error, expected bool, requested int32, fetched int32) {
+		t.Helper()
+		if err != nil || changed != expected {
+			t.Fatalf("Unexpected result %v %v", changed, err)
+		}
+		if atomic.LoadInt32(&requests) != requested || atomic.LoadInt32(&fetches) != fetched {
+			t.Fatalf("Unexpected requests %d %d", atomic.LoadInt32(&requests), atomic.LoadInt32(&fetches))
+		}
+		leftovers, _ := filepath.Glob(filepath.Join(dir, ".deployr.*"))
+		if len(leftovers) != 0 {
+			t.Fatalf("Expected the temporary files to be gone: %v", leftovers)
+		}
+	}
+
+	raw := sha256.Sum256([]byte(content))
+	sum := hex.EncodeToString(raw[:])
+
+	//
+	// Without running for real nothing is downloaded.
+	//
+	e.NOP = true
+	changed, err := e.download(c, url, app, sum, "")
+	check(changed, err, true, 0, 0)
+	if _, err = os.Stat(app); err == nil {
+		t.Fatalf("Expected nothing to be downloaded")
+	}
+
+	e.NOP = false
+	changed, err = e.download(c, url, app, strings.ToUpper(sum), "0755")
+	check(changed, err, true, 1, 1)
+	data, _ := ioutil.ReadFile(app)
+	fi, _ := os.Stat(app)
+	if string(data) != content || fi.Mode().Perm() != 0755 {
+		t.Fatalf("Unexpected file '%s' %v", data, fi.Mode())
+	}
+
+	//
+	// A matching file isn't downloaded again.
+	//
+	changed, err = e.download(c, url, app, sum, "")
+	check(changed, err, false, 1, 1)
+
+	//
+	// Without a checksum the file is only fetched if it has been
+	// modified, and only replaced if it has changed.
+	//
+	changed, err = e.download(c, url, app, "", "")
+	check(changed, err, false, 2, 1)
+
+	m.Lock()
+	modified = modified.Add(time.Minute)
+	m.Unlock()
+	changed, err = e.download(c, url, app, "", "")
+	check(changed, err, false, 3, 2)
+	changed, err = e.download(c, url, app, "", "")
+	check(changed, err, false, 4, 2)
+
+	m.Lock()
+	content = "#!/bin/sh\necho update\n"
+	modified = modified.Add(time.Minute)
+	m.Unlock()
+	changed, err = e.download(c, url, app, "", "")
+	check(changed, err, true, 5, 3)
+	data, _ = ioutil.ReadFile(app)
+	fi, _ = os.Stat(app)
+	if string(data) != content || fi.Mode().Perm() != 0755 {
+		t.Fatalf("Unexpected file '%s' %v", data, fi.Mode())
+	}
+
+	//
+	// A mismatched download leaves the existing file alone.
+	//
+	other := filepath.Join(dir, "other")
+	_, err = e.download(c, url, other, sum, "")
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("Expected a checksum error, got %v", err)
+	}
+	check(false, nil, false, 6, 4)
+	if _, err = os.Stat(other); err == nil {
+		t.Fatalf("Expected the mismatched download to be removed")
+	}
+
+	_, err = e.download(c, server.URL+"/missing", other, "", "")
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Expected an HTTP error, got %v", err)
+	}
+
+	_, err = e.download(c, url, other, "abc", "")
+	if err == nil || !strings.Contains(err.Error(), "invalid value for sha256") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+
+	//
+	// Within a "Become" block the download is made as the given
+	// user, and sudo's warnings shouldn't confuse us.
+	//
+	ioutil.WriteFile(filepath.Join(bin, "warn"), nil, 0644)
+	e.become = []string{"bob"}
+	c = &commandFS{run: e.execute, opts: e.escalation(ast.Prefix{})}
+
+	changed, err = e.download(c, url, other, "", "0600")
+	if err != nil || !changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+	data, _ = ioutil.ReadFile(other)
+	fi, _ = os.Stat(other)
+	if string(data) != content || fi.Mode().Perm() != 0600 {
+		t.Fatalf("Unexpected file '%s' %v", data, fi.Mode())
+	}
+	if !strings.Contains(sshLog(bin, "sudo"), "-u bob -n sh -c") {
+		t.Fatalf("The file was not downloaded via sudo: %s", sshLog(bin, "sudo"))
+	}
+
+	//
+	// As it is with the "Sudo" prefix.
+	//
+	e.become = nil
+	os.Remove(filepath.Join(bin, "sudo.log"))
+	err = e.evaluate([]ast.Statement{&ast.DownloadStatement{
+		Base:        ast.Base{Token: token.Token{Type: token.DOWNLOAD, Literal: "Download"}},
+		Prefix:      ast.Prefix{Sudo: true, SudoUser: "app"},
+		URL:         token.Token{Type: token.STRING, Literal: url},
+		Destination: token.Token{Type: token.STRING, Literal: filepath.Join(dir, "sudo")},
+	}})
+	if err != nil || !e.Changed {
+		t.Fatalf("Unexpected result %v %v", e.Changed, err)
+	}
+	if !strings.Contains(sshLog(bin, "sudo"), "-u app -n sh -c") {
+		t.Fatalf("The file was not downloaded via sudo: %s", sshLog(bin, "sudo"))
+	}
+}
@@ -0,0 +1,249 @@
+package evaluator
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// defaultMarker is the marker used by BlockInFile, if none is given.
+const defaultMarker = "deployr managed block"
+
+// Markers surrounding the content of a file read via sudo.
+const (
+	fileBegin = "deployr_file_begin"
+	fileEnd   = "deployr_file_end"
+)
+
+// splitLines returns the lines of the given content, without their
+// trailing newlines.
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// joinLines returns the given lines as content, each terminated by a
+// newline.
+func joinLines(lines []string) string {
+	if len(lines) < 1 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// lineInFile returns the given content edited such that it contains the
+// given line.
+//
+// If a regular expression is given the last line which matches it is
+// replaced, otherwise the line is appended unless already present.
+func lineInFile(content string, re *regexp.Regexp, line string) string {
+	lines := splitLines(content)
+
+	if re != nil {
+		for i := len(lines) - 1; i >= 0; i-- {
+			if re.MatchString(lines[i]) {
+				lines[i] = line
+				return joinLines(lines)
+			}
+		}
+	}
+
+	for _, l := range lines {
+		if l == line {
+			return content
+		}
+	}
+	return joinLines(append(lines, line))
+}
+
+// blockInFile returns the given content edited such that it contains the
+// given block, between lines holding the given marker.
+//
+// If the markers are present the lines between them are replaced,
+// otherwise the block, and its markers, are appended.
+func blockInFile(content string, marker string, block string) string {
+	begin := "# BEGIN " + marker
+	end := "# END " + marker
+
+	lines := splitLines(content)
+
+	for b := range lines {
+		if lines[b] != begin {
+			continue
+		}
+		for e := b + 1; e < len(lines); e++ {
+			if lines[e] == end {
+				edited := append([]string{}, lines[:b+1]...)
+				edited = append(edited, splitLines(block)...)
+				edited = append(edited, lines[e:]...)
+				return joinLines(edited)
+			}
+		}
+	}
+
+	lines = append(lines, begin)
+	lines = append(lines, splitLines(block)...)
+	lines = append(lines, end)
+	return joinLines(lines)
+}
+
+// editFile applies the given edit to the content of the remote file, or
+// to empty content if it doesn't exist, returning whether it changed.
+//
+// If opts.Sudo is set the file is read and written via sudo, otherwise
+// via SFTP.  Either way the edited file is renamed into place, so it is
+// never seen in a partially-written state.
+func (e *Evaluator) editFile(remote string, edit func(string) string, opts execOptions) (bool, error) {
+
+	if opts.Sudo {
+		content, exists, err := sudoRead(e.execute, remote, opts)
+		if err != nil {
+			return false, err
+		}
+		edited := edit(content)
+		if exists && edited == content {
+			if e.Verbose {
+				e.printf("\tFile on remote host doesn't need to be changed.\n")
+			}
+			return false, nil
+		}
+		return e.writeFile(edited, remote, opts)
+	}
+
+	client, err := sftp.NewClient(e.Connection.SSHClient)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	return e.replaceRemote(client, remote, edit)
+}
+
+// sudoRead returns the content of the remote file, read via sudo, and
+// whether it exists.
+//
+// The file is read as base64 between marker lines, so that neither any
+// warnings from sudo, nor the line-endings of the terminal doas and su
+// require, are mistaken for its content.
+func sudoRead(run commander, remote string, opts execOptions) (string, bool, error) {
+
+	script := "[ ! -e " + shellQuote(remote) + " ] || { echo " + fileBegin + "; base64 < " + shellQuote(remote) + " && echo " + fileEnd + "; }"
+
+	out, err := run("sh -c "+shellQuote(script), opts)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read remote file: %s\n%s", err.Error(), out)
+	}
+
+	var encoded strings.Builder
+	begun := false
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == fileBegin:
+			begun = true
+		case line == fileEnd && begun:
+			content, err := base64.StdEncoding.DecodeString(encoded.String())
+			if err != nil {
+				return "", false, fmt.Errorf("failed to decode remote file: %s", err.Error())
+			}
+			return string(content), true, nil
+		case begun:
+			encoded.WriteString(line)
+		}
+	}
+
+	if begun {
+		return "", false, fmt.Errorf("failed to read remote file: truncated output\n%s", out)
+	}
+	return "", false, nil
+}
+
+// replaceRemote applies the given edit to the content of the remote file
+// via the given SFTP client, returning whether it changed.
+//
+// The edited file is written beside the original, with the same mode and
+// ownership, then renamed over it so that the file is never seen in a
+// partially-written state.
+func (e *Evaluator) replaceRemote(client *sftp.Client, remote string, edit func(string) string) (bool, error) {
+
+	var content []byte
+	var fi os.FileInfo
+
+	f, err := client.Open(remote)
+	if err == nil {
+		content, err = ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return false, err
+		}
+		fi, err = client.Stat(remote)
+		if err != nil {
+			return false, err
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	edited := edit(string(content))
+	if fi != nil && edited == string(content) {
+		if e.Verbose {
+			e.printf("\tFile on remote host doesn't need to be changed.\n")
+		}
+		return false, nil
+	}
+
+	if e.Verbose {
+		e.printf("\tFile on remote host needs replacing.\n")
+	}
+
+	//
+	// Create the temporary file afresh, and set its mode and
+	// ownership before we write to it, so the content is never
+	// readable by anybody who couldn't read the original.
+	//
+	tmp := path.Join(path.Dir(remote), "."+path.Base(remote)+".deployr")
+	client.Remove(tmp)
+
+	out, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return false, err
+	}
+
+	mode := os.FileMode(0644)
+	if fi != nil {
+		mode = fi.Mode().Perm()
+
+		//
+		// Only root may change the ownership of files, so
+		// failures are expected.
+		//
+		if stat, ok := fi.Sys().(*sftp.FileStat); ok {
+			client.Chown(tmp, int(stat.UID), int(stat.GID))
+		}
+	}
+	err = client.Chmod(tmp, mode)
+	if err == nil {
+		_, err = out.Write([]byte(edited))
+	}
+	out.Close()
+	if err == nil {
+		err = client.PosixRename(tmp, remote)
+	}
+	if err != nil {
+		client.Remove(tmp)
+		return false, err
+	}
+
+	if isUnitFile(remote) {
+		e.daemonReload = true
+	}
+	return true, nil
+}
@@ -0,0 +1,192 @@
+package evaluator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestLineInFile tests adding, and replacing, lines.
+func TestLineInFile(t *testing.T) {
+
+	re := regexp.MustCompile("^#?PermitRootLogin")
+
+	tests := []struct {
+		in       string
+		re       *regexp.Regexp
+		line     string
+		expected string
+	}{
+		{"", nil, "127.0.0.1 app", "127.0.0.1 app\n"},
+		{"127.0.0.1 localhost\n", nil, "127.0.0.1 app", "127.0.0.1 localhost\n127.0.0.1 app\n"},
+		{"127.0.0.1 app\n", nil, "127.0.0.1 app", "127.0.0.1 app\n"},
+		{"no newline", nil, "line", "no newline\nline\n"},
+		{"Port 22\n#PermitRootLogin yes\n", re, "PermitRootLogin no", "Port 22\nPermitRootLogin no\n"},
+		{"PermitRootLogin yes\nPermitRootLogin yes\n", re, "PermitRootLogin no", "PermitRootLogin yes\nPermitRootLogin no\n"},
+		{"Port 22\n", re, "PermitRootLogin no", "Port 22\nPermitRootLogin no\n"},
+		{"PermitRootLogin no\n", re, "PermitRootLogin no", "PermitRootLogin no\n"},
+	}
+
+	for _, test := range tests {
+		out := lineInFile(test.in, test.re, test.line)
+		if out != test.expected {
+			t.Fatalf("Unexpected output for %q: %q", test.in, out)
+		}
+	}
+}
+
+// TestBlockInFile tests adding, and replacing, blocks.
+func TestBlockInFile(t *testing.T) {
+
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"", "# BEGIN app\na\nb\n# END app\n"},
+		{"x\n", "x\n# BEGIN app\na\nb\n# END app\n"},
+		{"x\n# BEGIN app\nold\n# END app\ny\n", "x\n# BEGIN app\na\nb\n# END app\ny\n"},
+		{"# BEGIN app\na\nb\n# END app\n", "# BEGIN app\na\nb\n# END app\n"},
+		{"# BEGIN app\nunterminated\n", "# BEGIN app\nunterminated\n# BEGIN app\na\nb\n# END app\n"},
+	}
+
+	for _, test := range tests {
+		out := blockInFile(test.in, "app", "a\nb\n")
+		if out != test.expected {
+			t.Fatalf("Unexpected output for %q: %q", test.in, out)
+		}
+	}
+}
+
+// TestReplaceRemote tests editing remote files via SFTP.
+func TestReplaceRemote(t *testing.T) {
+
+	client, stop := sftpClient(t)
+	defer stop()
+
+	remoteFile(t, client, "/etc/hosts", "127.0.0.1 localhost\n")
+
+	//
+	// A stale temporary file, from an earlier failure, is replaced.
+	//
+	remoteFile(t, client, "/etc/.hosts.deployr", "stale")
+
+	e := New(nil)
+	edit := func(in string) string {
+		return lineInFile(in, nil, "127.0.0.1 app")
+	}
+
+	changed, err := e.replaceRemote(client, "/etc/hosts", edit)
+	if err != nil || !changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+
+	f, err := client.Open("/etc/hosts")
+	if err != nil {
+		t.Fatalf("Failed to open edited file: %s", err.Error())
+	}
+	data, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(data) != "127.0.0.1 localhost\n127.0.0.1 app\n" {
+		t.Fatalf("Unexpected content %q", data)
+	}
+
+	if _, err = client.Stat("/etc/.hosts.deployr"); err == nil {
+		t.Fatalf("Expected the temporary file to be gone")
+	}
+
+	//
+	// A second edit changes nothing.
+	//
+	changed, err = e.replaceRemote(client, "/etc/hosts", edit)
+	if err != nil || changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+
+	//
+	// Missing files are created.
+	//
+	changed, err = e.replaceRemote(client, "/etc/new", edit)
+	if err != nil || !changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+}
+
+// TestEditFileSudo tests editing files via sudo.
+func TestEditFileSudo(t *testing.T) {
+
+	e, bin, stop := sshServer(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "edit")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	hosts := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(hosts, []byte("127.0.0.1 localhost\n"), 0640)
+
+	edit := func(in string) string {
+		return lineInFile(in, nil, "127.0.0.1 app")
+	}
+
+	//
+	// Neither sudo's warnings, nor terminal line-endings, should be
+	// mistaken for the content of the file.
+	//
+	ioutil.WriteFile(filepath.Join(bin, "warn"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(bin, "crlf"), nil, 0644)
+
+	opts := execOptions{Sudo: true}
+
+	changed, err := e.editFile(hosts, edit, opts)
+	if err != nil || !changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+	data, _ := ioutil.ReadFile(hosts)
+	if string(data) != "127.0.0.1 localhost\n127.0.0.1 app\n" {
+		t.Fatalf("Unexpected content %q", data)
+	}
+	fi, _ := os.Stat(hosts)
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("Wrong mode, got %s", fi.Mode())
+	}
+	if !strings.Contains(sshLog(bin, "sudo"), "base64") {
+		t.Fatalf("The file was not read via sudo: %s", sshLog(bin, "sudo"))
+	}
+
+	//
+	// A second edit changes nothing.
+	//
+	changed, err = e.editFile(hosts, edit, opts)
+	if err != nil || changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+
+	//
+	// Missing files are created.
+	//
+	created := filepath.Join(dir, "new")
+	changed, err = e.editFile(created, edit, opts)
+	if err != nil || !changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+	data, _ = ioutil.ReadFile(created)
+	if string(data) != "127.0.0.1 app\n" {
+		t.Fatalf("Unexpected content %q", data)
+	}
+
+	//
+	// Failures to write are reported.  (Our fake sudo loses the exit
+	// status of commands when it rewrites line-endings.)
+	//
+	os.Remove(filepath.Join(bin, "crlf"))
+
+	_, err = e.editFile(filepath.Join(dir, "missing", "hosts"), edit, opts)
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+}
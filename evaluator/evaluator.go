@@ -1,32 +1,37 @@
 // Package evaluator is the core of our run-time.
 //
-// Given a parsed series of statements we execute each of them in turn.
+// Given a parsed program we execute each of its statements in turn.
 package evaluator
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
-	"syscall"
 	"text/template"
 	"time"
 
+	"github.com/pkg/sftp"
 	"github.com/sfreiberg/simplessh"
-	"github.com/skx/deployr/statement"
+	"github.com/skx/deployr/ast"
 	"github.com/skx/deployr/util"
-	"golang.org/x/term"
+	"golang.org/x/crypto/ssh"
 )
 
+// maxRetryDelay is the longest we'll wait between connection attempts.
+const maxRetryDelay = 30 * time.Second
+
 // Evaluator holds our internal state.
 type Evaluator struct {
 
-	// Program is our parsed program, which is an array of statements.
-	Program []statement.Statement
+	// Program is our parsed program.
+	Program *ast.Program
 
 	// Identity holds the SSH key to authenticate with
 	Identity string
@@ -46,22 +51,111 @@ type Evaluator struct {
 	// for here first.
 	ROVariables map[string]string
 
+	// Strict is true if references to undefined variables are errors.
+	Strict bool
+
+	// ConnectTimeout is the maximum time to wait when connecting to
+	// the remote-host.
+	ConnectTimeout time.Duration
+
+	// ConnectRetries is the number of times a failed connection will
+	// be retried, with an increasing delay between attempts.
+	ConnectRetries int
+
+	// KeepAlive is the interval between SSH keepalive messages, which
+	// allows a dead connection to be detected.  Zero disables them.
+	KeepAlive time.Duration
+
 	// Connection holds the SSH-connection to the remote-host.
 	Connection *simplessh.Client
 
-	// Changed records whether the last copy operaton resulted in a change.
+	// BecomeMethod is the method used for privilege escalation, one
+	// of "sudo", "doas", or "su".
+	BecomeMethod string
+
+	// SudoNoPasswd is true if privileges should be escalated
+	// non-interactively, such that no password is required.
+	SudoNoPasswd bool
+
+	// SudoPasswordEnv is the name of an environmental variable
+	// holding the sudo password.
+	SudoPasswordEnv string
+
+	// SudoPasswordFD is a file-descriptor from which the sudo password
+	// is read, if it is non-negative.
+	SudoPasswordFD int
+
+	// SudoPasswordFile is the path to a file holding the sudo password.
+	SudoPasswordFile string
+
+	// SudoAskPass is a command which is executed to retrieve the
+	// sudo password.
+	SudoAskPass string
+
+	// SecretsIdentity is the path to an age identity-file used to
+	// decrypt secrets files.  If empty a passphrase is used instead.
+	SecretsIdentity string
+
+	// SecretPatterns holds glob-patterns, such as "*_TOKEN", matching
+	// the names of variables whose values should be redacted.
+	SecretPatterns []string
+
+	// secrets holds the values of secrets, which are redacted from
+	// our output.
+	secrets []string
+
+	// sudoPass holds the sudo password, once it has been retrieved.
+	sudoPass string
+
+	// become holds the users of any "Become" blocks we're within,
+	// innermost last.
+	become []string
+
+	// keepAliveDone is closed to stop sending keepalive messages.
+	keepAliveDone chan struct{}
+
+	// Changed records whether the last statement which records
+	// changes, such as a copy, resulted in a change.
 	Changed bool
+
+	// daemonReload records that a systemd unit file was changed,
+	// so systemd must reload its configuration before a service
+	// is next managed.
+	daemonReload bool
+
+	// packageManager holds the package manager of the remote host,
+	// once it has been detected.
+	packageManager *packageManager
+
+	// dial opens an SSH connection to the given destination, as the
+	// given user.  It is replaced when testing.
+	dial func(destination string, user string, timeout time.Duration) (*simplessh.Client, error)
+
+	// sleep pauses between connection attempts.  It is replaced when
+	// testing.
+	sleep func(time.Duration)
 }
 
 // New creates our evaluator object, which will execute the supplied
-// statements.
-func New(program []statement.Statement) *Evaluator {
+// program.
+func New(program *ast.Program) *Evaluator {
 	p := &Evaluator{Program: program}
 
 	// Setup the maps for storing variable names & values.
 	p.Variables = make(map[string]string)
 	p.ROVariables = make(map[string]string)
 
+	// Setup our connection defaults.
+	p.ConnectTimeout = simplessh.DefaultTimeout
+
+	// By default we escalate privileges via sudo, and don't read
+	// the password from a file-descriptor.
+	p.BecomeMethod = "sudo"
+	p.SudoPasswordFD = -1
+
+	p.dial = p.sshDial
+	p.sleep = time.Sleep
+
 	return p
 }
 
@@ -84,6 +178,38 @@ func (e *Evaluator) SetVerbose(verb bool) {
 	e.Verbose = verb
 }
 
+// SetStrict specifies whether references to undefined variables are
+// errors.
+func (e *Evaluator) SetStrict(strict bool) {
+	e.Strict = strict
+}
+
+// SetBecomeMethod specifies how privileges are escalated, via "sudo",
+// "doas", or "su".
+func (e *Evaluator) SetBecomeMethod(method string) error {
+	switch method {
+	case "sudo", "doas", "su":
+		e.BecomeMethod = method
+		return nil
+	}
+	return fmt.Errorf("unknown become method '%s' - expected sudo, doas, or su", method)
+}
+
+// SetConnectTimeout specifies how long we wait when connecting.
+func (e *Evaluator) SetConnectTimeout(timeout time.Duration) {
+	e.ConnectTimeout = timeout
+}
+
+// SetConnectRetries specifies how many times a failed connection is retried.
+func (e *Evaluator) SetConnectRetries(retries int) {
+	e.ConnectRetries = retries
+}
+
+// SetKeepAlive specifies the interval between SSH keepalive messages.
+func (e *Evaluator) SetKeepAlive(interval time.Duration) {
+	e.KeepAlive = interval
+}
+
 // ConnectTo opens the SSH connection to the specified target-host.
 //
 // If a connection is already open then it is maintained, and not replaced.
@@ -137,61 +263,808 @@ func (e *Evaluator) ConnectTo(target string) error {
 	destination := fmt.Sprintf("%s:%s", host, port)
 
 	//
-	// Finally connect.
+	// Finally connect, retrying with an increasing delay if
+	// that fails.
 	//
-	if util.HasSSHAgent() {
-		e.Connection, err = simplessh.ConnectWithAgent(destination, user)
-	} else {
-		e.Connection, err = simplessh.ConnectWithKeyFile(destination, user, e.Identity)
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+
+		e.Connection, err = e.dial(destination, user, e.ConnectTimeout)
+		if err == nil {
+			break
+		}
+
+		if attempt >= e.ConnectRetries {
+			return err
+		}
+
+		fmt.Printf("Failed to connect to %s - %s; retrying in %s\n", destination, err.Error(), delay)
+		e.sleep(delay)
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
 	}
-	if err != nil {
-		return err
+
+	//
+	// Start sending keepalives, if we should.
+	//
+	if e.KeepAlive > 0 {
+		e.keepAliveDone = make(chan struct{})
+		go e.keepAlive(e.Connection.SSHClient, e.KeepAlive, e.keepAliveDone)
 	}
 
 	return nil
 }
 
+// sshDial connects to the given destination, authenticating via the SSH
+// agent if there is one, or our identity file otherwise.
+//
+// Note that the timeout covers establishing the TCP connection, not the
+// SSH handshake which follows it.
+func (e *Evaluator) sshDial(destination string, user string, timeout time.Duration) (*simplessh.Client, error) {
+	if util.HasSSHAgent() {
+		return simplessh.ConnectWithAgentTimeout(destination, user, timeout)
+	}
+	return simplessh.ConnectWithKeyFileTimeout(destination, user, e.Identity, timeout)
+}
+
+// keepAlive sends a keepalive request to the remote host every interval,
+// until the done-channel is closed.
+//
+// If the remote host fails to reply within the interval the connection is
+// closed, so that any command which is waiting upon it will fail rather
+// than hang.
+func (e *Evaluator) keepAlive(client *ssh.Client, interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		//
+		// Sending a request blocks until it is answered, which
+		// may never happen if the link is dead, so we wait for
+		// the reply ourselves.
+		//
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		var err error
+		select {
+		case <-done:
+			return
+		case err = <-reply:
+		case <-time.After(interval):
+			err = fmt.Errorf("no reply to keepalive within %s", interval)
+		}
+
+		if err != nil {
+			fmt.Printf("Lost connection to remote-host: %s\n", err.Error())
+			client.Close()
+			return
+		}
+	}
+}
+
 // Run evaluates our program, continuing until all statements have been
 // executed - unless an error was encountered.
+//
+// Any secret values are redacted from the error which is returned.
 func (e *Evaluator) Run() error {
+	err := e.run()
+	if err != nil {
+		return errors.New(e.redact(err.Error()))
+	}
+	return nil
+}
+
+// run is the implementation of Run.
+func (e *Evaluator) run() error {
 
 	//
 	// Do any of our program-statements require the use of Sudo?
 	//
 	sudo := false
-	for _, statement := range e.Program {
-		if statement.Sudo {
+	ast.Walk(e.Program.Statements, func(s ast.Statement) {
+		if p, ok := s.(ast.Prefixed); ok && p.Prefixes().Sudo {
 			sudo = true
 		}
-	}
+		if _, ok := s.(*ast.BecomeStatement); ok {
+			sudo = true
+		}
+	})
 
 	//
-	// OK we need a sudo-password.  So prompt for it.
+	// OK we need a sudo-password.  So fetch it, unless we've been
+	// told that sudo won't require one.
 	//
-	sudoPassword := ""
-	if sudo {
-		fmt.Printf("Please enter your password for sudo: ")
-
-		text, err := term.ReadPassword(int(syscall.Stdin))
+	if sudo && !e.SudoNoPasswd {
+		var err error
+		e.sudoPass, err = e.sudoPassword()
 		if err != nil {
 			return err
 		}
-		fmt.Printf("\n")
-		sudoPassword = string(text)
 	}
 
-	//
-	// For each statement ..
-	//
-	for _, statement := range e.Program {
+	//
+	// Run each statement.
+	//
+	err := e.evaluate(e.Program.Statements)
+	if err != nil {
+		return err
+	}
+
+	//
+	// Disconnect from the remote host, if we connected.
+	//
+	if e.Connection != nil {
+		if e.Verbose {
+			e.printf("Disconnecting from remote-host\n")
+		}
+		if e.keepAliveDone != nil {
+			close(e.keepAliveDone)
+		}
+		e.Connection.Close()
+	}
+
+	//
+	// All done.
+	//
+	return nil
+}
+
+// evaluate executes each of the given statements in turn.
+func (e *Evaluator) evaluate(statements []ast.Statement) error {
+
+	//
+	// For each statement ..
+	//
+	for _, statement := range statements {
+
+		//
+		// The action to be taken will depend upon the type
+		// of the statement.
+		//
+		switch statement := statement.(type) {
+
+		case *ast.BecomeStatement:
+
+			//
+			// Run the statements within the block, which
+			// inherit the escalation.
+			//
+			if e.Verbose {
+				e.printf("Become(\"%s\")\n", statement.User.Literal)
+			}
+
+			e.become = append(e.become, statement.User.Literal)
+			err := e.evaluate(statement.Body)
+			e.become = e.become[:len(e.become)-1]
+			if err != nil {
+				return err
+			}
+
+		case *ast.BecomeMethodStatement:
+
+			//
+			// Change the method used for privilege escalation.
+			//
+			method := statement.Method.Literal
+
+			if e.Verbose {
+				e.printf("BecomeMethod(\"%s\")\n", method)
+			}
+
+			err := e.SetBecomeMethod(method)
+			if err != nil {
+				return err
+			}
+
+		case *ast.CopyTemplateStatement:
+
+			//
+			// Ensure we're connected.
+			//
+			if e.Connection == nil {
+				return fmt.Errorf("tried to run a command, but not connected to a target")
+			}
+
+			//
+			// Get the arguments and run the copy.
+			//
+			src, err := e.expandString(statement.Source.Literal)
+			if err != nil {
+				return err
+			}
+			dst, err := e.expandString(statement.Destination.Literal)
+			if err != nil {
+				return err
+			}
+			opts := e.escalation(statement.Prefix)
+			if e.Verbose {
+				e.printPrefix(opts)
+				e.printf("CopyTemplate(\"%s\", \"%s\")\n", src, dst)
+			}
+
+			if e.NOP {
+				break
+			}
+			e.Changed = e.copyFiles(src, dst, true, opts)
+
+		case *ast.CopyFileStatement:
+
+			//
+			// Ensure we're connected.
+			//
+			if e.Connection == nil {
+				return fmt.Errorf("tried to run a command, but not connected to a target")
+			}
+
+			//
+			// Get the arguments and run the copy.
+			//
+			src, err := e.expandString(statement.Source.Literal)
+			if err != nil {
+				return err
+			}
+			dst, err := e.expandString(statement.Destination.Literal)
+			if err != nil {
+				return err
+			}
+			opts := e.escalation(statement.Prefix)
+
+			if e.Verbose {
+				e.printPrefix(opts)
+				e.printf("CopyFile(\"%s\", \"%s\")\n", src, dst)
+			}
+
+			if e.NOP {
+				break
+			}
+
+			e.Changed = e.copyFiles(src, dst, false, opts)
+
+		case *ast.DeployToStatement:
+
+			//
+			// Get the arguments, and connect.
+			//
+			arg, err := e.expandString(statement.Target.Literal)
+			if err != nil {
+				return err
+			}
+
+			if e.Verbose {
+				e.printf("DeployTo(\"%s\")\n", arg)
+			}
+
+			err = e.ConnectTo(arg)
+			if err != nil {
+				return err
+			}
+
+		case *ast.DirectoryStatement:
+
+			//
+			// Ensure we're connected.
+			//
+			if e.Connection == nil {
+				return fmt.Errorf("tried to run a command, but not connected to a target")
+			}
+
+			//
+			// Get the arguments.
+			//
+			dir, err := e.expandString(statement.Path.Literal)
+			if err != nil {
+				return err
+			}
+			mode, _ := ast.Option(statement.Options, "mode")
+			mode, err = e.expandString(mode)
+			if err != nil {
+				return err
+			}
+			owner, _ := ast.Option(statement.Options, "owner")
+			owner, err = e.expandString(owner)
+			if err != nil {
+				return err
+			}
+
+			opts := e.escalation(statement.Prefix)
+
+			if e.Verbose {
+				e.printPrefix(opts)
+				e.printf("Directory(\"%s\")\n", dir)
+			}
+
+			//
+			// We don't break if we're not running for real, as
+			// the changes which would be made are reported.
+			//
+			client, done, err := e.files(opts)
+			if err != nil {
+				return err
+			}
+			e.Changed, err = e.directory(client, e.execute, dir, mode, owner)
+			done()
+			if err != nil {
+				return fmt.Errorf("failed to manage directory '%s': %s", dir, err.Error())
+			}
+
+		case *ast.DownloadStatement:
+
+			//
+			// Ensure we're connected.
+			//
+			if e.Connection == nil {
+				return fmt.Errorf("tried to run a command, but not connected to a target")
+			}
+
+			//
+			// Get the arguments.
+			//
+			url, err := e.expandString(statement.URL.Literal)
+			if err != nil {
+				return err
+			}
+			dst, err := e.expandString(statement.Destination.Literal)
+			if err != nil {
+				return err
+			}
+			sum, _ := ast.Option(statement.Options, "sha256")
+			sum, err = e.expandString(sum)
+			if err != nil {
+				return err
+			}
+			mode, _ := ast.Option(statement.Options, "mode")
+			mode, err = e.expandString(mode)
+			if err != nil {
+				return err
+			}
+
+			opts := e.escalation(statement.Prefix)
+
+			if e.Verbose {
+				e.printPrefix(opts)
+				e.printf("Download(\"%s\", \"%s\")\n", url, dst)
+			}
+
+			//
+			// We don't break if we're not running for real, as
+			// the changes which would be made are reported.
+			//
+			e.Changed, err = e.download(&commandFS{run: e.execute, opts: opts}, url, dst, sum, mode)
+			if err != nil {
+				return err
+			}
+
+		case *ast.EnvStatement:
+
+			//
+			// Import the environmental variable, which must
+			// be set.
+			//
+			key := statement.Name.Literal
+
+			val, ok := os.LookupEnv(key)
+			if !ok {
+				return fmt.Errorf("required environmental variable $%s is not set", key)
+			}
+
+			e.SetVariable(key, val)
+
+			if e.Verbose {
+				e.printf("Env(\"%s\")\n", key)
+			}
+
+		case *ast.BlockInFileStatement:
+
+			//
+			// Ensure we're connected.
+			//
+			if e.Connection == nil {
+				return fmt.Errorf("tried to run a command, but not connected to a target")
+			}
+
+			//
+			// Get the path and options.
+			//
+			remote, err := e.expandString(statement.Path.Literal)
+			if err != nil {
+				return err
+			}
+			marker, ok := ast.Option(statement.Options, "marker")
+			if !ok {
+				marker = defaultMarker
+			}
+			marker, err = e.expandString(marker)
+			if err != nil {
+				return err
+			}
+			content, _ := ast.Option(statement.Options, "content")
+			content, err = e.expandString(content)
+			if err != nil {
+				return err
+			}
+			opts := e.escalation(statement.Prefix)
+
+			if e.Verbose {
+				e.printPrefix(opts)
+				e.printf("BlockInFile(\"%s\")\n", remote)
+			}
+
+			if e.NOP {
+				break
+			}
+
+			edit := func(in string) string {
+				return blockInFile(in, marker, content)
+			}
+			e.Changed, err = e.editFile(remote, edit, opts)
+			if err != nil {
+				return fmt.Errorf("failed to edit '%s': %s", remote, err.Error())
+			}
+
+		case *ast.FetchStatement:
+
+			//
+			// Ensure we're connected.
+			//
+			if e.Connection == nil {
+				return fmt.Errorf("tried to run a command, but not connected to a target")
+			}
+
+			//
+			// Get the arguments and fetch the file(s).
+			//
+			src, err := e.expandString(statement.Source.Literal)
+			if err != nil {
+				return err
+			}
+			dst, err := e.expandString(statement.Destination.Literal)
+			if err != nil {
+				return err
+			}
+
+			opts := e.escalation(statement.Prefix)
+
+			if e.Verbose {
+				e.printPrefix(opts)
+				e.printf("Fetch(\"%s\", \"%s\")\n", src, dst)
+			}
+
+			if e.NOP {
+				break
+			}
+
+			//
+			// With escalated privileges the files are read via
+			// our become-method, rather than SFTP.
+			//
+			if opts.Sudo {
+				err = e.fetchFiles(&commandFS{run: e.execute, opts: opts}, src, dst)
+				if err != nil {
+					return err
+				}
+				break
+			}
+
+			client, err := sftp.NewClient(e.Connection.SSHClient)
+			if err != nil {
+				return err
+			}
+			err = e.fetchFiles(sftpSource{client}, src, dst)
+			client.Close()
+			if err != nil {
+				return err
+			}
+
+		case *ast.IfChangedStatement:
+
+			//
+			// If the previous copy didn't change then we can
+			// just skip this command.
+			//
+			if !e.Changed {
+				break
+			}
+
+			//
+			// Ensure we're connected.
+			//
+			if e.Connection == nil {
+				return fmt.Errorf("tried to run a command, but not connected to a target")
+			}
+
+			//
+			// Get the command to execute.
+			//
+			cmd, err := e.expandString(statement.Command.Literal)
+			if err != nil {
+				return err
+			}
+			opts := e.escalation(statement.Prefix)
+
+			if e.Verbose {
+				e.printPrefix(opts)
+				e.printf("IfChanged(\"%s\")\n", cmd)
+			}
+
+			if e.NOP {
+				break
+			}
+
+			//
+			// Run via sudo or normally, with the optional timeout.
+			//
+			result, err := e.execute(cmd, opts)
+			if err != nil {
+				return (fmt.Errorf("failed to run command '%s': %s\n%s", cmd, err.Error(), result))
+			}
+
+			//
+			// Show the output
+			//
+			e.printf("%s", result)
+
+		case *ast.RemoveStatement:
+
+			//
+			// Ensure we're connected.
+			//
+			if e.Connection == nil {
+				return fmt.Errorf("tried to run a command, but not connected to a target")
+			}
+
+			//
+			// Get the arguments.
+			//
+			remote, err := e.expandString(statement.Path.Literal)
+			if err != nil {
+				return err
+			}
+
+			opts := e.escalation(statement.Prefix)
+
+			if e.Verbose {
+				e.printPrefix(opts)
+				e.printf("Remove(\"%s\")\n", remote)
+			}
+
+			//
+			// We don't break if we're not running for real, as
+			// the changes which would be made are reported.
+			//
+			client, done, err := e.files(opts)
+			if err != nil {
+				return err
+			}
+			e.Changed, err = e.remove(client, remote)
+			done()
+			if err != nil {
+				return fmt.Errorf("failed to remove '%s': %s", remote, err.Error())
+			}
+
+		case *ast.RunStatement:
+
+			//
+			// Ensure we're connected.
+			//
+			if e.Connection == nil {
+				return fmt.Errorf("tried to run a command, but not connected to a target")
+			}
+
+			cmd, err := e.expandString(statement.Command.Literal)
+			if err != nil {
+				return err
+			}
+			opts := e.escalation(statement.Prefix)
+
+			if e.Verbose {
+				e.printPrefix(opts)
+
+				e.printf("Run(\"%s\")\n", cmd)
+			}
+
+			if e.NOP {
+				break
+			}
+
+			//
+			// Run via sudo or normally, with the optional timeout.
+			//
+			result, err := e.execute(cmd, opts)
+			if err != nil {
+				return (fmt.Errorf("failed to run command '%s': %s\n%s", cmd, err.Error(), result))
+			}
+
+			//
+			// Show the output
+			//
+			e.printf("%s", result)
+
+		case *ast.LocalStatement:
+
+			//
+			// Get the command to execute, and the variable to
+			// store its output in, if any.
+			//
+			cmd, err := e.expandString(statement.Command.Literal)
+			if err != nil {
+				return err
+			}
+			name, capture := ast.Option(statement.Options, "set")
+
+			if e.Verbose {
+				e.printPrefix(execOptions{Timeout: statement.Timeout})
+				e.printf("Local(\"%s\")\n", cmd)
+			}
+
+			if e.NOP {
+				break
+			}
+
+			//
+			// Run the command upon the local host.
+			//
+			stdout, result, err := e.runLocal(cmd, statement.Timeout, capture)
+			if err != nil {
+				return (fmt.Errorf("failed to run local command '%s': %s\n%s", cmd, err.Error(), result))
+			}
+
+			//
+			// Show the output, and store the result.
+			//
+			e.printf("%s", result)
+
+			if capture {
+				val := strings.TrimRight(stdout, "\r\n")
+				if e.isSecretName(name) {
+					e.addSecret(val)
+				}
+				e.Variables[name] = val
+
+				if e.Verbose {
+					e.printf("Set(\"%s\", \"%s\")\n", name, val)
+				}
+			}
+
+		case *ast.RunScriptStatement:
+
+			//
+			// Ensure we're connected.
+			//
+			if e.Connection == nil {
+				return fmt.Errorf("tried to run a command, but not connected to a target")
+			}
+
+			//
+			// Get the arguments and options.
+			//
+			script, err := e.expandString(statement.Script.Literal)
+			if err != nil {
+				return err
+			}
+
+			var args []string
+			for _, arg := range statement.Args {
+				val, err := e.expandString(arg.Literal)
+				if err != nil {
+					return err
+				}
+				args = append(args, val)
+			}
+
+			interpreter, _ := ast.Option(statement.Options, "interpreter")
+			interpreter, err = e.expandString(interpreter)
+			if err != nil {
+				return err
+			}
+
+			expand := false
+			if val, ok := ast.Option(statement.Options, "template"); ok {
+				expand, err = strconv.ParseBool(val)
+				if err != nil {
+					return fmt.Errorf("invalid value for template '%s' - expected true or false", val)
+				}
+			}
+			opts := e.escalation(statement.Prefix)
+
+			if e.Verbose {
+				e.printPrefix(opts)
+
+				e.printf("RunScript(\"%s\"", script)
+				for _, arg := range args {
+					e.printf(", \"%s\"", arg)
+				}
+				e.printf(")\n")
+			}
+
+			if e.NOP {
+				break
+			}
+
+			result, err := e.runScript(script, args, interpreter, expand, opts)
+			if err != nil {
+				return (fmt.Errorf("failed to run script '%s': %s\n%s", script, err.Error(), result))
+			}
+
+			//
+			// Show the output
+			//
+			e.printf("%s", result)
+
+		case *ast.LoadSecretsStatement:
+
+			//
+			// Get the arguments and load the secrets.
+			//
+			file, err := e.expandString(statement.Path.Literal)
+			if err != nil {
+				return err
+			}
+
+			if e.Verbose {
+				e.printf("LoadSecrets(\"%s\")\n", file)
+			}
+
+			err = e.LoadSecrets(file)
+			if err != nil {
+				return err
+			}
+
+		case *ast.SetStatement:
+
+			//
+			// Get the arguments and set the variable.
+			//
+			key := statement.Name.Literal
+			val, err := e.expandString(statement.Value.Literal)
+			if err != nil {
+				return err
+			}
+
+			//
+			// If the name looks sensitive we'll redact the value.
+			//
+			if e.isSecretName(key) {
+				e.addSecret(val)
+			}
+
+			if e.Verbose {
+				e.printf("Set(\"%s\", \"%s\")\n", key, val)
+			}
+			e.Variables[key] = val
+
+		case *ast.SecretStatement:
+
+			//
+			// Get the arguments and set the variable, recording
+			// that the value must be redacted.
+			//
+			key := statement.Name.Literal
+			val, err := e.expandString(statement.Value.Literal)
+			if err != nil {
+				return err
+			}
+
+			e.addSecret(val)
 
-		//
-		// The action to be taken will depend upon the type
-		// of the token.
-		//
-		switch statement.Token.Type {
+			if e.Verbose {
+				e.printf("Secret(\"%s\", \"%s\")\n", key, val)
+			}
+			e.Variables[key] = val
 
-		case "CopyTemplate":
+		case *ast.WriteFileStatement:
 
 			//
 			// Ensure we're connected.
@@ -201,20 +1074,33 @@ func (e *Evaluator) Run() error {
 			}
 
 			//
-			// Get the arguments and run the copy.
+			// Get the arguments and write the file.
 			//
-			src := e.expandString(statement.Arguments[0].Literal)
-			dst := e.expandString(statement.Arguments[1].Literal)
+			dst, err := e.expandString(statement.Destination.Literal)
+			if err != nil {
+				return err
+			}
+			content, err := e.expandString(statement.Content.Literal)
+			if err != nil {
+				return err
+			}
+			opts := e.escalation(statement.Prefix)
+
 			if e.Verbose {
-				fmt.Printf("CopyTemplate(\"%s\", \"%s\")\n", src, dst)
+				e.printPrefix(opts)
+				e.printf("WriteFile(\"%s\")\n", dst)
 			}
 
 			if e.NOP {
 				break
 			}
-			e.Changed = e.copyFiles(src, dst, true)
 
-		case "CopyFile":
+			e.Changed, err = e.writeFile(content, dst, opts)
+			if err != nil {
+				return err
+			}
+
+		case *ast.GroupStatement:
 
 			//
 			// Ensure we're connected.
@@ -224,47 +1110,86 @@ func (e *Evaluator) Run() error {
 			}
 
 			//
-			// Get the arguments and run the copy.
+			// Get the name and options.
 			//
-			src := e.expandString(statement.Arguments[0].Literal)
-			dst := e.expandString(statement.Arguments[1].Literal)
+			name, err := e.expandString(statement.Name.Literal)
+			if err != nil {
+				return err
+			}
+			system, _ := ast.Option(statement.Options, "system")
+			system, err = e.expandString(system)
+			if err != nil {
+				return err
+			}
+			opts := e.escalation(statement.Prefix)
 
 			if e.Verbose {
-				fmt.Printf("CopyFile(\"%s\", \"%s\")\n", src, dst)
+				e.printPrefix(opts)
+				e.printf("Group(\"%s\")\n", name)
 			}
 
 			if e.NOP {
 				break
 			}
 
-			e.Changed = e.copyFiles(src, dst, false)
+			e.Changed, err = e.group(e.execute, name, system, opts)
+			if err != nil {
+				return err
+			}
 
-		case "DeployTo":
+		case *ast.LineInFileStatement:
 
 			//
-			// Get the arguments, and connect.
+			// Ensure we're connected.
 			//
-			arg := e.expandString(statement.Arguments[0].Literal)
-
-			if e.Verbose {
-				fmt.Printf("DeployTo(\"%s\")\n", arg)
+			if e.Connection == nil {
+				return fmt.Errorf("tried to run a command, but not connected to a target")
 			}
 
-			err := e.ConnectTo(arg)
+			//
+			// Get the path and options.
+			//
+			remote, err := e.expandString(statement.Path.Literal)
+			if err != nil {
+				return err
+			}
+			var re *regexp.Regexp
+			if pattern, ok := ast.Option(statement.Options, "regexp"); ok {
+				pattern, err = e.expandString(pattern)
+				if err != nil {
+					return err
+				}
+				re, err = regexp.Compile(pattern)
+				if err != nil {
+					return fmt.Errorf("invalid regexp '%s': %s", pattern, err.Error())
+				}
+			}
+			line, _ := ast.Option(statement.Options, "line")
+			line, err = e.expandString(line)
 			if err != nil {
 				return err
 			}
+			opts := e.escalation(statement.Prefix)
 
-		case "IfChanged":
+			if e.Verbose {
+				e.printPrefix(opts)
+				e.printf("LineInFile(\"%s\")\n", remote)
+			}
 
-			//
-			// If the previous copy didn't change then we can
-			// just skip this command.
-			//
-			if !e.Changed {
+			if e.NOP {
 				break
 			}
 
+			edit := func(in string) string {
+				return lineInFile(in, re, line)
+			}
+			e.Changed, err = e.editFile(remote, edit, opts)
+			if err != nil {
+				return fmt.Errorf("failed to edit '%s': %s", remote, err.Error())
+			}
+
+		case *ast.PackageStatement:
+
 			//
 			// Ensure we're connected.
 			//
@@ -273,45 +1198,83 @@ func (e *Evaluator) Run() error {
 			}
 
 			//
-			// Get the command to execute.
+			// Get the names and state.
 			//
-			cmd := e.expandString(statement.Arguments[0].Literal)
+			var names []string
+			for _, name := range statement.Names {
+				val, err := e.expandString(name.Literal)
+				if err != nil {
+					return err
+				}
+				names = append(names, strings.Fields(val)...)
+			}
+			state, ok := ast.Option(statement.Options, "state")
+			if !ok {
+				state = "present"
+			}
+			state, err := e.expandString(state)
+			if err != nil {
+				return err
+			}
+			opts := e.escalation(statement.Prefix)
 
 			if e.Verbose {
-				if statement.Sudo {
-					fmt.Printf("Sudo ")
-				}
-				fmt.Printf("IfChanged(\"%s\")\n", cmd)
+				e.printPrefix(opts)
+				e.printf("Package(\"%s\", state=%s)\n", strings.Join(names, " "), state)
 			}
 
 			if e.NOP {
 				break
 			}
 
+			e.Changed, err = e.packages(e.execute, names, state, opts)
+			if err != nil {
+				return err
+			}
+
+		case *ast.SymlinkStatement:
+
 			//
-			// Holder for results of execution.
+			// Ensure we're connected.
 			//
-			var result []byte
-			var err error
+			if e.Connection == nil {
+				return fmt.Errorf("tried to run a command, but not connected to a target")
+			}
 
 			//
-			// Run via sudo or normally.
+			// Get the arguments.
 			//
-			if statement.Sudo {
-				result, err = e.Connection.ExecSudo(cmd, sudoPassword)
-			} else {
-				result, err = e.Connection.Exec(cmd)
+			target, err := e.expandString(statement.Target.Literal)
+			if err != nil {
+				return err
 			}
+			link, err := e.expandString(statement.Link.Literal)
 			if err != nil {
-				return (fmt.Errorf("failed to run command '%s': %s\n%s", cmd, err.Error(), result))
+				return err
+			}
+
+			opts := e.escalation(statement.Prefix)
+
+			if e.Verbose {
+				e.printPrefix(opts)
+				e.printf("Symlink(\"%s\", \"%s\")\n", target, link)
 			}
 
 			//
-			// Show the output
+			// We don't break if we're not running for real, as
+			// the changes which would be made are reported.
 			//
-			fmt.Printf("%s", result)
+			client, done, err := e.files(opts)
+			if err != nil {
+				return err
+			}
+			e.Changed, err = e.symlink(client, target, link)
+			done()
+			if err != nil {
+				return fmt.Errorf("failed to create symlink '%s': %s", link, err.Error())
+			}
 
-		case "Run":
+		case *ast.UserStatement:
 
 			//
 			// Ensure we're connected.
@@ -320,87 +1283,133 @@ func (e *Evaluator) Run() error {
 				return fmt.Errorf("tried to run a command, but not connected to a target")
 			}
 
-			cmd := e.expandString(statement.Arguments[0].Literal)
-
-			if e.Verbose {
-				if statement.Sudo {
-					fmt.Printf("Sudo ")
+			//
+			// Get the name and options.
+			//
+			name, err := e.expandString(statement.Name.Literal)
+			if err != nil {
+				return err
+			}
+			values := make(map[string]string)
+			for _, opt := range []string{"home", "shell", "system", "groups"} {
+				val, _ := ast.Option(statement.Options, opt)
+				values[opt], err = e.expandString(val)
+				if err != nil {
+					return err
 				}
+			}
+			opts := e.escalation(statement.Prefix)
 
-				fmt.Printf("Run(\"%s\")\n", cmd)
+			if e.Verbose {
+				e.printPrefix(opts)
+				e.printf("User(\"%s\")\n", name)
 			}
 
 			if e.NOP {
 				break
 			}
 
-			//
-			// Holder for results of execution.
-			//
-			var result []byte
-			var err error
-
-			//
-			// Run via sudo or normally.
-			//
-			if statement.Sudo {
-				result, err = e.Connection.ExecSudo(cmd, sudoPassword)
-			} else {
-				result, err = e.Connection.Exec(cmd)
-			}
+			e.Changed, err = e.user(e.execute, name, values["home"], values["shell"], values["system"], values["groups"], opts)
 			if err != nil {
-				return (fmt.Errorf("failed to run command '%s': %s\n%s", cmd, err.Error(), result))
+				return err
 			}
 
+		case *ast.ServiceStatement:
+
 			//
-			// Show the output
+			// Ensure we're connected.
 			//
-			fmt.Printf("%s", result)
-
-		case "Set":
+			if e.Connection == nil {
+				return fmt.Errorf("tried to run a command, but not connected to a target")
+			}
 
 			//
-			// Get the arguments and set the variable.
+			// Get the name and options.
 			//
-			key := statement.Arguments[0].Literal
-			val := e.expandString(statement.Arguments[1].Literal)
+			name, err := e.expandString(statement.Name.Literal)
+			if err != nil {
+				return err
+			}
+			state, _ := ast.Option(statement.Options, "state")
+			state, err = e.expandString(state)
+			if err != nil {
+				return err
+			}
+			enabled, _ := ast.Option(statement.Options, "enabled")
+			enabled, err = e.expandString(enabled)
+			if err != nil {
+				return err
+			}
+			opts := e.escalation(statement.Prefix)
 
 			if e.Verbose {
-				fmt.Printf("Set(\"%s\", \"%s\")\n", key, val)
+				e.printPrefix(opts)
+				e.printf("Service(\"%s\"", name)
+				if state != "" {
+					e.printf(", state=%s", state)
+				}
+				if enabled != "" {
+					e.printf(", enabled=%s", enabled)
+				}
+				e.printf(")\n")
+			}
+
+			if e.NOP {
+				break
 			}
-			e.Variables[key] = val
 
-		case "Sudo":
+			e.Changed, err = e.service(e.execute, name, state, enabled, opts)
+			if err != nil {
+				return err
+			}
 
-			//
-			// This is an error?
-			//
 		default:
-			return fmt.Errorf("unhandled statement - %v", statement.Token)
+			return fmt.Errorf("unhandled statement - %v", statement.Keyword())
 		}
 	}
 
-	//
-	// Disconnect from the remote host, if we connected.
-	//
-	if e.Connection != nil {
-		if e.Verbose {
-			fmt.Printf("Disconnecting from remote-host\n")
+	return nil
+}
+
+// escalation returns the options used to execute a statement with the
+// given prefixes.
+//
+// An explicit "Sudo" prefix is used if present, otherwise the statement
+// inherits the user of the innermost "Become" block, if any.
+func (e *Evaluator) escalation(prefix ast.Prefix) execOptions {
+	opts := execOptions{Sudo: prefix.Sudo, User: prefix.SudoUser, Timeout: prefix.Timeout}
+
+	if !prefix.Sudo && len(e.become) > 0 {
+		opts.Sudo = true
+		opts.User = e.become[len(e.become)-1]
+		if opts.User == "root" {
+			opts.User = ""
 		}
-		e.Connection.Close()
 	}
+	return opts
+}
 
-	//
-	// All done.
-	//
-	return nil
+// printPrefix shows the prefixes a statement is executed with, such as
+// "Sudo -u www-data", when running verbosely.
+func (e *Evaluator) printPrefix(opts execOptions) {
+	if opts.Sudo {
+		e.printf("Sudo ")
+		if opts.User != "" {
+			e.printf("-u %s ", opts.User)
+		}
+	}
+	if opts.Timeout > 0 {
+		e.printf("Timeout %s ", opts.Timeout)
+	}
 }
 
 // copyFiles is designed to copy a file/template from the local
 // system to the remote host.
 //
 // It might be called with a glob, or with a single file.
-func (e *Evaluator) copyFiles(pattern string, destination string, expand bool) bool {
+//
+// If opts.Sudo is set the files are installed via sudo.
+func (e *Evaluator) copyFiles(pattern string, destination string, expand bool, opts execOptions) bool {
 
 	//
 	// If our input pattern ends with a "/" we just add "*"
@@ -421,7 +1430,7 @@ func (e *Evaluator) copyFiles(pattern string, destination string, expand bool) b
 	// Did we fail to find file(s)?
 	//
 	if len(files) < 1 {
-		fmt.Printf("Failed to find file(s) matching %s\n", pattern)
+		e.printf("Failed to find file(s) matching %s\n", pattern)
 		return false
 	}
 
@@ -433,7 +1442,7 @@ func (e *Evaluator) copyFiles(pattern string, destination string, expand bool) b
 		//
 		// OK just copying a single file.
 		//
-		return (e.copyFile(pattern, destination, expand))
+		return (e.copyFile(pattern, destination, expand, opts))
 	}
 
 	//
@@ -457,17 +1466,17 @@ func (e *Evaluator) copyFiles(pattern string, destination string, expand bool) b
 
 		fi, err := os.Stat(file)
 		if err != nil {
-			fmt.Printf("Failed to stat(%s) %s\n", file, err.Error())
+			e.printf("Failed to stat(%s) %s\n", file, err.Error())
 			continue
 		}
 		switch mode := fi.Mode(); {
 		case mode.IsDir():
 			if e.Verbose {
-				fmt.Printf("Skipping directory %s\n", file)
+				e.printf("Skipping directory %s\n", file)
 			}
 		case mode.IsRegular():
 			name := path.Base(file)
-			c := e.copyFile(file, destination+name, expand)
+			c := e.copyFile(file, destination+name, expand, opts)
 			if c {
 				changed = c
 			}
@@ -485,18 +1494,15 @@ func (e *Evaluator) copyFiles(pattern string, destination string, expand bool) b
 // * It only copies files if the local/remote differ.
 //
 // * It optionally expands template-variables.
-func (e *Evaluator) copyFile(local string, remote string, expand bool) bool {
-
-	//
-	// Did we result in a change?
-	//
-	changed := false
+//
+// The actual upload is handled by installFile.
+func (e *Evaluator) copyFile(local string, remote string, expand bool, opts execOptions) bool {
 
 	if e.Verbose {
 		if expand {
-			fmt.Printf("CopyTemplate(\"%s\",\"%s\")\n", local, remote)
+			e.printf("CopyTemplate(\"%s\",\"%s\")\n", local, remote)
 		} else {
-			fmt.Printf("CopyFile(\"%s\",\"%s\")\n", local, remote)
+			e.printf("CopyFile(\"%s\",\"%s\")\n", local, remote)
 		}
 
 	}
@@ -522,43 +1528,119 @@ func (e *Evaluator) copyFile(local string, remote string, expand bool) bool {
 		// If we can't read the input-file that's a fatal error.
 		//
 		if err != nil {
-			fmt.Printf("Failed to read local file to expand template-variables %s\n", err.Error())
+			e.printf("Failed to read local file to expand template-variables %s\n", err.Error())
 			os.Exit(11)
 		}
 
 		//
-		// Define a helper-function that users can call to get
-		// the variables they've set.
+		// Perform the expansion, failure is also fatal.
 		//
-		funcMap := template.FuncMap{
-			"get": func(s string) string {
-				if len(e.ROVariables[s]) > 0 {
-					return (e.ROVariables[s])
-				}
-				return (e.Variables[s])
-			},
-			"now": time.Now,
+		data, err = e.expandTemplate(data)
+		if err != nil {
+			e.printf("Failed to expand template-variables in %s: %s\n", local, err.Error())
+			os.Exit(11)
 		}
 
-		//
-		// Load the file as a template.
-		//
-		tmpl := template.Must(template.New("tmpl").Funcs(funcMap).Parse(string(data)))
-
-		//
-		// Now expand the template into a temporary-buffer.
-		//
-		buf := &bytes.Buffer{}
-		tmpl.Execute(buf, e.Variables)
-
 		//
 		// Finally write that to a temporary file, and ensure
 		// that is the source of the copy.
 		//
 		tmpfile, _ := ioutil.TempFile("", "tmpl")
 		local = tmpfile.Name()
-		ioutil.WriteFile(local, buf.Bytes(), 0600)
+		defer os.Remove(local)
+		ioutil.WriteFile(local, data, 0600)
+	}
+
+	changed, err := e.installFile(local, remote, opts)
+	if err != nil {
+		e.printf("Failed to copy '%s' to '%s': %s\n", local, remote, err.Error())
+	}
+	return changed
+}
+
+// expandTemplate expands the given template, returning the result.
+//
+// Variables are available within the template via "get", along with
+// the "env" and "now" functions.
+func (e *Evaluator) expandTemplate(data []byte) ([]byte, error) {
+
+	//
+	// Define a helper-function that users can call to get
+	// the variables they've set.
+	//
+	funcMap := template.FuncMap{
+		"get": func(s string) string {
+			if len(e.ROVariables[s]) > 0 {
+				return (e.ROVariables[s])
+			}
+			return (e.Variables[s])
+		},
+		"env": os.Getenv,
+		"now": time.Now,
+	}
+
+	//
+	// Load the file as a template.
+	//
+	tmpl, err := template.New("tmpl").Funcs(funcMap).Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// Now expand the template into a temporary-buffer.
+	//
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, e.Variables)
+	return buf.Bytes(), err
+}
+
+// writeFile writes the given content to the remote file, returning
+// whether that resulted in a change.
+//
+// The content is written to a local temporary file, which is then
+// installed exactly as a copied file would be.
+func (e *Evaluator) writeFile(content string, remote string, opts execOptions) (bool, error) {
+
+	tmpfile, err := ioutil.TempFile("", "write")
+	if err != nil {
+		return false, fmt.Errorf("failed to create temporary file: %s", err.Error())
+	}
+	defer os.Remove(tmpfile.Name())
+
+	_, err = tmpfile.WriteString(content)
+	tmpfile.Close()
+	if err != nil {
+		return false, fmt.Errorf("failed to write temporary file: %s", err.Error())
+	}
+
+	return e.installFile(tmpfile.Name(), remote, opts)
+}
+
+// installFile uploads the local file to the remote system, if the
+// two differ, returning whether that resulted in a change.
+//
+// Changes to systemd unit files are recorded, so that systemd may
+// reload its configuration before the next service is managed.
+func (e *Evaluator) installFile(local string, remote string, opts execOptions) (bool, error) {
+	changed, err := e.replaceFile(local, remote, opts)
+	if changed && isUnitFile(remote) {
+		e.daemonReload = true
 	}
+	return changed, err
+}
+
+// replaceFile uploads the local file to the remote system, if the
+// two differ, returning whether that resulted in a change.
+//
+// If opts.Sudo is set the file is uploaded to a temporary location and
+// then installed via sudo, so that restricted destinations may be used.
+func (e *Evaluator) replaceFile(local string, remote string, opts execOptions) (bool, error) {
+
+	//
+	// Did we result in a change?
+	//
+	changed := false
 
 	//
 	// Copying a file to the remote host is
@@ -577,7 +1659,7 @@ func (e *Evaluator) copyFile(local string, remote string, expand bool) bool {
 	var err error
 	hashLocal, err = util.HashFile(local)
 	if err != nil {
-		fmt.Printf("Failed to hash local file %s\n", err.Error())
+		e.printf("Failed to hash local file %s\n", err.Error())
 
 		//
 		// If we're trying to copy a file that doesn't exist that
@@ -586,6 +1668,18 @@ func (e *Evaluator) copyFile(local string, remote string, expand bool) bool {
 		os.Exit(11)
 	}
 
+	//
+	// If we're using sudo then the remote file might not be readable,
+	// or writeable, by the user we've connected as.
+	//
+	if opts.Sudo {
+		changed, err = e.sudoCopy(local, remote, hashLocal, opts)
+		if err != nil {
+			return changed, fmt.Errorf("failed to upload via sudo: %s", err.Error())
+		}
+		return changed, nil
+	}
+
 	//
 	// Now fetch the file from the remote host, if we can.
 	//
@@ -602,26 +1696,18 @@ func (e *Evaluator) copyFile(local string, remote string, expand bool) bool {
 		var hashRemote string
 		hashRemote, err = util.HashFile(tmpfile.Name())
 		if err != nil {
-			fmt.Printf("Failed to hash remote file %s\n", err.Error())
-
-			// If expanding variables we replaced our
-			// input-file with the temporary result of
-			// expansion.
-			if expand {
-				os.Remove(local)
-			}
-			return changed
+			return changed, fmt.Errorf("failed to hash remote file: %s", err.Error())
 		}
 
 		if hashRemote != hashLocal {
 			if e.Verbose {
-				fmt.Printf("\tFile on remote host needs replacing.\n")
+				e.printf("\tFile on remote host needs replacing.\n")
 			}
 
 			changed = true
 		} else {
 			if e.Verbose {
-				fmt.Printf("\tFile on remote host doesn't need to be changed.\n")
+				e.printf("\tFile on remote host doesn't need to be changed.\n")
 			}
 		}
 	} else {
@@ -641,31 +1727,29 @@ func (e *Evaluator) copyFile(local string, remote string, expand bool) bool {
 	if changed {
 		err = e.Connection.Upload(local, remote)
 		if err != nil {
-			fmt.Printf("Failed to upload '%s' to '%s': %s\n", local, remote, err.Error())
-
-			// If expanding variables we replaced our
-			// input-file with the temporary result of
-			// expansion.
-			if expand {
-				os.Remove(local)
-			}
-
-			return changed
+			return changed, fmt.Errorf("failed to upload: %s", err.Error())
 		}
 	}
-	// If expanding variables we replaced our
-	// input-file with the temporary result of
-	// expansion.
-	if expand {
-		os.Remove(local)
-	}
 
-	return changed
+	return changed, nil
 }
 
 // expandString expands tokens of the form "${blah}" into the
-// value of the variable "blah".
-func (e *Evaluator) expandString(in string) string {
+// value of the variable "blah", and tokens of the form "${env:blah}"
+// into the value of the environmental variable "blah".
+//
+// Some shell-like modifiers are supported:
+//
+//	${blah:-default}  The value, or "default" if unset.
+//	${blah:?message}  The value, or an error containing "message" if unset.
+//	${blah^^}         The value in upper-case.
+//	${blah,,}         The value in lower-case.
+//
+// Unresolved references are left alone, unless we're running in strict
+// mode in which case they're an error.
+func (e *Evaluator) expandString(in string) (string, error) {
+
+	var err error
 
 	//
 	// Expand any variables which have previously been
@@ -674,28 +1758,91 @@ func (e *Evaluator) expandString(in string) string {
 	re := regexp.MustCompile(`\$\{([^\}]+)\}`)
 	in = re.ReplaceAllStringFunc(in, func(in string) string {
 
-		in = strings.TrimPrefix(in, "${")
-		in = strings.TrimSuffix(in, "}")
+		//
+		// Once we've seen an error we stop expanding.
+		//
+		if err != nil {
+			return in
+		}
+
+		ref := strings.TrimPrefix(in, "${")
+		ref = strings.TrimSuffix(ref, "}")
+
+		//
+		// Split the name from any modifier.
+		//
+		name, modifier, arg := ast.SplitReference(ref)
 
-		// Look for read-only variables first
-		if len(e.ROVariables[in]) > 0 {
-			return (e.ROVariables[in])
+		val, ok := e.lookupVariable(name)
+
+		switch modifier {
+		case ":-":
+			if !ok {
+				val, ok = arg, true
+			}
+		case ":?":
+			if !ok {
+				if arg == "" {
+					arg = "parameter not set"
+				}
+				err = fmt.Errorf("%s: %s", name, arg)
+				return in
+			}
+		case "^^":
+			val = strings.ToUpper(val)
+		case ",,":
+			val = strings.ToLower(val)
 		}
 
-		// Now look for normal-variable
-		if len(e.Variables[in]) > 0 {
-			return (e.Variables[in])
+		if ok {
+			return val
 		}
 
-		// Finally we found neither, just leave the
-		// expansion alone.
-		return "${" + in + "}"
+		//
+		// Finally we found nothing, so just leave the expansion
+		// alone - unless we're in strict mode.
+		//
+		if e.Strict {
+			err = fmt.Errorf("reference to undefined variable '%s'", name)
+		}
+		return in
 	})
 
-	return in
+	return in, err
+}
+
+// lookupVariable returns the value of the named variable, if it is set.
+//
+// Names of the form "env:blah" refer to environmental variables, other
+// names are looked for in our read-only variables first, then in our
+// normal variables.
+func (e *Evaluator) lookupVariable(name string) (string, bool) {
+
+	// Look for environmental variables
+	if strings.HasPrefix(name, "env:") {
+		return os.LookupEnv(strings.TrimPrefix(name, "env:"))
+	}
+
+	// Look for read-only variables first
+	if len(e.ROVariables[name]) > 0 {
+		return e.ROVariables[name], true
+	}
+
+	// Now look for normal-variable
+	if len(e.Variables[name]) > 0 {
+		return e.Variables[name], true
+	}
+
+	return "", false
 }
 
 // SetVariable sets the content of a read-only variable
+//
+// If the name of the variable matches one of our secret patterns the
+// value will be redacted from our output.
 func (e *Evaluator) SetVariable(key string, val string) {
+	if e.isSecretName(key) {
+		e.addSecret(val)
+	}
 	e.ROVariables[key] = val
 }
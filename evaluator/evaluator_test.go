@@ -0,0 +1,297 @@
+package evaluator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skx/deployr/ast"
+	"github.com/skx/deployr/token"
+)
+
+// TestExpandEnv tests that environmental variables are expanded.
+func TestExpandEnv(t *testing.T) {
+
+	os.Setenv("DEPLOYR_TEST_RELEASE", "1.2")
+	defer os.Unsetenv("DEPLOYR_TEST_RELEASE")
+
+	e := New(nil)
+	e.SetVariable("name", "steve")
+
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"${name}", "steve"},
+		{"release-${env:DEPLOYR_TEST_RELEASE}", "release-1.2"},
+		{"${env:DEPLOYR_TEST_MISSING}", "${env:DEPLOYR_TEST_MISSING}"},
+	}
+
+	for _, tst := range tests {
+		out, err := e.expandString(tst.input)
+		if err != nil {
+			t.Fatalf("Unexpected error expanding '%s': %s", tst.input, err.Error())
+		}
+		if out != tst.output {
+			t.Fatalf("Expanding '%s' gave '%s', expected '%s'", tst.input, out, tst.output)
+		}
+	}
+}
+
+// TestEnv tests that the Env primitive imports a variable, and fails
+// if it is missing.
+func TestEnv(t *testing.T) {
+
+	os.Setenv("DEPLOYR_TEST_RELEASE", "1.2")
+	defer os.Unsetenv("DEPLOYR_TEST_RELEASE")
+
+	env := &ast.EnvStatement{
+		Base: ast.Base{Token: token.Token{Type: "Env", Literal: "Env"}},
+		Name: token.Token{Type: "IDENT", Literal: "DEPLOYR_TEST_RELEASE"},
+	}
+	program := &ast.Program{Statements: []ast.Statement{env}}
+
+	e := New(program)
+	err := e.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if e.ROVariables["DEPLOYR_TEST_RELEASE"] != "1.2" {
+		t.Fatalf("Variable was not imported")
+	}
+
+	env.Name.Literal = "DEPLOYR_TEST_MISSING"
+	e = New(program)
+	err = e.Run()
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+	if !strings.Contains(err.Error(), "not set") {
+		t.Fatalf("Our error was misleading: %s", err.Error())
+	}
+}
+
+// TestExpandModifiers tests the shell-like modifiers.
+func TestExpandModifiers(t *testing.T) {
+
+	os.Setenv("DEPLOYR_TEST_RELEASE", "1.2")
+	defer os.Unsetenv("DEPLOYR_TEST_RELEASE")
+
+	e := New(nil)
+	e.SetVariable("name", "Steve")
+
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"${name:-bob}", "Steve"},
+		{"${missing:-bob}", "bob"},
+		{"${missing:-}", ""},
+		{"${missing:-a b c}", "a b c"},
+		{"${name:?must be set}", "Steve"},
+		{"${name^^}", "STEVE"},
+		{"${name,,}", "steve"},
+		{"${missing^^}", "${missing^^}"},
+		{"${env:DEPLOYR_TEST_RELEASE:-0.1}", "1.2"},
+		{"${env:DEPLOYR_TEST_MISSING:-0.1}", "0.1"},
+	}
+
+	for _, tst := range tests {
+		out, err := e.expandString(tst.input)
+		if err != nil {
+			t.Fatalf("Unexpected error expanding '%s': %s", tst.input, err.Error())
+		}
+		if out != tst.output {
+			t.Fatalf("Expanding '%s' gave '%s', expected '%s'", tst.input, out, tst.output)
+		}
+	}
+}
+
+// TestExpandErrors tests required variables, and strict mode.
+func TestExpandErrors(t *testing.T) {
+
+	e := New(nil)
+	e.SetVariable("name", "Steve")
+
+	_, err := e.expandString("${missing:?must be set}")
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+	if err.Error() != "missing: must be set" {
+		t.Fatalf("Our error was misleading: %s", err.Error())
+	}
+
+	_, err = e.expandString("${missing:?}")
+	if err == nil || !strings.Contains(err.Error(), "not set") {
+		t.Fatalf("Expected a default error, got %v", err)
+	}
+
+	//
+	// Unresolved references are only errors in strict mode.
+	//
+	out, err := e.expandString("${name} ${missing}")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if out != "Steve ${missing}" {
+		t.Fatalf("Unexpected expansion: %s", out)
+	}
+
+	e.SetStrict(true)
+	_, err = e.expandString("${name} ${missing}")
+	if err == nil {
+		t.Fatalf("Expected an error in strict mode, got none")
+	}
+	if !strings.Contains(err.Error(), "'missing'") {
+		t.Fatalf("Our error was misleading: %s", err.Error())
+	}
+}
+
+// TestLocal tests running commands upon the local host.
+func TestLocal(t *testing.T) {
+
+	local := func(command string, options ...string) *ast.LocalStatement {
+		s := &ast.LocalStatement{
+			Base:    ast.Base{Token: token.Token{Type: token.LOCAL, Literal: "Local"}},
+			Command: token.Token{Type: token.STRING, Literal: command},
+		}
+		for _, opt := range options {
+			s.Options = append(s.Options, token.Token{Type: token.IDENT, Literal: opt})
+		}
+		return s
+	}
+
+	program := &ast.Program{Statements: []ast.Statement{
+		local("echo hello", "set=GREETING"),
+		local("echo ${GREETING} world", "set=MESSAGE"),
+	}}
+
+	e := New(program)
+	err := e.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if e.Variables["MESSAGE"] != "hello world" {
+		t.Fatalf("Unexpected output '%s'", e.Variables["MESSAGE"])
+	}
+
+	//
+	// Failing commands fail the recipe.
+	//
+	e = New(&ast.Program{Statements: []ast.Statement{local("echo oops; exit 3")}})
+	err = e.Run()
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") || !strings.Contains(err.Error(), "oops") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+
+	//
+	// As do those which take too long.
+	//
+	slow := local("sleep 5")
+	slow.Timeout = 10 * time.Millisecond
+	e = New(&ast.Program{Statements: []ast.Statement{slow}})
+	err = e.Run()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+
+	//
+	// Any children the command started are killed too.
+	//
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	marker := filepath.Join(dir, "marker")
+
+	slow = local("(sleep 1; touch " + marker + ") & wait")
+	slow.Timeout = 100 * time.Millisecond
+	e = New(&ast.Program{Statements: []ast.Statement{slow}})
+	err = e.Run()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if _, err = os.Stat(marker); err == nil {
+		t.Fatalf("The child process was not killed")
+	}
+}
+
+// TestWriteFile tests writing files upon the remote host.
+func TestWriteFile(t *testing.T) {
+
+	//
+	// We evaluate statements directly, since running a program
+	// closes our connection once it completes.
+	//
+	e, bin, stop := sshServer(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "write")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(dst string, content string) *ast.WriteFileStatement {
+		return &ast.WriteFileStatement{
+			Base:        ast.Base{Token: token.Token{Type: token.WRITEFILE, Literal: "WriteFile"}},
+			Destination: token.Token{Type: token.STRING, Literal: dst},
+			Content:     token.Token{Type: token.STRING, Literal: content},
+		}
+	}
+
+	dst := filepath.Join(dir, "motd")
+
+	//
+	// The file is written, and then left alone.
+	//
+	for _, changed := range []bool{true, false} {
+		err = e.evaluate([]ast.Statement{write(dst, "Welcome\n")})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if e.Changed != changed {
+			t.Fatalf("Expected changed to be %t", changed)
+		}
+		data, _ := ioutil.ReadFile(dst)
+		if string(data) != "Welcome\n" {
+			t.Fatalf("Wrong content, got '%s'", data)
+		}
+	}
+
+	//
+	// Files may be written via sudo.
+	//
+	statement := write(dst, "Goodbye\n")
+	statement.Sudo = true
+	err = e.evaluate([]ast.Statement{statement})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	data, _ := ioutil.ReadFile(dst)
+	if !e.Changed || string(data) != "Goodbye\n" {
+		t.Fatalf("Wrong content, got '%s'", data)
+	}
+	if !strings.Contains(sshLog(bin, "sudo"), "sh -c") {
+		t.Fatalf("The file was not written via sudo")
+	}
+
+	//
+	// Failing to write the file fails the recipe.
+	//
+	for _, sudo := range []bool{false, true} {
+		statement = write(filepath.Join(dir, "missing", "motd"), "Welcome\n")
+		statement.Sudo = sudo
+		err = e.evaluate([]ast.Statement{statement})
+		if err == nil {
+			t.Fatalf("Expected an error, got none")
+		}
+	}
+}
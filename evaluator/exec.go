@@ -0,0 +1,322 @@
+package evaluator
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sudoPrompt is the prompt we ask sudo to display when it wants a
+// password, so that we can recognise the request and answer it.
+const sudoPrompt = "deployr_sudo_password"
+
+// timeoutStatus is the exit status of timeout(1) when it terminates a
+// command, and timeoutKillStatus that when it had to kill it.
+const (
+	timeoutStatus     = 124
+	timeoutKillStatus = 128 + 9
+)
+
+// timeoutGrace is how long we wait beyond a command's timeout for the
+// remote host to kill it, before we give up upon it ourselves.
+const timeoutGrace = 10 * time.Second
+
+// passwordPrompt is the text we look for when doas or su want a password,
+// since unlike sudo they don't allow the prompt to be specified.
+const passwordPrompt = "assword:"
+
+// outputWriter collects the combined stdout/stderr of a command.
+//
+// If a prompt is set the password will be written to stdin the first time
+// the prompt is seen, and the line holding the prompt is not recorded.
+// Stdin is then closed, so that if the password is wrong any further
+// prompt fails rather than waiting forever.
+type outputWriter struct {
+	buf      bytes.Buffer
+	prompt   string
+	password string
+	stdin    io.WriteCloser
+	m        sync.Mutex
+
+	// tty is true if the password is read from a terminal, which
+	// ends the line holding the prompt once it has been entered.
+	tty bool
+
+	// eol is true if the end of the line holding the prompt is
+	// still to be removed.
+	eol bool
+}
+
+// Write implements the io.Writer interface.
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	n := len(p)
+	if w.eol && len(p) > 0 {
+		p = w.trimEOL(p)
+	}
+	w.buf.Write(p)
+
+	if w.stdin == nil {
+		return n, nil
+	}
+
+	//
+	// The prompt may be split across writes, so we look for it in
+	// everything we've received.
+	//
+	data := w.buf.Bytes()
+	i := bytes.Index(data, []byte(w.prompt))
+	if i < 0 {
+		return n, nil
+	}
+
+	w.stdin.Write([]byte(w.password + "\n"))
+	w.stdin.Close()
+	w.stdin = nil
+
+	//
+	// Remove the line holding the prompt, such as
+	// "doas (user@host) password: ", along with what follows the
+	// prompt upon it.
+	//
+	start := bytes.LastIndexByte(data[:i], '\n') + 1
+	rest := append([]byte(nil), bytes.TrimLeft(data[i+len(w.prompt):], " ")...)
+	w.buf.Truncate(start)
+
+	w.eol = w.tty
+	if w.eol && len(rest) > 0 {
+		rest = w.trimEOL(rest)
+	}
+	w.buf.Write(rest)
+	return n, nil
+}
+
+// trimEOL removes the line-ending which starts the given output, if any,
+// as the end of the line holding the prompt.
+func (w *outputWriter) trimEOL(p []byte) []byte {
+	w.eol = false
+	if bytes.HasPrefix(p, []byte("\r\n")) {
+		return p[2:]
+	}
+	if bytes.HasPrefix(p, []byte("\n")) {
+		return p[1:]
+	}
+	return p
+}
+
+// Bytes returns the output which has been collected.
+func (w *outputWriter) Bytes() []byte {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.buf.Bytes()
+}
+
+// execOptions control how a command is executed upon the remote host.
+type execOptions struct {
+
+	// Sudo is true if the command should be executed via sudo.
+	Sudo bool
+
+	// User is the user sudo should run the command as, if not root.
+	User string
+
+	// Timeout is the time after which the command is killed, if
+	// it has not completed.  Zero means no timeout.
+	Timeout time.Duration
+}
+
+// execute runs the given command upon the remote host, returning the
+// combined stdout/stderr output.
+//
+// If opts.Sudo is true the command is executed via our become-method,
+// answering any password-prompt with the sudo password, or
+// non-interactively if no password is required.
+//
+// If opts.Timeout is non-zero the command is killed if it fails to
+// complete within that period.  This is done upon the remote host, via
+// timeout(1), so that any children the command started are killed too,
+// even if it was run via sudo, doas, or su.
+func (e *Evaluator) execute(cmd string, opts execOptions) ([]byte, error) {
+
+	session, err := e.Connection.SSHClient.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	out := &outputWriter{}
+
+	if opts.Timeout > 0 {
+		cmd = withTimeout(cmd, opts.Timeout)
+	}
+
+	//
+	// If we're escalating privileges we need to be able to answer
+	// the password-prompt - unless we're running non-interactively.
+	//
+	if opts.Sudo {
+		var prompt string
+		var tty bool
+
+		cmd, prompt, tty = e.escalate(cmd, opts.User)
+
+		if prompt != "" {
+			out.prompt = prompt
+			out.password = e.sudoPass
+			out.tty = tty
+			out.stdin, err = session.StdinPipe()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		//
+		// doas and su read passwords from the terminal.
+		//
+		if tty {
+			modes := ssh.TerminalModes{
+				ssh.ECHO: 0,
+			}
+			err = session.RequestPty("dumb", 24, 80, modes)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	session.Stdout = out
+	session.Stderr = out
+
+	start := time.Now()
+	err = session.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// No timeout?  Then just wait for completion.
+	//
+	if opts.Timeout == 0 {
+		err = session.Wait()
+		return out.Bytes(), err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		if exit, ok := err.(*ssh.ExitError); ok && time.Since(start) >= opts.Timeout {
+			if exit.ExitStatus() == timeoutStatus || exit.ExitStatus() == timeoutKillStatus {
+				err = fmt.Errorf("command timed out after %s", opts.Timeout)
+			}
+		}
+		return out.Bytes(), err
+	case <-time.After(opts.Timeout + timeoutGrace):
+
+		//
+		// The remote host failed to kill the command, so we
+		// try ourselves, and close the session so that we don't
+		// wait upon it any further.
+		//
+		// The signal only reaches the process the SSH server
+		// started, and only if that runs as our login user.
+		//
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		return out.Bytes(), fmt.Errorf("command timed out after %s", opts.Timeout)
+	}
+}
+
+// withTimeout wraps the given command such that timeout(1) kills it, and
+// any children it started, if it hasn't completed within the given
+// period.
+//
+// The command is asked to terminate first, and killed if it is still
+// running half of timeoutGrace later.
+func withTimeout(cmd string, timeout time.Duration) string {
+	return "timeout -k " + seconds(timeoutGrace/2) + " " + seconds(timeout) + " sh -c " + shellQuote(cmd)
+}
+
+// seconds formats the given duration as timeout(1) expects, such as "1.5s".
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+// escalate wraps the given command such that it runs as the given user,
+// or root if that is empty, via our become-method.
+//
+// The password-prompt the wrapped command will display is returned, if
+// a password is required, along with whether a terminal is required.
+func (e *Evaluator) escalate(cmd string, user string) (string, string, bool) {
+
+	switch e.BecomeMethod {
+	case "doas":
+		prefix := "doas "
+		if user != "" {
+			prefix += "-u " + shellQuote(user) + " "
+		}
+		if e.SudoNoPasswd {
+			return prefix + "-n " + cmd, "", false
+		}
+		return prefix + cmd, passwordPrompt, true
+
+	case "su":
+		prefix := "su "
+		if user != "" {
+			prefix += shellQuote(user) + " "
+		}
+		prefix += "-c " + shellQuote(cmd)
+		if e.SudoNoPasswd {
+			return prefix, "", false
+		}
+		return prefix, passwordPrompt, true
+
+	default:
+		prefix := "sudo "
+		if user != "" {
+			prefix += "-u " + shellQuote(user) + " "
+		}
+		if e.SudoNoPasswd {
+			return prefix + "-n " + cmd, "", false
+		}
+		return prefix + "-p " + sudoPrompt + " -S " + cmd, sudoPrompt, false
+	}
+}
+
+// markOutput wraps the given command such that each line of its output is
+// prefixed by the given marker, for markedLines to find, while keeping its
+// exit status.
+func markOutput(cmd string, marker string) string {
+	return "sh -c " + shellQuote("out=$("+cmd+"); status=$?; [ -z \"$out\" ] || printf '%s\\n' \"$out\" | sed 's/^/"+marker+" /'; exit $status")
+}
+
+// markedLines returns the remainder of each line of the given output which
+// starts with the given marker, ignoring anything else, such as warnings
+// from sudo, and the line-endings of the terminal doas and su require.
+func markedLines(out []byte, marker string) []string {
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, marker+" ") {
+			lines = append(lines, strings.TrimPrefix(line, marker+" "))
+		}
+	}
+	return lines
+}
+
+// shellQuote quotes the given string such that it will be treated as a
+// single word by the remote shell.
+func shellQuote(in string) string {
+	return "'" + strings.Replace(in, "'", `'\''`, -1) + "'"
+}
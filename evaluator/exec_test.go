@@ -0,0 +1,421 @@
+package evaluator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sfreiberg/simplessh"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestExecute tests running commands, with and without sudo.
+func TestExecute(t *testing.T) {
+
+	e, bin, stop := sshServer(t)
+	defer stop()
+
+	out, err := e.execute("echo hello", execOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if string(out) != "hello\n" {
+		t.Fatalf("Wrong output, got '%s'", out)
+	}
+
+	out, err = e.execute("echo hello", execOptions{Sudo: true, User: "bob"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if string(out) != "hello\n" {
+		t.Fatalf("Wrong output, got '%s'", out)
+	}
+	if sshLog(bin, "sudo") != "-u bob -n echo hello\n" {
+		t.Fatalf("Wrong sudo invocation, got '%s'", sshLog(bin, "sudo"))
+	}
+
+	_, err = e.execute("exit 3", execOptions{})
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+}
+
+// TestExecutePassword tests that sudo's password-prompt is answered, and
+// that a wrong password fails rather than waiting for another.
+func TestExecutePassword(t *testing.T) {
+
+	e, bin, stop := sshServer(t)
+	defer stop()
+
+	ioutil.WriteFile(filepath.Join(bin, "password"), []byte("secret\n"), 0644)
+	e.SudoNoPasswd = false
+	e.sudoPass = "secret"
+
+	out, err := e.execute("echo hello", execOptions{Sudo: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if string(out) != "hello\n" {
+		t.Fatalf("Wrong output, got '%s'", out)
+	}
+
+	e.sudoPass = "wrong"
+	result := make(chan error, 1)
+	go func() {
+		_, err := e.execute("echo hello", execOptions{Sudo: true})
+		result <- err
+	}()
+
+	select {
+	case err = <-result:
+		if err == nil {
+			t.Fatalf("Expected an error, got none")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("We waited for another password")
+	}
+}
+
+// TestExecuteBecomeMethods tests that the password-prompts of doas and su
+// are answered, and that they're removed from the output.
+func TestExecuteBecomeMethods(t *testing.T) {
+
+	e, bin, stop := sshServer(t)
+	defer stop()
+
+	ioutil.WriteFile(filepath.Join(bin, "password"), []byte("secret\n"), 0644)
+	e.SudoNoPasswd = false
+
+	for _, method := range []string{"doas", "su"} {
+		e.BecomeMethod = method
+
+		e.sudoPass = "secret"
+		out, err := e.execute("echo hello; echo world", execOptions{Sudo: true, User: "bob"})
+		if err != nil {
+			t.Fatalf("Unexpected error via %s: %s", method, err.Error())
+		}
+		if string(out) != "hello\nworld\n" {
+			t.Fatalf("Wrong output via %s, got '%s'", method, out)
+		}
+		if !strings.Contains(sshLog(bin, method), "bob") {
+			t.Fatalf("Wrong %s invocation, got '%s'", method, sshLog(bin, method))
+		}
+
+		e.sudoPass = "wrong"
+		out, err = e.execute("echo hello", execOptions{Sudo: true})
+		if err == nil || !strings.Contains(string(out), "Authentication fail") {
+			t.Fatalf("Expected an error via %s, got %v '%s'", method, err, out)
+		}
+	}
+}
+
+// TestOutputWriter tests that a password-prompt is recognised even if it
+// is split across writes, and that the line holding it is removed.
+func TestOutputWriter(t *testing.T) {
+
+	var stdin closeRecorder
+	w := &outputWriter{prompt: passwordPrompt, password: "secret", stdin: &stdin, tty: true}
+
+	for _, p := range []string{"warning: one\n", "doas (bob@host) pass", "word: ", "\r\nhello\n", "\nworld\n"} {
+		w.Write([]byte(p))
+	}
+	if string(w.Bytes()) != "warning: one\nhello\n\nworld\n" {
+		t.Fatalf("Wrong output, got '%s'", w.Bytes())
+	}
+	if stdin.String() != "secret\n" || !stdin.closed {
+		t.Fatalf("Wrong password sent, got '%s' %t", stdin.String(), stdin.closed)
+	}
+}
+
+// closeRecorder is a buffer which records whether it was closed.
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+// Close records that the buffer was closed.
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+// TestMarkOutput tests that the output of a command is found despite any
+// warnings from sudo, or terminal line-endings, keeping its exit status.
+func TestMarkOutput(t *testing.T) {
+
+	e, bin, stop := sshServer(t)
+	defer stop()
+
+	for _, flag := range []string{"warn", "crlf"} {
+		ioutil.WriteFile(filepath.Join(bin, flag), nil, 0644)
+	}
+
+	out, err := e.execute(markOutput("echo 'a b'; echo c", "deployr_test"), execOptions{Sudo: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	lines := markedLines(out, "deployr_test")
+	if len(lines) != 2 || lines[0] != "a b" || lines[1] != "c" {
+		t.Fatalf("Unexpected lines %q from '%s'", lines, out)
+	}
+
+	//
+	// The exit status is kept - though not by our fake sudo when it
+	// converts line-endings.
+	//
+	os.Remove(filepath.Join(bin, "crlf"))
+	out, err = e.execute(markOutput("echo a; exit 2", "deployr_test"), execOptions{Sudo: true})
+	if err == nil || !strings.Contains(err.Error(), "status 2") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+	if lines = markedLines(out, "deployr_test"); len(lines) != 1 || lines[0] != "a" {
+		t.Fatalf("Unexpected lines %q from '%s'", lines, out)
+	}
+
+	//
+	// Our fake commanders rely upon unwrapping the command.
+	//
+	cmd, marker, ok := unmarkOutput(markOutput("getent passwd 'app'", "deployr_test"))
+	if !ok || cmd != "getent passwd 'app'" || marker != "deployr_test" {
+		t.Fatalf("Unexpected unwrapping '%s' '%s' %t", cmd, marker, ok)
+	}
+}
+
+// unmarkOutput is a helper which returns the command wrapped by markOutput,
+// and its marker, so that fake commanders may recognise it.
+func unmarkOutput(cmd string) (string, string, bool) {
+	if !strings.HasPrefix(cmd, "sh -c '") {
+		return "", "", false
+	}
+	script := strings.Replace(strings.TrimSuffix(strings.TrimPrefix(cmd, "sh -c '"), "'"), `'\''`, "'", -1)
+
+	end := strings.Index(script, "); status=$?")
+	begin := strings.Index(script, "sed 's/^/")
+	if !strings.HasPrefix(script, "out=$(") || end < 0 || begin < 0 {
+		return "", "", false
+	}
+	marker := script[begin+len("sed 's/^/"):]
+	return script[len("out=$("):end], marker[:strings.Index(marker, " ")], true
+}
+
+// markedReply is a helper which returns the output a command wrapped by
+// markOutput would give, along with a warning from sudo, and terminal
+// line-endings, which should be ignored.
+func markedReply(marker string, output string) []byte {
+	reply := "sudo: unable to resolve host test\r\n"
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		if line != "" {
+			reply += marker + " " + line + "\r\n"
+		}
+	}
+	return []byte(reply)
+}
+
+// TestExecuteTimeout tests that a command which runs for too long is
+// killed upon the remote host.
+func TestExecuteTimeout(t *testing.T) {
+
+	e, bin, stop := sshServer(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "timeout")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	//
+	// The command is killed, along with any children it started,
+	// even if it runs via sudo.
+	//
+	for i, opts := range []execOptions{{}, {Sudo: true}} {
+		opts.Timeout = 100 * time.Millisecond
+		marker := filepath.Join(dir, fmt.Sprintf("marker-%d", i))
+
+		start := time.Now()
+		_, err = e.execute("(sleep 1; touch "+shellQuote(marker)+") & wait", opts)
+		if err == nil {
+			t.Fatalf("Expected an error, got none")
+		}
+		if !strings.Contains(err.Error(), "timed out after 100ms") {
+			t.Fatalf("Our error was misleading: %s", err.Error())
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("We waited for the command to complete")
+		}
+
+		//
+		// Had the command not been killed it would have created
+		// the marker by now.
+		//
+		time.Sleep(1500 * time.Millisecond)
+		if _, err = os.Stat(marker); err == nil {
+			t.Fatalf("The command was not killed")
+		}
+	}
+	if !strings.Contains(sshLog(bin, "sudo"), "-n timeout ") {
+		t.Fatalf("The timeout was not enforced via sudo: %s", sshLog(bin, "sudo"))
+	}
+
+	//
+	// A command which completes in time is fine.
+	//
+	out, err := e.execute("echo ok", execOptions{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if string(out) != "ok\n" {
+		t.Fatalf("Wrong output, got '%s'", out)
+	}
+}
+
+// TestConnectRetries tests that failed connections are retried, with an
+// increasing delay, and that our timeout is used.
+func TestConnectRetries(t *testing.T) {
+
+	type attempt struct {
+		destination string
+		user        string
+		timeout     time.Duration
+	}
+
+	var attempts []attempt
+	var delays []time.Duration
+
+	e := New(nil)
+	e.SetConnectTimeout(7 * time.Second)
+	e.SetConnectRetries(7)
+	e.sleep = func(d time.Duration) {
+		delays = append(delays, d)
+	}
+	e.dial = func(destination string, user string, timeout time.Duration) (*simplessh.Client, error) {
+		attempts = append(attempts, attempt{destination, user, timeout})
+		if len(attempts) < 8 {
+			return nil, errors.New("connection refused")
+		}
+		return &simplessh.Client{}, nil
+	}
+
+	err := e.ConnectTo("bob@example.com:2222")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(attempts) != 8 {
+		t.Fatalf("Expected 8 attempts, got %d", len(attempts))
+	}
+	for _, a := range attempts {
+		if a.destination != "example.com:2222" || a.user != "bob" || a.timeout != 7*time.Second {
+			t.Fatalf("Wrong connection attempt: %v", a)
+		}
+	}
+
+	expected := []time.Duration{1, 2, 4, 8, 16, 30, 30}
+	if len(delays) != len(expected) {
+		t.Fatalf("Expected %d delays, got %v", len(expected), delays)
+	}
+	for i, d := range expected {
+		if delays[i] != d*time.Second {
+			t.Fatalf("Wrong delay %d, got %s", i, delays[i])
+		}
+	}
+
+	//
+	// Running out of retries returns the last error.
+	//
+	attempts = nil
+	delays = nil
+
+	e = New(nil)
+	e.SetConnectRetries(2)
+	e.sleep = func(d time.Duration) {
+		delays = append(delays, d)
+	}
+	e.dial = func(destination string, user string, timeout time.Duration) (*simplessh.Client, error) {
+		attempts = append(attempts, attempt{destination, user, timeout})
+		return nil, errors.New("connection refused")
+	}
+
+	err = e.ConnectTo("example.com")
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+	if !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("Our error was misleading: %s", err.Error())
+	}
+	if len(attempts) != 3 || len(delays) != 2 {
+		t.Fatalf("Wrong number of attempts, got %d with %d delays", len(attempts), len(delays))
+	}
+	if attempts[0].destination != "example.com:22" || attempts[0].user != "root" {
+		t.Fatalf("Wrong defaults: %v", attempts[0])
+	}
+	if attempts[0].timeout != simplessh.DefaultTimeout {
+		t.Fatalf("Wrong default timeout, got %s", attempts[0].timeout)
+	}
+}
+
+// TestKeepAlive tests that a connection whose keepalives go unanswered
+// is closed.
+func TestKeepAlive(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	defer listener.Close()
+
+	//
+	// Our server completes the handshake, then ignores everything,
+	// as a host upon a black-holed link would.
+	//
+	config := sshConfig(t)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go func() {
+			for range chans {
+			}
+		}()
+		for range reqs {
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err.Error())
+	}
+	defer client.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	e := New(nil)
+	go e.keepAlive(client, 50*time.Millisecond, done)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.Wait()
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The connection was not closed")
+	}
+}
@@ -0,0 +1,212 @@
+package evaluator
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// globMarker prefixes the paths matching a glob, so that they can't be
+// confused with any warnings from sudo.
+const globMarker = "deployr_glob"
+
+// fetchSource holds the operations upon remote files which Fetch uses.
+//
+// It is implemented by sftpSource, which works as the user we connected
+// as, and by commandFS, which runs commands so that privileges may be
+// escalated.
+type fetchSource interface {
+	Glob(pattern string) ([]string, error)
+	Stat(p string) (os.FileInfo, error)
+	Open(p string) (io.ReadCloser, error)
+}
+
+// sftpSource fetches remote files via SFTP.
+type sftpSource struct {
+	*sftp.Client
+}
+
+// Open opens the given remote file for reading.
+func (s sftpSource) Open(p string) (io.ReadCloser, error) {
+	return s.Client.Open(p)
+}
+
+// Glob returns the remote paths matching the given pattern, which are
+// expanded by the remote shell.
+func (c *commandFS) Glob(pattern string) ([]string, error) {
+	script := "for f in " + globQuote(pattern) + "; do if [ -e \"$f\" ] || [ -L \"$f\" ]; then printf '" + globMarker + " %s\\n' \"$f\"; fi; done"
+	out, err := c.run("sh -c "+shellQuote(script), c.opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s\n%s", err.Error(), out)
+	}
+	return markedLines(out, globMarker), nil
+}
+
+// Open opens the given remote file for reading, which is read in full.
+func (c *commandFS) Open(p string) (io.ReadCloser, error) {
+	content, exists, err := sudoRead(c.run, p, c.opts)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(strings.NewReader(content)), nil
+}
+
+// globQuote quotes the given glob pattern such that the remote shell
+// will expand it, as path.Match would, but treat everything else within
+// it literally.
+//
+// Bracket expressions are only kept if they hold nothing which the shell
+// would treat specially, otherwise the bracket is literal.
+func globQuote(pattern string) string {
+	out := ""
+	literal := ""
+
+	//
+	// flush quotes the literal text we've collected.
+	//
+	flush := func() {
+		if literal != "" {
+			out += shellQuote(literal)
+			literal = ""
+		}
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*', '?':
+			flush()
+			out += string(c)
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			literal += string(pattern[i])
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 || !bracketSafe(pattern[i+1:i+1+end]) {
+				literal += "["
+				continue
+			}
+			flush()
+			out += pattern[i : i+end+2]
+			i += end + 1
+		default:
+			literal += string(c)
+		}
+	}
+	flush()
+	return out
+}
+
+// bracketSafe returns true if the given contents of a bracket expression
+// may be passed to the shell as they are.
+func bracketSafe(contents string) bool {
+	if contents == "" {
+		return false
+	}
+	for _, c := range contents {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!^-_.", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// fetchFiles downloads the remote file, or the remote files matching a
+// glob, to the local host via the given source.
+//
+// If a single file is named the destination is the local path to write
+// it to, unless it ends with "/".  Otherwise the destination is treated
+// as a directory, and each file is written within it.  Any missing local
+// directories are created.
+func (e *Evaluator) fetchFiles(client fetchSource, pattern string, destination string) error {
+
+	//
+	// Expand the pattern we received.
+	//
+	files, err := client.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(files) < 1 {
+		return fmt.Errorf("failed to find remote file(s) matching %s", pattern)
+	}
+
+	//
+	// If we're fetching more than a single file our destination
+	// must be a directory.
+	//
+	if !(len(files) == 1 && files[0] == pattern) && !strings.HasSuffix(destination, "/") {
+		destination += "/"
+	}
+
+	for _, file := range files {
+
+		fi, err := client.Stat(file)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if e.Verbose {
+				e.printf("\tSkipping directory %s\n", file)
+			}
+			continue
+		}
+
+		local := destination
+		if strings.HasSuffix(local, "/") {
+			local += path.Base(file)
+		}
+
+		if e.Verbose {
+			e.printf("\tFetching %s to %s\n", file, local)
+		}
+
+		err = fetchFile(client, file, local)
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s: %s", file, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// fetchFile downloads a single remote file to the given local path,
+// creating the local directory if required.
+func fetchFile(client fetchSource, remote string, local string) error {
+
+	err := os.MkdirAll(filepath.Dir(local), 0755)
+	if err != nil {
+		return err
+	}
+
+	in, err := client.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,194 @@
+package evaluator
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/skx/deployr/ast"
+	"github.com/skx/deployr/token"
+)
+
+// sftpClient is a helper which returns an SFTP client connected to an
+// in-memory server, along with a function to stop them.
+func sftpClient(t *testing.T) (*sftp.Client, func()) {
+
+	server, conn := net.Pipe()
+	srv := sftp.NewRequestServer(server, sftp.InMemHandler())
+	go srv.Serve()
+
+	client, err := sftp.NewClientPipe(conn, conn)
+	if err != nil {
+		t.Fatalf("Failed to create SFTP client: %s", err.Error())
+	}
+
+	return client, func() {
+		client.Close()
+		srv.Close()
+	}
+}
+
+// remoteFile is a helper which creates a file upon the SFTP server.
+func remoteFile(t *testing.T, client *sftp.Client, name string, content string) {
+	client.MkdirAll(filepath.Dir(name))
+	f, err := client.Create(name)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %s", name, err.Error())
+	}
+	f.Write([]byte(content))
+	f.Close()
+}
+
+// TestFetch tests downloading files, and globs of files.
+func TestFetch(t *testing.T) {
+
+	client, stop := sftpClient(t)
+	defer stop()
+
+	remoteFile(t, client, "/var/log/app.log", "app")
+	remoteFile(t, client, "/var/log/db.log", "db")
+	remoteFile(t, client, "/var/log/old/app.log", "old")
+
+	dir, err := ioutil.TempDir("", "fetch")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	e := New(nil)
+
+	//
+	// A single file is written to the given path, creating any
+	// missing directories.
+	//
+	err = e.fetchFiles(sftpSource{client}, "/var/log/app.log", filepath.Join(dir, "one", "renamed.log"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "one", "renamed.log"))
+	if string(data) != "app" {
+		t.Fatalf("Unexpected content '%s'", data)
+	}
+
+	//
+	// A glob is written into a directory, skipping directories.
+	//
+	err = e.fetchFiles(sftpSource{client}, "/var/log/*", filepath.Join(dir, "all"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "all", "*"))
+	if len(files) != 2 {
+		t.Fatalf("Expected two files, got %v", files)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "all", "db.log"))
+	if string(data) != "db" {
+		t.Fatalf("Unexpected content '%s'", data)
+	}
+
+	//
+	// Missing files are an error.
+	//
+	err = e.fetchFiles(sftpSource{client}, "/var/log/missing.log", dir+"/")
+	if err == nil || !strings.Contains(err.Error(), "failed to find") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+}
+
+// TestGlobQuote tests quoting globs for the remote shell.
+func TestGlobQuote(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"/var/log/app.log", "'/var/log/app.log'"},
+		{"/var/log/*.log", "'/var/log/'*'.log'"},
+		{"/var/log/app.?", "'/var/log/app.'?"},
+		{"/var/log/app.[0-9]", "'/var/log/app.'[0-9]"},
+		{"/var/log/[$(id)]", "'/var/log/[$(id)]'"},
+		{"/var/log/it's *", "'/var/log/it'\\''s '*"},
+		{"/var/log/\\*", "'/var/log/*'"},
+	}
+
+	for _, test := range tests {
+		if out := globQuote(test.input); out != test.output {
+			t.Fatalf("Quoting '%s' gave %s, expected %s", test.input, out, test.output)
+		}
+	}
+}
+
+// TestEscalatedFetch tests downloading files via sudo, as happens with
+// the "Sudo" prefix, or within "Become" blocks.
+func TestEscalatedFetch(t *testing.T) {
+
+	e, bin, stop := sshServer(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "fetch")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	remote := filepath.Join(dir, "remote")
+	os.MkdirAll(filepath.Join(remote, "old"), 0755)
+	ioutil.WriteFile(filepath.Join(remote, "app.log"), []byte("app\n"), 0600)
+	ioutil.WriteFile(filepath.Join(remote, "my db.log"), []byte{0, 1, 2, '\r', '\n'}, 0600)
+
+	//
+	// Sudo's warnings shouldn't confuse us.
+	//
+	ioutil.WriteFile(filepath.Join(bin, "warn"), nil, 0644)
+
+	client := &commandFS{run: e.execute, opts: e.escalation(ast.Prefix{Sudo: true})}
+
+	local := filepath.Join(dir, "local")
+	err = e.fetchFiles(client, filepath.Join(remote, "*"), local)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	files, _ := filepath.Glob(filepath.Join(local, "*"))
+	if len(files) != 2 {
+		t.Fatalf("Expected two files, got %v", files)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(local, "app.log"))
+	if string(data) != "app\n" {
+		t.Fatalf("Unexpected content '%s'", data)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(local, "my db.log"))
+	if string(data) != "\x00\x01\x02\r\n" {
+		t.Fatalf("Unexpected content %q", data)
+	}
+
+	err = e.fetchFiles(client, filepath.Join(remote, "missing.log"), local)
+	if err == nil || !strings.Contains(err.Error(), "failed to find") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+
+	//
+	// Running the statement within a "Become" block reads the file
+	// as the given user.
+	//
+	os.Remove(filepath.Join(bin, "sudo.log"))
+	e.become = []string{"app"}
+	err = e.evaluate([]ast.Statement{&ast.FetchStatement{
+		Base:        ast.Base{Token: token.Token{Type: token.FETCH, Literal: "Fetch"}},
+		Source:      token.Token{Type: token.STRING, Literal: filepath.Join(remote, "app.log")},
+		Destination: token.Token{Type: token.STRING, Literal: filepath.Join(local, "become.log")},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(local, "become.log"))
+	if string(data) != "app\n" {
+		t.Fatalf("Unexpected content '%s'", data)
+	}
+	if !strings.Contains(sshLog(bin, "sudo"), "-u app -n sh -c") {
+		t.Fatalf("The file was not read via sudo: %s", sshLog(bin, "sudo"))
+	}
+}
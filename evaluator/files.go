@@ -0,0 +1,470 @@
+package evaluator
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// statMarker prefixes the output of stat, and linkMarker that of
+// readlink, so that they can't be confused with any warnings from sudo.
+const (
+	statMarker = "deployr_stat"
+	linkMarker = "deployr_link"
+)
+
+// fileSystem holds the operations upon remote files which we use.
+//
+// It is implemented by an SFTP client, which works as the user we
+// connected as, and by commandFS, which runs commands so that privileges
+// may be escalated.
+type fileSystem interface {
+	Stat(p string) (os.FileInfo, error)
+	Lstat(p string) (os.FileInfo, error)
+	MkdirAll(p string) error
+	Chmod(p string, mode os.FileMode) error
+	Chown(p string, uid int, gid int) error
+	Symlink(target string, link string) error
+	ReadLink(p string) (string, error)
+	PosixRename(oldname string, newname string) error
+	Remove(p string) error
+	RemoveAll(p string) error
+}
+
+// files returns the means by which remote files are managed, with the
+// given options, along with a function to call once we're done.
+//
+// SFTP is used unless privileges are escalated, in which case commands
+// are run via our become-method instead.
+func (e *Evaluator) files(opts execOptions) (fileSystem, func(), error) {
+	if opts.Sudo {
+		return &commandFS{run: e.execute, opts: opts}, func() {}, nil
+	}
+
+	client, err := sftp.NewClient(e.Connection.SSHClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, func() { client.Close() }, nil
+}
+
+// commandFS manages remote files by running commands with the given
+// options, which allows privileges to be escalated.
+type commandFS struct {
+	run  commander
+	opts execOptions
+}
+
+// command runs the given command, including its output in any error.
+func (c *commandFS) command(cmd string) error {
+	out, err := c.run(cmd, c.opts)
+	if err != nil {
+		return fmt.Errorf("%s\n%s", err.Error(), out)
+	}
+	return nil
+}
+
+// marked runs the given shell script, returning the remainder of the
+// line of output which starts with the given marker, and whether there
+// was one.
+func (c *commandFS) marked(script string, marker string) (string, bool, error) {
+	out, err := c.run("sh -c "+shellQuote(script), c.opts)
+	if err != nil {
+		return "", false, fmt.Errorf("%s\n%s", err.Error(), out)
+	}
+	lines := markedLines(out, marker)
+	if len(lines) == 0 {
+		return "", false, nil
+	}
+	return lines[0], true, nil
+}
+
+// stat returns the details of the given file, following symlinks if
+// follow is true.
+func (c *commandFS) stat(p string, follow bool) (os.FileInfo, error) {
+	exists := "[ -e " + shellQuote(p) + " ]"
+	flags := "-L -c"
+	if !follow {
+		exists += " || [ -L " + shellQuote(p) + " ]"
+		flags = "-c"
+	}
+
+	line, found, err := c.marked("if "+exists+"; then stat "+flags+" '"+statMarker+" %f %u %g %s' "+shellQuote(p)+"; fi", statMarker)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+
+	var mode uint32
+	var uid, gid uint32
+	var size uint64
+	_, err = fmt.Sscanf(line, "%x %d %d %d", &mode, &uid, &gid, &size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse details of '%s': %s", p, line)
+	}
+
+	stat := &sftp.FileStat{Mode: mode, UID: uid, GID: gid, Size: size}
+	return &commandFileInfo{name: path.Base(p), stat: stat}, nil
+}
+
+// Stat returns the details of the given file, following symlinks.
+func (c *commandFS) Stat(p string) (os.FileInfo, error) {
+	return c.stat(p, true)
+}
+
+// Lstat returns the details of the given file, or symlink.
+func (c *commandFS) Lstat(p string) (os.FileInfo, error) {
+	return c.stat(p, false)
+}
+
+// MkdirAll creates the given directory, and any parents.
+func (c *commandFS) MkdirAll(p string) error {
+	return c.command("mkdir -p " + shellQuote(p))
+}
+
+// Chmod changes the mode of the given file.
+func (c *commandFS) Chmod(p string, mode os.FileMode) error {
+	return c.command(fmt.Sprintf("chmod %04o %s", mode.Perm(), shellQuote(p)))
+}
+
+// Chown changes the ownership of the given file.
+func (c *commandFS) Chown(p string, uid int, gid int) error {
+	return c.command(fmt.Sprintf("chown %d:%d %s", uid, gid, shellQuote(p)))
+}
+
+// Symlink creates a symlink pointing to the given target.
+func (c *commandFS) Symlink(target string, link string) error {
+	return c.command("ln -s " + shellQuote(target) + " " + shellQuote(link))
+}
+
+// ReadLink returns the target of the given symlink.
+func (c *commandFS) ReadLink(p string) (string, error) {
+	target, found, err := c.marked("printf '"+linkMarker+" %s\\n' \"$(readlink "+shellQuote(p)+")\"", linkMarker)
+	if err == nil && !found {
+		err = fmt.Errorf("failed to read symlink '%s'", p)
+	}
+	return target, err
+}
+
+// PosixRename renames the given file, replacing any existing file.
+//
+// The destination is never treated as a directory to move into, so
+// that a symlink to a directory may be replaced.
+func (c *commandFS) PosixRename(oldname string, newname string) error {
+	return c.command("mv -f -T " + shellQuote(oldname) + " " + shellQuote(newname))
+}
+
+// Remove removes the given file.
+func (c *commandFS) Remove(p string) error {
+	return c.command("rm -f " + shellQuote(p))
+}
+
+// RemoveAll removes the given path, and anything beneath it.
+func (c *commandFS) RemoveAll(p string) error {
+	return c.command("rm -rf " + shellQuote(p))
+}
+
+// commandFileInfo describes a file, whose details were found via stat.
+type commandFileInfo struct {
+	name string
+	stat *sftp.FileStat
+}
+
+// Name returns the base name of the file.
+func (fi *commandFileInfo) Name() string { return fi.name }
+
+// Size returns the size of the file.
+func (fi *commandFileInfo) Size() int64 { return int64(fi.stat.Size) }
+
+// ModTime is not known.
+func (fi *commandFileInfo) ModTime() time.Time { return time.Time{} }
+
+// IsDir returns true if the file is a directory.
+func (fi *commandFileInfo) IsDir() bool { return fi.Mode().IsDir() }
+
+// Sys returns the details of the file, as SFTP would.
+func (fi *commandFileInfo) Sys() interface{} { return fi.stat }
+
+// Mode converts the raw mode of the file, as returned by stat, to an
+// os.FileMode.
+func (fi *commandFileInfo) Mode() os.FileMode {
+	raw := fi.stat.Mode
+	mode := os.FileMode(raw & 0777)
+
+	switch raw & 0170000 {
+	case 0040000:
+		mode |= os.ModeDir
+	case 0120000:
+		mode |= os.ModeSymlink
+	case 0010000:
+		mode |= os.ModeNamedPipe
+	case 0140000:
+		mode |= os.ModeSocket
+	case 0020000:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 0060000:
+		mode |= os.ModeDevice
+	}
+	if raw&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if raw&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if raw&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// report shows the given change to the named object, or the change
+// which would have been made if we're not running for real.
+func (e *Evaluator) report(object string, change string) {
+	if e.NOP {
+		e.printf("\t%s: would be %s\n", object, change)
+		return
+	}
+	e.printf("\t%s: %s\n", object, change)
+}
+
+// parseMode parses the given octal file mode, such as "0755", which may
+// be empty.
+func parseMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	val, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || val > 07777 {
+		return 0, fmt.Errorf("invalid value for mode '%s' - expected an octal mode such as 0755", mode)
+	}
+	return os.FileMode(val), nil
+}
+
+// fileOwner returns the numeric user and group IDs of the given owner,
+// "user" or "user:group", each of which may be a name or an ID.
+//
+// If no group is given that of the user is used.
+func fileOwner(run commander, owner string) (int, int, error) {
+	user, group := owner, ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		user, group = owner[:i], owner[i+1:]
+	}
+
+	//
+	// lookup returns the given field of the named entry.
+	//
+	lookup := func(database string, name string, field int) (int, error) {
+		entry, err := getent(run, database, name, execOptions{})
+		if err != nil {
+			return 0, err
+		}
+		if len(entry) <= field {
+			if id, err := strconv.Atoi(name); err == nil && field == 2 {
+				return id, nil
+			}
+			return 0, fmt.Errorf("failed to find %s entry for '%s'", database, name)
+		}
+		return strconv.Atoi(entry[field])
+	}
+
+	uid, err := lookup("passwd", user, 2)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var gid int
+	if group == "" {
+		gid, err = lookup("passwd", user, 3)
+	} else {
+		gid, err = lookup("group", group, 2)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// directory ensures the given remote directory exists, with the given
+// mode and owner, if they are not empty, returning whether a change was
+// made.
+//
+// If we're not running for real the changes are only reported.
+func (e *Evaluator) directory(client fileSystem, run commander, dir string, mode string, owner string) (bool, error) {
+
+	object := "Directory " + dir
+	changed := false
+
+	perm, err := parseMode(mode)
+	if err != nil {
+		return false, err
+	}
+
+	fi, err := client.Stat(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if fi != nil && !fi.IsDir() {
+		return false, fmt.Errorf("'%s' exists, but is not a directory", dir)
+	}
+
+	if fi == nil {
+		e.report(object, "created")
+		changed = true
+
+		if !e.NOP {
+			err = client.MkdirAll(dir)
+			if err != nil {
+				return false, err
+			}
+			fi, err = client.Stat(dir)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if mode != "" && (fi == nil || fi.Mode().Perm() != perm) {
+		e.report(object, fmt.Sprintf("changed to mode %04o", perm))
+		changed = true
+
+		if !e.NOP {
+			err = client.Chmod(dir, perm)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if owner != "" {
+		uid, gid, err := fileOwner(run, owner)
+		if err != nil {
+			return false, err
+		}
+
+		current := false
+		if fi != nil {
+			if stat, ok := fi.Sys().(*sftp.FileStat); ok {
+				current = int(stat.UID) == uid && int(stat.GID) == gid
+			}
+		}
+		if !current {
+			e.report(object, "changed to owner "+owner)
+			changed = true
+
+			if !e.NOP {
+				err = client.Chown(dir, uid, gid)
+				if err != nil {
+					return false, err
+				}
+			}
+		}
+	}
+
+	if !changed && e.Verbose {
+		e.printf("\t%s doesn't need to be changed.\n", object)
+	}
+	return changed, nil
+}
+
+// symlink ensures the given remote symlink exists, and points to the
+// given target, returning whether a change was made.
+//
+// An existing symlink is replaced atomically, but other files are never
+// replaced.  If we're not running for real the changes are only reported.
+func (e *Evaluator) symlink(client fileSystem, target string, link string) (bool, error) {
+
+	object := "Symlink " + link
+
+	fi, err := client.Lstat(link)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if fi == nil {
+		e.report(object, "created, pointing to "+target)
+		if !e.NOP {
+			err = client.Symlink(target, link)
+			if err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return false, fmt.Errorf("'%s' exists, but is not a symlink", link)
+	}
+
+	current, err := client.ReadLink(link)
+	if err != nil {
+		return false, err
+	}
+	if current == target {
+		if e.Verbose {
+			e.printf("\t%s doesn't need to be changed.\n", object)
+		}
+		return false, nil
+	}
+
+	e.report(object, "changed to point to "+target)
+	if e.NOP {
+		return true, nil
+	}
+
+	//
+	// Create the new link beside the old, then rename it into place.
+	//
+	tmp := path.Join(path.Dir(link), "."+path.Base(link)+".deployr")
+	client.Remove(tmp)
+
+	err = client.Symlink(target, tmp)
+	if err == nil {
+		err = client.PosixRename(tmp, link)
+	}
+	if err != nil {
+		client.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
+
+// remove ensures the given remote path doesn't exist, removing it and
+// anything beneath it, returning whether a change was made.
+//
+// Symlinks are removed, rather than anything they point to.  If we're
+// not running for real the changes are only reported.
+func (e *Evaluator) remove(client fileSystem, remote string) (bool, error) {
+
+	fi, err := client.Lstat(remote)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if e.Verbose {
+				e.printf("\t%s doesn't exist.\n", remote)
+			}
+			return false, nil
+		}
+		return false, err
+	}
+
+	e.report(remote, "removed")
+	if e.NOP {
+		return true, nil
+	}
+
+	if fi.IsDir() {
+		err = client.RemoveAll(remote)
+	} else {
+		err = client.Remove(remote)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,314 @@
+package evaluator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skx/deployr/ast"
+	"github.com/skx/deployr/token"
+)
+
+// TestDirectory tests creating directories.
+func TestDirectory(t *testing.T) {
+
+	client, stop := sftpClient(t)
+	defer stop()
+
+	remoteFile(t, client, "/etc/hosts", "127.0.0.1 localhost\n")
+
+	e := New(nil)
+
+	//
+	// Without running for real nothing is created.
+	//
+	e.NOP = true
+	changed, err := e.directory(client, nil, "/opt/app/bin", "", "")
+	if err != nil || !changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+	if _, err = client.Stat("/opt/app/bin"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the directory not to exist, got %v", err)
+	}
+
+	e.NOP = false
+	changed, err = e.directory(client, nil, "/opt/app/bin", "", "")
+	if err != nil || !changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+	fi, err := client.Stat("/opt/app/bin")
+	if err != nil || !fi.IsDir() {
+		t.Fatalf("Expected the directory to exist, got %v", err)
+	}
+
+	changed, err = e.directory(client, nil, "/opt/app/bin", "", "")
+	if err != nil || changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+
+	_, err = e.directory(client, nil, "/etc/hosts", "", "")
+	if err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+	_, err = e.directory(client, nil, "/opt/app", "rwx", "")
+	if err == nil || !strings.Contains(err.Error(), "invalid value for mode") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+}
+
+// TestFileOwner tests the lookup of owners.
+func TestFileOwner(t *testing.T) {
+
+	fake := &fakeAccounts{entries: map[string]string{
+		"getent passwd 'app'": "app:x:999:998::/opt/app:/bin/sh",
+		"getent group 'adm'":  "adm:x:4:syslog",
+	}}
+
+	tests := []struct {
+		owner string
+		uid   int
+		gid   int
+	}{
+		{"app", 999, 998},
+		{"app:adm", 999, 4},
+		{"1000:adm", 1000, 4},
+	}
+	for _, test := range tests {
+		uid, gid, err := fileOwner(fake.execute, test.owner)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", test.owner, err.Error())
+		}
+		if uid != test.uid || gid != test.gid {
+			t.Fatalf("Unexpected result for %s: %d:%d", test.owner, uid, gid)
+		}
+	}
+
+	_, _, err := fileOwner(fake.execute, "bob")
+	if err == nil {
+		t.Fatalf("Expected an error for a missing user")
+	}
+}
+
+// TestSymlink tests creating, and replacing, symlinks.
+func TestSymlink(t *testing.T) {
+
+	client, stop := sftpClient(t)
+	defer stop()
+
+	remoteFile(t, client, "/opt/app/app-1.0", "1.0")
+	remoteFile(t, client, "/opt/app/app-1.1", "1.1")
+
+	e := New(nil)
+
+	for _, target := range []string{"/opt/app/app-1.0", "/opt/app/app-1.1"} {
+		changed, err := e.symlink(client, target, "/opt/app/app")
+		if err != nil || !changed {
+			t.Fatalf("Unexpected result %v %v", changed, err)
+		}
+		current, err := client.ReadLink("/opt/app/app")
+		if err != nil || current != target {
+			t.Fatalf("Unexpected link %s %v", current, err)
+		}
+
+		changed, err = e.symlink(client, target, "/opt/app/app")
+		if err != nil || changed {
+			t.Fatalf("Unexpected result %v %v", changed, err)
+		}
+	}
+
+	_, err := e.symlink(client, "/opt/app/app-1.1", "/opt/app/app-1.0")
+	if err == nil || !strings.Contains(err.Error(), "not a symlink") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+}
+
+// TestRemove tests removing files, and directories.
+func TestRemove(t *testing.T) {
+
+	client, stop := sftpClient(t)
+	defer stop()
+
+	remoteFile(t, client, "/opt/app/bin/app", "app")
+	remoteFile(t, client, "/opt/app/README", "readme")
+
+	e := New(nil)
+
+	e.NOP = true
+	changed, err := e.remove(client, "/opt/app")
+	if err != nil || !changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+	if _, err = client.Stat("/opt/app/README"); err != nil {
+		t.Fatalf("Expected the file to remain, got %v", err)
+	}
+
+	e.NOP = false
+	for _, remote := range []string{"/opt/app/README", "/opt/app"} {
+		changed, err = e.remove(client, remote)
+		if err != nil || !changed {
+			t.Fatalf("Unexpected result %v %v", changed, err)
+		}
+		if _, err = client.Lstat(remote); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be removed, got %v", remote, err)
+		}
+	}
+
+	changed, err = e.remove(client, "/opt/app")
+	if err != nil || changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+}
+
+// TestEscalatedFiles tests managing files via sudo, as happens within
+// "Become" blocks.
+func TestEscalatedFiles(t *testing.T) {
+
+	e, bin, stop := sshServer(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	//
+	// Sudo's warnings shouldn't confuse us.
+	//
+	ioutil.WriteFile(filepath.Join(bin, "warn"), nil, 0644)
+
+	e.become = []string{"root"}
+	client, done, err := e.files(e.escalation(ast.Prefix{}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer done()
+
+	if _, ok := client.(*commandFS); !ok {
+		t.Fatalf("Expected files to be managed via commands, got %T", client)
+	}
+
+	//
+	// Directories are created, with the given mode.
+	//
+	app := filepath.Join(dir, "opt", "app")
+	for _, changed := range []bool{true, false} {
+		c, err := e.directory(client, nil, app, "0750", "")
+		if err != nil || c != changed {
+			t.Fatalf("Unexpected result %v %v", c, err)
+		}
+		fi, err := os.Stat(app)
+		if err != nil || !fi.IsDir() || fi.Mode().Perm() != 0750 {
+			t.Fatalf("Unexpected directory %v %v", fi, err)
+		}
+	}
+
+	ioutil.WriteFile(filepath.Join(app, "app-1.0"), []byte("1.0"), 0644)
+	_, err = e.directory(client, nil, filepath.Join(app, "app-1.0"), "", "")
+	if err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+
+	//
+	// Symlinks are created, and replaced - even those pointing to
+	// directories.
+	//
+	link := filepath.Join(dir, "current")
+	for _, target := range []string{filepath.Join(app, "app-1.0"), app} {
+		for _, changed := range []bool{true, false} {
+			c, err := e.symlink(client, target, link)
+			if err != nil || c != changed {
+				t.Fatalf("Unexpected result %v %v", c, err)
+			}
+			current, err := os.Readlink(link)
+			if err != nil || current != target {
+				t.Fatalf("Unexpected link %s %v", current, err)
+			}
+		}
+	}
+	if _, err = os.Lstat(filepath.Join(app, ".current.deployr")); err == nil {
+		t.Fatalf("The link was moved into the directory it pointed to")
+	}
+
+	//
+	// Symlinks are removed, rather than what they point to, and
+	// directories are removed along with their contents.
+	//
+	for _, remote := range []string{link, filepath.Join(dir, "opt")} {
+		for _, changed := range []bool{true, false} {
+			c, err := e.remove(client, remote)
+			if err != nil || c != changed {
+				t.Fatalf("Unexpected result %v %v", c, err)
+			}
+		}
+		if remote == link {
+			if _, err = os.Stat(app); err != nil {
+				t.Fatalf("The target of the link was removed")
+			}
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "opt")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the directory to be removed, got %v", err)
+	}
+
+	if !strings.Contains(sshLog(bin, "sudo"), "-n mkdir -p") {
+		t.Fatalf("Commands were not run via sudo: %s", sshLog(bin, "sudo"))
+	}
+}
+
+// TestSudoFiles tests that the Directory, Symlink, and Remove primitives
+// honour the "Sudo" prefix.
+func TestSudoFiles(t *testing.T) {
+
+	e, bin, stop := sshServer(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	app := filepath.Join(dir, "app")
+	link := filepath.Join(dir, "current")
+	sudo := ast.Prefix{Sudo: true, SudoUser: "app"}
+
+	statements := []ast.Statement{
+		&ast.DirectoryStatement{
+			Base:   ast.Base{Token: token.Token{Type: token.DIRECTORY, Literal: "Directory"}},
+			Prefix: sudo,
+			Path:   token.Token{Type: token.STRING, Literal: app},
+		},
+		&ast.SymlinkStatement{
+			Base:   ast.Base{Token: token.Token{Type: token.SYMLINK, Literal: "Symlink"}},
+			Prefix: sudo,
+			Target: token.Token{Type: token.STRING, Literal: app},
+			Link:   token.Token{Type: token.STRING, Literal: link},
+		},
+		&ast.RemoveStatement{
+			Base:   ast.Base{Token: token.Token{Type: token.REMOVE, Literal: "Remove"}},
+			Prefix: sudo,
+			Path:   token.Token{Type: token.STRING, Literal: link},
+		},
+	}
+
+	for _, statement := range statements {
+		os.Remove(filepath.Join(bin, "sudo.log"))
+		err = e.evaluate([]ast.Statement{statement})
+		if err != nil || !e.Changed {
+			t.Fatalf("Unexpected result for %s: %v %v", statement, e.Changed, err)
+		}
+		if !strings.Contains(sshLog(bin, "sudo"), "-u app -n ") {
+			t.Fatalf("%s was not run via sudo: %s", statement, sshLog(bin, "sudo"))
+		}
+	}
+
+	if fi, err := os.Stat(app); err != nil || !fi.IsDir() {
+		t.Fatalf("Expected the directory to exist, got %v", err)
+	}
+	if _, err = os.Lstat(link); !os.IsNotExist(err) {
+		t.Fatalf("Expected the link to be removed, got %v", err)
+	}
+}
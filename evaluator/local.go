@@ -0,0 +1,62 @@
+package evaluator
+
+import (
+	"fmt"
+	"time"
+)
+
+// runLocal runs the given command upon the local host, via the shell,
+// or cmd.exe upon Windows.
+//
+// If capture is true the standard output of the command is returned
+// separately, and only its standard error is included in the output,
+// otherwise the output holds both.
+//
+// If timeout is non-zero the command, and any children it started, are
+// killed if it fails to complete within that period.
+func (e *Evaluator) runLocal(command string, timeout time.Duration, capture bool) (string, []byte, error) {
+
+	stdout := &outputWriter{}
+	output := &outputWriter{}
+
+	cmd := shellCommand(command)
+	cmd.Stderr = output
+	if capture {
+		cmd.Stdout = stdout
+	} else {
+		cmd.Stdout = output
+	}
+	setProcessGroup(cmd)
+
+	err := cmd.Start()
+	if err != nil {
+		return "", nil, err
+	}
+
+	//
+	// No timeout?  Then just wait for completion.
+	//
+	if timeout == 0 {
+		err = cmd.Wait()
+		return string(stdout.Bytes()), output.Bytes(), err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		return string(stdout.Bytes()), output.Bytes(), err
+	case <-time.After(timeout):
+
+		//
+		// Kill the process, along with its children, and don't
+		// wait upon it any further since a child which left our
+		// process group might still hold our output open.
+		//
+		killProcessGroup(cmd)
+		return "", output.Bytes(), fmt.Errorf("command timed out after %s", timeout)
+	}
+}
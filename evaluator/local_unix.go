@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package evaluator
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand returns the command which runs the given command-line
+// via the shell.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("sh", "-c", command)
+}
+
+// setProcessGroup runs the command within a new process group, so that
+// it may be killed along with any children it starts.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the command, and any children it started.
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package evaluator
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand returns the command which runs the given command-line
+// via cmd.exe, since there is usually no "sh" upon Windows.
+//
+// The command-line is passed as it was written, rather than escaped as
+// arguments usually are, since cmd.exe doesn't understand that escaping.
+// With "/S" it removes only the outer quotes we add.
+func shellCommand(command string) *exec.Cmd {
+	cmd := exec.Command("cmd")
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: `cmd /S /C "` + command + `"`}
+	return cmd
+}
+
+// setProcessGroup does nothing, since there are no process groups upon
+// Windows.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// killProcessGroup kills the command, but not any children it started.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
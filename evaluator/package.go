@@ -0,0 +1,279 @@
+package evaluator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// packageMarker prefixes the output of a query for installed packages, so
+// that it can't be confused with any warnings from sudo.
+const packageMarker = "deployr_package"
+
+// packageManager describes how packages are queried, and changed, with
+// one of the package managers we support.
+type packageManager struct {
+
+	// query is the command which reports upon installed packages,
+	// the names of which are appended.
+	query string
+
+	// parse returns the versions of the installed packages, by name,
+	// from the output of the query.
+	parse func(out string, names []string) map[string]string
+
+	// install, remove, and upgrade, are the commands which change
+	// packages, the names of which are appended.
+	install string
+	remove  string
+	upgrade string
+
+	// refresh is the command which updates the list of available
+	// packages, before upgrading, if one is required.
+	refresh string
+}
+
+// packageManagers holds the package managers we support, by the name of
+// the command which is used to detect them, in order of preference.
+var packageManagers = []struct {
+	name    string
+	manager packageManager
+}{
+	{"apt-get", packageManager{
+		query:   "dpkg-query -W -f='${Status} ${Package} ${Version}\\n'",
+		parse:   parseDpkg,
+		install: "env DEBIAN_FRONTEND=noninteractive apt-get install -y -q",
+		remove:  "env DEBIAN_FRONTEND=noninteractive apt-get remove -y -q",
+		upgrade: "env DEBIAN_FRONTEND=noninteractive apt-get install -y -q",
+		refresh: "apt-get update -q",
+	}},
+	{"dnf", packageManager{
+		query:   "rpm -q --qf '%{NAME} %{VERSION}-%{RELEASE}\\n'",
+		parse:   parseRPM,
+		install: "dnf install -y -q",
+		remove:  "dnf remove -y -q",
+		upgrade: "dnf upgrade -y -q",
+	}},
+	{"yum", packageManager{
+		query:   "rpm -q --qf '%{NAME} %{VERSION}-%{RELEASE}\\n'",
+		parse:   parseRPM,
+		install: "yum install -y -q",
+		remove:  "yum remove -y -q",
+		upgrade: "yum upgrade -y -q",
+	}},
+	{"apk", packageManager{
+		query:   "apk list --installed",
+		parse:   parseAPK,
+		install: "apk add -q",
+		remove:  "apk del -q",
+		upgrade: "apk add -q --upgrade --update-cache",
+	}},
+}
+
+// parseDpkg parses the output of dpkg-query, which reports the status,
+// name, and version of each package.
+func parseDpkg(out string, names []string) map[string]string {
+	installed := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 5 && strings.Join(fields[:3], " ") == "install ok installed" {
+			installed[fields[3]] = fields[4]
+		}
+	}
+	return installed
+}
+
+// parseRPM parses the output of rpm, which reports the name and version
+// of each installed package, and a message for each missing one.
+func parseRPM(out string, names []string) map[string]string {
+	installed := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			installed[fields[0]] = fields[1]
+		}
+	}
+	return installed
+}
+
+// parseAPK parses the output of "apk list", which reports each installed
+// package as "name-version arch {origin} (license) [installed]".
+func parseAPK(out string, names []string) map[string]string {
+	installed := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+
+		//
+		// Names may contain "-", so we look for the package which
+		// is followed by a version.
+		//
+		for _, name := range names {
+			version := strings.TrimPrefix(fields[0], name+"-")
+			if version != fields[0] && version != "" && version[0] >= '0' && version[0] <= '9' {
+				installed[name] = version
+			}
+		}
+	}
+	return installed
+}
+
+// detectPackageManager returns the package manager of the remote host,
+// which is only detected once.
+func (e *Evaluator) detectPackageManager(run commander) (*packageManager, error) {
+	if e.packageManager != nil {
+		return e.packageManager, nil
+	}
+
+	var names []string
+	for _, pm := range packageManagers {
+		names = append(names, pm.name)
+	}
+
+	out, _ := run("for m in "+strings.Join(names, " ")+"; do if command -v $m >/dev/null 2>&1; then echo $m; break; fi; done", execOptions{})
+	found := strings.TrimSpace(string(out))
+
+	for i, pm := range packageManagers {
+		if pm.name == found {
+			e.packageManager = &packageManagers[i].manager
+			if e.Verbose {
+				e.printf("\tUsing the package manager %s.\n", found)
+			}
+			return e.packageManager, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to find a supported package manager (%s) upon the remote host", strings.Join(names, ", "))
+}
+
+// packages ensures that the named packages are in the given state, one
+// of "present", "absent", or "latest".
+//
+// Packages are installed, or removed, together in a single transaction
+// and only if required, and the return value records whether a change
+// was made.
+func (e *Evaluator) packages(run commander, names []string, state string, opts execOptions) (bool, error) {
+
+	switch state {
+	case "present", "absent", "latest":
+	default:
+		return false, fmt.Errorf("invalid value for state '%s' - expected present, absent, or latest", state)
+	}
+
+	pm, err := e.detectPackageManager(run)
+	if err != nil {
+		return false, err
+	}
+
+	//
+	// quoted returns the given packages, quoted for the shell.
+	//
+	quoted := func(names []string) string {
+		var out []string
+		for _, name := range names {
+			out = append(out, shellQuote(name))
+		}
+		return strings.Join(out, " ")
+	}
+
+	//
+	// query returns the versions of the installed packages.
+	//
+	// The query fails if any package is missing, so we rely upon
+	// its output.
+	//
+	query := func() map[string]string {
+		out, _ := run(markOutput(pm.query+" "+quoted(names), packageMarker), opts)
+		return pm.parse(strings.Join(markedLines(out, packageMarker), "\n"), names)
+	}
+
+	//
+	// change runs the given command against the given packages.
+	//
+	change := func(cmd string, names []string) error {
+		if cmd == "" {
+			return nil
+		}
+		if len(names) > 0 {
+			cmd += " " + quoted(names)
+		}
+		out, err := run(cmd, opts)
+		if err != nil {
+			return fmt.Errorf("failed to run '%s': %s\n%s", cmd, err.Error(), out)
+		}
+		return nil
+	}
+
+	before := query()
+
+	var missing, present []string
+	for _, name := range names {
+		if _, ok := before[name]; ok {
+			present = append(present, name)
+		} else {
+			missing = append(missing, name)
+		}
+	}
+
+	switch state {
+	case "present":
+		if len(missing) < 1 {
+			break
+		}
+		if err := change(pm.install, missing); err != nil {
+			return false, err
+		}
+		e.printf("\tInstalled %s\n", strings.Join(missing, " "))
+		return true, nil
+
+	case "absent":
+		if len(present) < 1 {
+			break
+		}
+		if err := change(pm.remove, present); err != nil {
+			return false, err
+		}
+		e.printf("\tRemoved %s\n", strings.Join(present, " "))
+		return true, nil
+
+	case "latest":
+
+		//
+		// We can't cheaply know whether upgrades are available,
+		// so we compare the versions installed before and after.
+		//
+		if err := change(pm.refresh, nil); err != nil {
+			return false, err
+		}
+		if pm.install == pm.upgrade {
+			missing, present = nil, names
+		}
+		if len(missing) > 0 {
+			if err := change(pm.install, missing); err != nil {
+				return false, err
+			}
+		}
+		if len(present) > 0 {
+			if err := change(pm.upgrade, present); err != nil {
+				return false, err
+			}
+		}
+
+		var updated []string
+		after := query()
+		for _, name := range names {
+			if after[name] != before[name] {
+				updated = append(updated, name)
+			}
+		}
+		if len(updated) > 0 {
+			e.printf("\tUpdated %s\n", strings.Join(updated, " "))
+			return true, nil
+		}
+	}
+
+	if e.Verbose {
+		e.printf("\tPackages don't need to be changed.\n")
+	}
+	return false, nil
+}
@@ -0,0 +1,125 @@
+package evaluator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/skx/deployr/ast"
+)
+
+// fakeDpkg pretends to be a Debian host, recording the commands which
+// were run.
+type fakeDpkg struct {
+	installed map[string]string
+	run       []string
+}
+
+// execute handles a command, as a commander.
+//
+// Queries are answered as they would be via sudo, with a warning which
+// should be ignored.
+func (f *fakeDpkg) execute(cmd string, opts execOptions) ([]byte, error) {
+	if strings.HasPrefix(cmd, "for m in ") {
+		return []byte("apt-get\n"), nil
+	}
+	marker := ""
+	if inner, m, ok := unmarkOutput(cmd); ok {
+		cmd, marker = inner, m
+	}
+	f.run = append(f.run, cmd)
+
+	if strings.HasPrefix(cmd, "dpkg-query ") {
+		out, missing := "", ""
+		for _, name := range strings.Fields(strings.SplitN(cmd, "\\n' ", 2)[1]) {
+			name = strings.Trim(name, "'")
+			if version, ok := f.installed[name]; ok {
+				out += "install ok installed " + name + " " + version + "\n"
+			} else {
+				missing += "dpkg-query: no packages found matching " + name + "\n"
+			}
+		}
+		return append(markedReply(marker, out), missing...), nil
+	}
+	return nil, nil
+}
+
+// TestPackages tests that only the required packages are changed.
+func TestPackages(t *testing.T) {
+
+	query := "dpkg-query -W -f='${Status} ${Package} ${Version}\\n' 'nginx' 'curl'"
+
+	tests := []struct {
+		state    string
+		changed  bool
+		commands []string
+	}{
+		{"present", true, []string{
+			query,
+			"env DEBIAN_FRONTEND=noninteractive apt-get install -y -q 'nginx'",
+		}},
+		{"absent", true, []string{
+			query,
+			"env DEBIAN_FRONTEND=noninteractive apt-get remove -y -q 'curl'",
+		}},
+		{"latest", false, []string{
+			query,
+			"apt-get update -q",
+			"env DEBIAN_FRONTEND=noninteractive apt-get install -y -q 'nginx' 'curl'",
+			query,
+		}},
+	}
+
+	for _, test := range tests {
+		fake := &fakeDpkg{installed: map[string]string{"curl": "7.88"}}
+
+		e := New(&ast.Program{})
+		changed, err := e.packages(fake.execute, []string{"nginx", "curl"}, test.state, execOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if changed != test.changed {
+			t.Fatalf("Expected changed to be %v for %s", test.changed, test.state)
+		}
+		if !reflect.DeepEqual(fake.run, test.commands) {
+			t.Fatalf("Unexpected commands %v for %s", fake.run, test.state)
+		}
+	}
+
+	//
+	// Nothing is done if nothing is required.
+	//
+	fake := &fakeDpkg{installed: map[string]string{"nginx": "1.22", "curl": "7.88"}}
+	e := New(&ast.Program{})
+	changed, err := e.packages(fake.execute, []string{"nginx", "curl"}, "present", execOptions{})
+	if err != nil || changed || len(fake.run) != 1 {
+		t.Fatalf("Unexpected result %v %v %v", changed, err, fake.run)
+	}
+
+	_, err = e.packages(fake.execute, []string{"nginx"}, "installed", execOptions{})
+	if err == nil || !strings.Contains(err.Error(), "invalid value for state") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+}
+
+// TestPackageParsers tests the parsing of each package manager's output.
+func TestPackageParsers(t *testing.T) {
+
+	names := []string{"nginx", "py3-yaml", "curl"}
+	expected := map[string]string{"nginx": "1.24.0-r6", "py3-yaml": "6.0.1-r1"}
+
+	rpm := "nginx 1.24.0-r6\npy3-yaml 6.0.1-r1\npackage curl is not installed\n"
+	if out := parseRPM(rpm, names); !reflect.DeepEqual(out, expected) {
+		t.Fatalf("Unexpected rpm result %v", out)
+	}
+
+	dpkg := "install ok installed nginx 1.24.0-r6\ninstall ok installed py3-yaml 6.0.1-r1\ndeinstall ok config-files curl 7.88\n"
+	if out := parseDpkg(dpkg, names); !reflect.DeepEqual(out, expected) {
+		t.Fatalf("Unexpected dpkg result %v", out)
+	}
+
+	apk := "nginx-1.24.0-r6 x86_64 {nginx} (BSD-2-Clause) [installed]\npy3-yaml-6.0.1-r1 x86_64 {py3-yaml} (MIT) [installed]\n"
+	if out := parseAPK(apk, names); !reflect.DeepEqual(out, expected) {
+		t.Fatalf("Unexpected apk result %v", out)
+	}
+}
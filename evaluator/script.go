@@ -0,0 +1,98 @@
+package evaluator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// runScript uploads the local script to a private temporary directory
+// upon the remote host, runs it with the given arguments, and removes it
+// once it has completed.  The output of the script is returned.
+//
+// If expand is true the script is treated as a template, and expanded
+// before it is uploaded.  If an interpreter is given, such as "bash",
+// the script is passed to it, otherwise the script is executed directly
+// and so should start with a "#!" line.
+//
+// If opts.Sudo is set the script is run via sudo.
+func (e *Evaluator) runScript(script string, args []string, interpreter string, expand bool, opts execOptions) ([]byte, error) {
+
+	data, err := ioutil.ReadFile(script)
+	if err != nil {
+		return nil, err
+	}
+
+	if expand {
+		data, err = e.expandTemplate(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand template-variables: %s", err.Error())
+		}
+	}
+
+	tmpfile, err := ioutil.TempFile("", "script")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	_, err = tmpfile.Write(data)
+	tmpfile.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// Create a temporary directory to upload into, which mktemp
+	// makes accessible to nobody but ourselves.
+	//
+	out, err := e.execute("mktemp -d", execOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %s\n%s", err.Error(), out)
+	}
+	dir := strings.TrimSpace(string(out))
+
+	cleanup := execOptions{}
+	defer func() {
+		e.execute("rm -rf "+shellQuote(dir), cleanup)
+	}()
+
+	remote := dir + "/" + path.Base(script)
+
+	err = e.Connection.Upload(tmpfile.Name(), remote)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err = e.execute("chmod 700 "+shellQuote(remote), execOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set permissions on script: %s\n%s", err.Error(), out)
+	}
+
+	//
+	// If sudo runs as a user other than root they can't read the
+	// script, so we hand it over to them.
+	//
+	if opts.Sudo && opts.User != "" {
+		out, err = e.execute("chown -R "+shellQuote(opts.User)+" "+shellQuote(dir), execOptions{Sudo: true})
+		if err != nil {
+			return nil, fmt.Errorf("failed to change owner of temporary directory: %s\n%s", err.Error(), out)
+		}
+		cleanup = execOptions{Sudo: true, User: opts.User}
+	}
+
+	//
+	// Now run it.
+	//
+	cmd := shellQuote(remote)
+	if interpreter != "" {
+		cmd = interpreter + " " + cmd
+	}
+	for _, arg := range args {
+		cmd += " " + shellQuote(arg)
+	}
+
+	return e.execute(cmd, opts)
+}
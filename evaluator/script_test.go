@@ -0,0 +1,82 @@
+package evaluator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRunScript tests running scripts upon the remote host.
+func TestRunScript(t *testing.T) {
+
+	e, bin, stop := sshServer(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "script")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	//
+	// Our script shows its arguments, where it was uploaded to, and
+	// the permissions of both it and its directory.
+	//
+	script := filepath.Join(dir, "setup.sh")
+	ioutil.WriteFile(script, []byte(`#!/bin/sh
+echo "$@"
+echo "$0"
+stat -c %a "$(dirname "$0")" "$0"
+`), 0644)
+
+	tests := []struct {
+		opts execOptions
+		sudo string
+	}{
+		{execOptions{}, ""},
+		{execOptions{Sudo: true}, "-n sh "},
+		{execOptions{Sudo: true, User: "bob"}, "-u bob -n sh "},
+	}
+
+	for _, test := range tests {
+		out, err := e.runScript(script, []string{"one", "two three"}, "sh", false, test.opts)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		if len(lines) != 4 {
+			t.Fatalf("Unexpected output '%s'", out)
+		}
+		if lines[0] != "one two three" {
+			t.Fatalf("Wrong arguments, got '%s'", lines[0])
+		}
+
+		//
+		// The script is private to us, even when it is run via
+		// sudo, and removed once it has completed.
+		//
+		if lines[2] != "700" || lines[3] != "700" {
+			t.Fatalf("The script was not private: %v", lines)
+		}
+		if _, err = os.Stat(filepath.Dir(lines[1])); err == nil {
+			t.Fatalf("The script was not removed")
+		}
+
+		if test.sudo != "" && !strings.Contains(sshLog(bin, "sudo"), test.sudo+lines[1]) {
+			t.Fatalf("The script was not run via sudo: %s", sshLog(bin, "sudo"))
+		}
+	}
+
+	//
+	// Running as another user hands the script over to them.
+	//
+	if !strings.Contains(sshLog(bin, "chown"), "-R bob "+os.TempDir()) {
+		t.Fatalf("The script was not handed over: %s", sshLog(bin, "chown"))
+	}
+	if strings.Count(sshLog(bin, "chown"), "\n") != 1 {
+		t.Fatalf("The script was handed over unnecessarily: %s", sshLog(bin, "chown"))
+	}
+}
@@ -0,0 +1,155 @@
+package evaluator
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"filippo.io/age"
+	"github.com/skx/deployr/secrets"
+	"golang.org/x/term"
+)
+
+// redacted is the text which replaces secret values in our output.
+const redacted = "****"
+
+// SetSecretsIdentity specifies the age identity-file used to decrypt
+// secrets files.
+func (e *Evaluator) SetSecretsIdentity(file string) {
+	e.SecretsIdentity = file
+}
+
+// SetSecretVariable sets the content of a read-only variable, whose value
+// will be redacted from our output.
+func (e *Evaluator) SetSecretVariable(key string, val string) {
+	e.addSecret(val)
+	e.ROVariables[key] = val
+}
+
+// AddSecretPattern adds a glob-pattern, such as "*_TOKEN", matching the
+// names of variables whose values should be redacted.
+func (e *Evaluator) AddSecretPattern(pattern string) error {
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return fmt.Errorf("invalid secret pattern '%s': %s", pattern, err.Error())
+	}
+	e.SecretPatterns = append(e.SecretPatterns, pattern)
+	return nil
+}
+
+// isSecretName returns true if the given variable-name matches one of
+// our secret patterns.
+func (e *Evaluator) isSecretName(name string) bool {
+	for _, pattern := range e.SecretPatterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadSecrets decrypts the given secrets file, and stores the values it
+// contains as read-only variables.
+//
+// The values are redacted from all subsequent output.
+func (e *Evaluator) LoadSecrets(file string) error {
+
+	identities, err := e.secretsIdentities()
+	if err != nil {
+		return err
+	}
+
+	vals, err := secrets.Load(file, identities...)
+	if err != nil {
+		return err
+	}
+
+	for key, val := range vals {
+		e.SetVariable(key, val)
+		e.addSecret(val)
+	}
+	return nil
+}
+
+// secretsIdentities returns the identities used to decrypt secrets files.
+//
+// If an identity-file has been specified it is loaded, otherwise the
+// passphrase is taken from $DEPLOYR_SECRETS_PASSPHRASE, or prompted for.
+func (e *Evaluator) secretsIdentities() ([]age.Identity, error) {
+
+	if e.SecretsIdentity != "" {
+		f, err := os.Open(e.SecretsIdentity)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return age.ParseIdentities(f)
+	}
+
+	pass, ok := os.LookupEnv("DEPLOYR_SECRETS_PASSPHRASE")
+	if !ok {
+		if !term.IsTerminal(int(syscall.Stdin)) {
+			return nil, fmt.Errorf("a secrets passphrase is required, but $DEPLOYR_SECRETS_PASSPHRASE is not set and STDIN is not a terminal")
+		}
+
+		fmt.Printf("Please enter the passphrase for your secrets: ")
+		text, err := term.ReadPassword(int(syscall.Stdin))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("\n")
+		pass = string(text)
+	}
+
+	identity, err := age.NewScryptIdentity(pass)
+	if err != nil {
+		return nil, err
+	}
+	return []age.Identity{identity}, nil
+}
+
+// addSecret records a value which should be redacted from our output,
+// along with its upper and lower-case forms, since "${name^^}" and
+// "${name,,}" expand to those.
+func (e *Evaluator) addSecret(val string) {
+	if val == "" {
+		return
+	}
+	for _, form := range []string{val, strings.ToUpper(val), strings.ToLower(val)} {
+		known := false
+		for _, s := range e.secrets {
+			if s == form {
+				known = true
+				break
+			}
+		}
+		if !known {
+			e.secrets = append(e.secrets, form)
+		}
+	}
+
+	//
+	// Replace longer secrets first, so that a secret which contains
+	// another is entirely redacted.
+	//
+	sort.Slice(e.secrets, func(i, j int) bool {
+		return len(e.secrets[i]) > len(e.secrets[j])
+	})
+}
+
+// redact replaces any secret values within the given string.
+func (e *Evaluator) redact(in string) string {
+	for _, s := range e.secrets {
+		in = strings.Replace(in, s, redacted, -1)
+	}
+	return in
+}
+
+// printf is a wrapper around fmt.Printf which redacts secret values.
+func (e *Evaluator) printf(format string, a ...interface{}) {
+	fmt.Print(e.redact(fmt.Sprintf(format, a...)))
+}
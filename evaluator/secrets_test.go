@@ -0,0 +1,125 @@
+package evaluator
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/skx/deployr/ast"
+	"github.com/skx/deployr/token"
+)
+
+// TestRedact tests that secret values are removed from strings.
+func TestRedact(t *testing.T) {
+
+	e := New(nil)
+	e.addSecret("abc")
+	e.addSecret("abcdef")
+	e.addSecret("Pa55word")
+	e.addSecret("")
+
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"nothing secret", "nothing secret"},
+		{"token=abc", "token=****"},
+		{"token=abcdef", "token=****"},
+		{"abc abc", "**** ****"},
+		{"ABC pa55word PA55WORD", "**** **** ****"},
+	}
+
+	for _, tst := range tests {
+		out := e.redact(tst.input)
+		if out != tst.output {
+			t.Fatalf("Redacting '%s' gave '%s', expected '%s'", tst.input, out, tst.output)
+		}
+	}
+}
+
+// bogusStatement is a statement which the evaluator cannot run.
+type bogusStatement struct {
+	ast.Base
+}
+
+func (b *bogusStatement) Arguments() []token.Token { return nil }
+func (b *bogusStatement) String() string           { return b.Token.Literal }
+
+// TestRedactErrors tests that errors returned by Run are redacted.
+func TestRedactErrors(t *testing.T) {
+
+	program := &ast.Program{Statements: []ast.Statement{
+		&bogusStatement{ast.Base{Token: token.Token{Type: "Bogus", Literal: "s3cr3t"}}},
+	}}
+
+	e := New(program)
+	e.addSecret("s3cr3t")
+
+	err := e.Run()
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+	if strings.Contains(err.Error(), "s3cr3t") {
+		t.Fatalf("Our error leaked the secret: %s", err.Error())
+	}
+	if !strings.Contains(err.Error(), "****") {
+		t.Fatalf("Our error wasn't redacted: %s", err.Error())
+	}
+}
+
+// TestSecretVariables tests that variables may be marked as secret, by
+// name-pattern or explicitly.
+func TestSecretVariables(t *testing.T) {
+
+	program := &ast.Program{Statements: []ast.Statement{
+		&ast.SetStatement{
+			Base:  ast.Base{Token: token.Token{Type: "Set", Literal: "Set"}},
+			Name:  token.Token{Type: "IDENT", Literal: "API_TOKEN"},
+			Value: token.Token{Type: "STRING", Literal: "tok123"},
+		},
+		&ast.SecretStatement{
+			Base:  ast.Base{Token: token.Token{Type: "Secret", Literal: "Secret"}},
+			Name:  token.Token{Type: "IDENT", Literal: "DB"},
+			Value: token.Token{Type: "STRING", Literal: "db456"},
+		},
+		&ast.SetStatement{
+			Base:  ast.Base{Token: token.Token{Type: "Set", Literal: "Set"}},
+			Name:  token.Token{Type: "IDENT", Literal: "PUBLIC"},
+			Value: token.Token{Type: "STRING", Literal: "public"},
+		},
+	}}
+
+	e := New(program)
+	err := e.AddSecretPattern("*_TOKEN")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	e.SetVariable("ADMIN_TOKEN", "admin789")
+	e.SetVariable("VERSION", "1.2")
+	e.SetSecretVariable("PASS", "pass000")
+
+	err = e.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	out := e.redact("tok123 db456 public admin789 1.2 pass000")
+	if out != "**** **** public **** 1.2 ****" {
+		t.Fatalf("Unexpected redaction: %s", out)
+	}
+
+	//
+	// As are their values when their case is changed.
+	//
+	out, err = e.expandString("${DB^^} ${API_TOKEN^^} ${PASS,,}")
+	if err != nil || e.redact(out) != "**** **** ****" {
+		t.Fatalf("Unexpected redaction: %s %v", e.redact(out), err)
+	}
+
+	//
+	// Bogus patterns are rejected.
+	//
+	err = e.AddSecretPattern("[")
+	if err == nil {
+		t.Fatalf("Expected an error with a bogus pattern")
+	}
+}
@@ -0,0 +1,151 @@
+package evaluator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// commander runs a command upon the remote host, returning its output,
+// as execute does.
+//
+// Primitives which run several commands take one, so that they may be
+// tested without a remote host.
+type commander func(cmd string, opts execOptions) ([]byte, error)
+
+// statusMarker prefixes the status of a service, so that it can't be
+// confused with any warnings from sudo.
+const statusMarker = "deployr_status"
+
+// isUnitFile returns true if the given remote path looks like part of
+// the configuration of systemd, such as a unit file or a drop-in.
+func isUnitFile(remote string) bool {
+	return strings.Contains(remote, "/systemd/")
+}
+
+// service ensures the named systemd service is in the given state, one
+// of "running", "stopped", "restarted", or "reloaded", and is enabled,
+// or not, at boot.  Empty values are left alone.
+//
+// Only the commands required to make a change are run, and the return
+// value records whether a change was made.  If systemd must reload its
+// configuration, because unit files were changed, that is done first.
+func (e *Evaluator) service(run commander, name string, state string, enabled string, opts execOptions) (bool, error) {
+
+	changed := false
+
+	//
+	// systemctl runs the given command, returning its trimmed output.
+	//
+	systemctl := func(args string) (string, error) {
+		out, err := run("systemctl "+args+" "+shellQuote(name), opts)
+		if err != nil {
+			return "", fmt.Errorf("failed to run 'systemctl %s %s': %s\n%s", args, name, err.Error(), out)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	//
+	// query runs a command which reports the status of the service.
+	//
+	// These exit with a non-zero status when the service isn't
+	// active, or enabled, so only missing output is an error.
+	//
+	query := func(args string) (string, error) {
+		out, err := run(markOutput("systemctl "+args+" "+shellQuote(name), statusMarker), opts)
+		lines := markedLines(out, statusMarker)
+		if len(lines) == 0 {
+			if err == nil {
+				err = fmt.Errorf("no status was shown")
+			}
+			return "", fmt.Errorf("failed to run 'systemctl %s %s': %s\n%s", args, name, err.Error(), out)
+		}
+		return strings.TrimSpace(lines[0]), nil
+	}
+
+	if e.daemonReload {
+		if e.Verbose {
+			e.printf("\tReloading systemd, as unit files were changed.\n")
+		}
+		out, err := run("systemctl daemon-reload", opts)
+		if err != nil {
+			return false, fmt.Errorf("failed to run 'systemctl daemon-reload': %s\n%s", err.Error(), out)
+		}
+		e.daemonReload = false
+	}
+
+	//
+	// Handle the enabled-state first, so that a service is enabled
+	// even if starting it fails.
+	//
+	if enabled != "" {
+		want, err := strconv.ParseBool(enabled)
+		if err != nil {
+			return false, fmt.Errorf("invalid value for enabled '%s' - expected true or false", enabled)
+		}
+
+		status, err := query("is-enabled")
+		if err != nil {
+			return false, err
+		}
+
+		action := ""
+		if want && status != "enabled" {
+			action = "enable"
+		}
+		if !want && status == "enabled" {
+			action = "disable"
+		}
+
+		if action != "" {
+			_, err = systemctl(action)
+			if err != nil {
+				return false, err
+			}
+			e.printf("\tService %s: %sd\n", name, action)
+			changed = true
+		}
+	}
+
+	action := ""
+	switch state {
+	case "":
+	case "running", "stopped":
+		status, err := query("is-active")
+		if err != nil {
+			return false, err
+		}
+
+		if state == "running" && status != "active" {
+			action = "start"
+		}
+		if state == "stopped" && status == "active" {
+			action = "stop"
+		}
+	case "restarted":
+		action = "restart"
+	case "reloaded":
+		action = "reload"
+	default:
+		return false, fmt.Errorf("invalid value for state '%s' - expected running, stopped, restarted, or reloaded", state)
+	}
+
+	if action != "" {
+		_, err := systemctl(action)
+		if err != nil {
+			return false, err
+		}
+		e.printf("\tService %s: %s\n", name, map[string]string{
+			"start":   "started",
+			"stop":    "stopped",
+			"restart": "restarted",
+			"reload":  "reloaded",
+		}[action])
+		changed = true
+	}
+
+	if !changed && e.Verbose {
+		e.printf("\tService %s doesn't need to be changed.\n", name)
+	}
+	return changed, nil
+}
@@ -0,0 +1,140 @@
+package evaluator
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/skx/deployr/ast"
+)
+
+// fakeSystemd pretends to be systemctl upon a remote host, recording
+// the commands which were run.
+type fakeSystemd struct {
+	active  string
+	enabled string
+	run     []string
+}
+
+// execute handles a command, as a commander.
+//
+// The status of the service is shown as it would be via sudo, with a
+// warning which should be ignored.
+func (f *fakeSystemd) execute(cmd string, opts execOptions) ([]byte, error) {
+	marker := ""
+	if inner, m, ok := unmarkOutput(cmd); ok {
+		cmd, marker = inner, m
+	}
+	f.run = append(f.run, cmd)
+
+	switch {
+	case strings.HasPrefix(cmd, "systemctl is-active "):
+		if f.active != "active" {
+			return markedReply(marker, f.active), fmt.Errorf("exit status 3")
+		}
+		return markedReply(marker, f.active), nil
+	case strings.HasPrefix(cmd, "systemctl is-enabled "):
+		if f.enabled != "enabled" {
+			return markedReply(marker, f.enabled), fmt.Errorf("exit status 1")
+		}
+		return markedReply(marker, f.enabled), nil
+	}
+	return nil, nil
+}
+
+// TestService tests that only the required changes are made to services.
+func TestService(t *testing.T) {
+
+	tests := []struct {
+		active   string
+		enabled  string
+		state    string
+		want     string
+		changed  bool
+		commands []string
+	}{
+		{"inactive", "disabled", "running", "true", true, []string{
+			"systemctl is-enabled 'app'",
+			"systemctl enable 'app'",
+			"systemctl is-active 'app'",
+			"systemctl start 'app'",
+		}},
+		{"active", "enabled", "running", "true", false, []string{
+			"systemctl is-enabled 'app'",
+			"systemctl is-active 'app'",
+		}},
+		{"active", "enabled", "stopped", "false", true, []string{
+			"systemctl is-enabled 'app'",
+			"systemctl disable 'app'",
+			"systemctl is-active 'app'",
+			"systemctl stop 'app'",
+		}},
+		{"active", "enabled", "restarted", "", true, []string{
+			"systemctl restart 'app'",
+		}},
+	}
+
+	for _, test := range tests {
+		fake := &fakeSystemd{active: test.active, enabled: test.enabled}
+
+		e := New(&ast.Program{})
+		changed, err := e.service(fake.execute, "app", test.state, test.want, execOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if changed != test.changed {
+			t.Fatalf("Expected changed to be %v for %v", test.changed, test)
+		}
+		if !reflect.DeepEqual(fake.run, test.commands) {
+			t.Fatalf("Unexpected commands %v for %v", fake.run, test)
+		}
+	}
+
+	//
+	// Changed unit files cause systemd to reload, once.
+	//
+	fake := &fakeSystemd{active: "active", enabled: "enabled"}
+	e := New(&ast.Program{})
+	e.daemonReload = true
+	for i := 0; i < 2; i++ {
+		_, err := e.service(fake.execute, "app", "running", "", execOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+	expected := []string{
+		"systemctl daemon-reload",
+		"systemctl is-active 'app'",
+		"systemctl is-active 'app'",
+	}
+	if !reflect.DeepEqual(fake.run, expected) {
+		t.Fatalf("Unexpected commands %v", fake.run)
+	}
+
+	//
+	// Bogus values are errors.
+	//
+	_, err := e.service(fake.execute, "app", "asleep", "", execOptions{})
+	if err == nil || !strings.Contains(err.Error(), "invalid value for state") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+	_, err = e.service(fake.execute, "app", "", "maybe", execOptions{})
+	if err == nil || !strings.Contains(err.Error(), "invalid value for enabled") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+}
+
+// TestUnitFile tests our detection of systemd configuration.
+func TestUnitFile(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/etc/systemd/system/app.service":          true,
+		"/etc/systemd/system/app.service.d/x.conf": true,
+		"/lib/systemd/system/app.timer":            true,
+		"/etc/nginx/nginx.conf":                    false,
+	} {
+		if isUnitFile(path) != expected {
+			t.Fatalf("Unexpected result for %s", path)
+		}
+	}
+}
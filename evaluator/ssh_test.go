@@ -0,0 +1,299 @@
+package evaluator
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/sfreiberg/simplessh"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSudo is installed upon the PATH of our test SSH server, in place of
+// sudo.  It records its arguments and then runs the command as the
+// current user.
+//
+// If a file named "warn" exists beside it a warning is written to stderr
+// first, as real sudo does when it cannot resolve the hostname, and if a
+// file named "crlf" exists the output has terminal line-endings.
+//
+// With -S the password is read from stdin, and must match the content of
+// the file named "password", with up to three attempts.
+const fakeSudo = `#!/bin/sh
+bin=$(dirname "$0")
+printf '%s\n' "$*" >> "$bin/sudo.log"
+if [ -e "$bin/warn" ]; then
+	echo "sudo: unable to resolve host test" >&2
+fi
+prompt="Password:"
+stdin=
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-u) shift 2 ;;
+	-p) prompt=$2; shift 2 ;;
+	-n) shift ;;
+	-S) stdin=1; shift ;;
+	*) break ;;
+	esac
+done
+if [ -n "$stdin" ]; then
+	for attempt in 1 2 3; do
+		printf '%s' "$prompt" >&2
+		IFS= read -r password || exit 1
+		[ "$password" = "$(cat "$bin/password")" ] && break
+		echo "Sorry, try again." >&2
+		[ $attempt -lt 3 ] || exit 1
+	done
+fi
+if [ -e "$bin/crlf" ]; then
+	"$@" | sed 's/$/\r/'
+	exit
+fi
+exec "$@"
+`
+
+// fakeDoas is installed upon the PATH of our test SSH server, in place of
+// doas.  It records its arguments and then runs the command as the
+// current user.
+//
+// Unless -n is given the password is read, as it would be from the
+// terminal, and must match the content of the file named "password".
+const fakeDoas = `#!/bin/sh
+bin=$(dirname "$0")
+printf '%s\n' "$*" >> "$bin/doas.log"
+nopass=
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-u) shift 2 ;;
+	-n) nopass=1; shift ;;
+	*) break ;;
+	esac
+done
+if [ -z "$nopass" ]; then
+	printf 'doas (test@localhost) password: '
+	IFS= read -r password || exit 1
+	printf '\r\n'
+	if [ "$password" != "$(cat "$bin/password")" ]; then
+		echo "doas: Authentication failed"
+		exit 1
+	fi
+fi
+exec "$@"
+`
+
+// fakeSu is installed upon the PATH of our test SSH server, in place of
+// su.  It records its arguments and then runs the command given via -c
+// as the current user.
+//
+// If a file named "password" exists beside it the password is read, as
+// it would be from the terminal, and must match its content.
+const fakeSu = `#!/bin/sh
+bin=$(dirname "$0")
+printf '%s\n' "$*" >> "$bin/su.log"
+[ "$1" = "-c" ] || shift
+if [ -e "$bin/password" ]; then
+	printf 'Password: '
+	IFS= read -r password || exit 1
+	printf '\r\n'
+	if [ "$password" != "$(cat "$bin/password")" ]; then
+		echo "su: Authentication failure"
+		exit 1
+	fi
+fi
+exec sh -c "$2"
+`
+
+// fakeChown is installed upon the PATH of our test SSH server, in place
+// of chown, so that changing ownership to other users may be tested
+// without privileges.  It records its arguments and does nothing else.
+const fakeChown = `#!/bin/sh
+printf '%s\n' "$*" >> "$(dirname "$0")/chown.log"
+`
+
+// sshServer is a helper which starts an SSH server upon the loopback
+// interface, which runs commands locally via "sh -c" and serves SFTP
+// from the local filesystem.
+//
+// The returned evaluator is connected to it, with sudo configured not to
+// require a password, and the returned directory holds the fake sudo,
+// doas, su, and chown commands along with their logs.
+func sshServer(t *testing.T) (*Evaluator, string, func()) {
+
+	bin, err := ioutil.TempDir("", "bin")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	for name, content := range map[string]string{"sudo": fakeSudo, "doas": fakeDoas, "su": fakeSu, "chown": fakeChown} {
+		err = ioutil.WriteFile(filepath.Join(bin, name), []byte(content), 0755)
+		if err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err.Error())
+		}
+	}
+
+	config := sshConfig(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config, bin)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err.Error())
+	}
+
+	e := New(nil)
+	e.Connection = &simplessh.Client{SSHClient: client}
+	e.SudoNoPasswd = true
+
+	return e, bin, func() {
+		client.Close()
+		listener.Close()
+		os.RemoveAll(bin)
+	}
+}
+
+// sshConfig is a helper which returns the configuration of a test SSH
+// server, with a freshly generated host key and no authentication.
+func sshConfig(t *testing.T) *ssh.ServerConfig {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %s", err.Error())
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %s", err.Error())
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	return config
+}
+
+// serveSSH handles the sessions opened upon the given connection.
+func serveSSH(conn net.Conn, config *ssh.ServerConfig, bin string) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		channel, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSession(channel, requests, bin)
+	}
+}
+
+// serveSession handles the requests made upon a single session, running
+// at most one command.
+//
+// As with OpenSSH a signal is delivered to the command alone, rather than
+// any children it started, and closing the session doesn't kill it.
+func serveSession(channel ssh.Channel, requests <-chan *ssh.Request, bin string) {
+	var cmd *exec.Cmd
+	var m sync.Mutex
+
+	kill := func() {
+		m.Lock()
+		defer m.Unlock()
+		if cmd != nil && cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	}
+
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(req.Payload, &payload)
+
+			m.Lock()
+			cmd = exec.Command("sh", "-c", payload.Command)
+			cmd.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"))
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			stdin, _ := cmd.StdinPipe()
+			err := cmd.Start()
+			m.Unlock()
+
+			req.Reply(err == nil, nil)
+			if err != nil {
+				channel.Close()
+				continue
+			}
+			go func() {
+				io.Copy(stdin, channel)
+				stdin.Close()
+			}()
+			go func(cmd *exec.Cmd) {
+				status := 0
+				if err := cmd.Wait(); err != nil {
+					status = 1
+					if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() > 0 {
+						status = exit.ExitCode()
+					}
+				}
+				code := make([]byte, 4)
+				binary.BigEndian.PutUint32(code, uint32(status))
+				channel.SendRequest("exit-status", false, code)
+				channel.Close()
+			}(cmd)
+
+		case "subsystem":
+			var payload struct{ Name string }
+			ssh.Unmarshal(req.Payload, &payload)
+			req.Reply(payload.Name == "sftp", nil)
+			if payload.Name == "sftp" {
+				go func() {
+					server, err := sftp.NewServer(channel)
+					if err == nil {
+						server.Serve()
+					}
+					channel.Close()
+				}()
+			}
+
+		case "signal":
+			kill()
+
+		default:
+			req.Reply(req.Type == "pty-req" || req.Type == "env", nil)
+		}
+	}
+}
+
+// sshLog is a helper which returns the log written by the given fake
+// command, if any.
+func sshLog(bin string, name string) string {
+	data, _ := ioutil.ReadFile(filepath.Join(bin, name+".log"))
+	return string(data)
+}
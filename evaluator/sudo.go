@@ -0,0 +1,236 @@
+package evaluator
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// SetSudoNoPasswd specifies that sudo should be invoked non-interactively,
+// via "sudo -n", such that no password is required.
+func (e *Evaluator) SetSudoNoPasswd(nopasswd bool) {
+	e.SudoNoPasswd = nopasswd
+}
+
+// SetSudoPasswordEnv specifies the name of the environmental variable
+// which holds the sudo password.
+func (e *Evaluator) SetSudoPasswordEnv(name string) {
+	e.SudoPasswordEnv = name
+}
+
+// SetSudoPasswordFD specifies a file-descriptor from which the sudo
+// password should be read.  A negative value disables this.
+func (e *Evaluator) SetSudoPasswordFD(fd int) {
+	e.SudoPasswordFD = fd
+}
+
+// SetSudoPasswordFile specifies the file which holds the sudo password.
+func (e *Evaluator) SetSudoPasswordFile(file string) {
+	e.SudoPasswordFile = file
+}
+
+// SetSudoAskPass specifies a command which is executed to retrieve the
+// sudo password, which it should write to STDOUT.
+func (e *Evaluator) SetSudoAskPass(command string) {
+	e.SudoAskPass = command
+}
+
+// sudoPassword returns the password to use for sudo.
+//
+// The password is taken from the first configured source, in the order
+// environmental variable, file-descriptor, file, and askpass-command.
+// If no source is configured the user is prompted upon the terminal.
+func (e *Evaluator) sudoPassword() (string, error) {
+
+	//
+	// Environmental variable.
+	//
+	if e.SudoPasswordEnv != "" {
+		val, ok := os.LookupEnv(e.SudoPasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("sudo password variable $%s is not set", e.SudoPasswordEnv)
+		}
+		return val, nil
+	}
+
+	//
+	// File-descriptor.
+	//
+	if e.SudoPasswordFD >= 0 {
+		f := os.NewFile(uintptr(e.SudoPasswordFD), "sudo-password")
+		if f == nil {
+			return "", fmt.Errorf("invalid sudo password file-descriptor %d", e.SudoPasswordFD)
+		}
+		defer f.Close()
+
+		return firstLine(f)
+	}
+
+	//
+	// File.
+	//
+	if e.SudoPasswordFile != "" {
+		data, err := ioutil.ReadFile(e.SudoPasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read sudo password file: %s", err.Error())
+		}
+		return firstLine(bytes.NewReader(data))
+	}
+
+	//
+	// Askpass command.
+	//
+	if e.SudoAskPass != "" {
+		cmd := exec.Command(e.SudoAskPass, fmt.Sprintf("Please enter your password for %s: ", e.BecomeMethod))
+		cmd.Stderr = os.Stderr
+
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to run askpass command '%s': %s", e.SudoAskPass, err.Error())
+		}
+		return firstLine(bytes.NewReader(out))
+	}
+
+	//
+	// Finally prompt upon the terminal, if we have one.
+	//
+	if !term.IsTerminal(int(syscall.Stdin)) {
+		return "", fmt.Errorf("a sudo password is required, but no password source was configured and STDIN is not a terminal")
+	}
+
+	fmt.Printf("Please enter your password for %s: ", e.BecomeMethod)
+
+	text, err := term.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("\n")
+
+	return string(text), nil
+}
+
+// firstLine returns the first line read from the given reader, without
+// any trailing newline.
+func firstLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// hashMarker prefixes the hash of a remote file, so that it can't be
+// confused with any warnings from sudo.
+const hashMarker = "deployr_sha1"
+
+// sudoCopy copies the local file to the remote host, via sudo.
+//
+// The remote file is hashed via sudo, and if it differs from the given
+// local hash the file is uploaded to a private temporary directory, then
+// copied beside the remote file via sudo and renamed over it, so that it
+// is never seen in a partially-written state.
+//
+// The return value records whether the remote file was changed.
+func (e *Evaluator) sudoCopy(local string, remote string, hashLocal string, opts execOptions) (bool, error) {
+
+	//
+	// Hash the remote file, if it exists.
+	//
+	script := "[ ! -e " + shellQuote(remote) + " ] || { s=$(sha1sum < " + shellQuote(remote) + ") && printf '" + hashMarker + " %s\\n' \"$s\"; }"
+
+	out, err := e.execute("sh -c "+shellQuote(script), opts)
+	if err != nil {
+		return false, fmt.Errorf("failed to hash remote file: %s\n%s", err.Error(), out)
+	}
+
+	var fields []string
+	if lines := markedLines(out, hashMarker); len(lines) > 0 {
+		fields = strings.Fields(lines[0])
+	}
+	if len(fields) > 0 && fields[0] == hashLocal {
+		if e.Verbose {
+			e.printf("\tFile on remote host doesn't need to be changed.\n")
+		}
+		return false, nil
+	}
+
+	if e.Verbose {
+		e.printf("\tFile on remote host needs replacing.\n")
+	}
+
+	//
+	// Create a temporary directory to upload into, which mktemp
+	// makes accessible to nobody but ourselves.
+	//
+	out, err = e.execute("mktemp -d", execOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to create temporary directory: %s\n%s", err.Error(), out)
+	}
+	dir := strings.TrimSpace(string(out))
+
+	cleanup := execOptions{}
+	defer func() {
+		e.execute("rm -rf "+shellQuote(dir), cleanup)
+	}()
+
+	tmp := dir + "/" + path.Base(remote)
+
+	err = e.Connection.Upload(local, tmp)
+	if err != nil {
+		return false, err
+	}
+
+	out, err = e.execute("chmod 600 "+shellQuote(tmp), execOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to set permissions on temporary file: %s\n%s", err.Error(), out)
+	}
+
+	//
+	// If sudo runs as a user other than root they can't read our
+	// upload, so we hand it over to them.
+	//
+	if opts.User != "" {
+		out, err = e.execute("chown -R "+shellQuote(opts.User)+" "+shellQuote(dir), execOptions{Sudo: true})
+		if err != nil {
+			return false, fmt.Errorf("failed to change owner of temporary directory: %s\n%s", err.Error(), out)
+		}
+		cleanup = opts
+	}
+
+	//
+	// Finally copy the file beside the original, and rename it into
+	// place.  An existing file retains its ownership and permissions.
+	//
+	out, err = e.execute("sh -c "+shellQuote(installScript(tmp, remote)), opts)
+	if err != nil {
+		return false, fmt.Errorf("failed to install file: %s\n%s", err.Error(), out)
+	}
+
+	return true, nil
+}
+
+// installScript returns a shell script which copies the file src to a
+// temporary file beside dst, with the mode, and where permitted the
+// ownership, of dst if it exists, and then renames it over dst.
+func installScript(src string, dst string) string {
+	return `set -e
+t=$(mktemp "$(dirname ` + shellQuote(dst) + `)/.deployr.XXXXXX")
+trap 'rm -f "$t"' EXIT
+cat ` + shellQuote(src) + ` > "$t"
+if [ -e ` + shellQuote(dst) + ` ]; then
+	chown "$(stat -c %u:%g ` + shellQuote(dst) + `)" "$t" 2>/dev/null || :
+	chmod "$(stat -c %a ` + shellQuote(dst) + `)" "$t"
+else
+	chmod 644 "$t"
+fi
+mv -f "$t" ` + shellQuote(dst)
+}
@@ -0,0 +1,258 @@
+package evaluator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skx/deployr/ast"
+	"github.com/skx/deployr/util"
+)
+
+// TestSudoPasswordEnv tests reading the sudo password from the environment.
+func TestSudoPasswordEnv(t *testing.T) {
+
+	os.Setenv("DEPLOYR_TEST_SUDO", "s3cr3t")
+	defer os.Unsetenv("DEPLOYR_TEST_SUDO")
+
+	e := New(nil)
+	e.SetSudoPasswordEnv("DEPLOYR_TEST_SUDO")
+
+	pass, err := e.sudoPassword()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if pass != "s3cr3t" {
+		t.Fatalf("Wrong password, got '%s'", pass)
+	}
+
+	//
+	// A missing variable is an error.
+	//
+	e.SetSudoPasswordEnv("DEPLOYR_TEST_MISSING")
+	_, err = e.sudoPassword()
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+	if !strings.Contains(err.Error(), "not set") {
+		t.Fatalf("Our error was misleading: %s", err.Error())
+	}
+}
+
+// TestSudoPasswordFile tests reading the sudo password from a file.
+func TestSudoPasswordFile(t *testing.T) {
+
+	tmpfile, err := ioutil.TempFile("", "sudo")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %s", err.Error())
+	}
+	defer os.Remove(tmpfile.Name())
+
+	ioutil.WriteFile(tmpfile.Name(), []byte("password\nignored\n"), 0600)
+
+	e := New(nil)
+	e.SetSudoPasswordFile(tmpfile.Name())
+
+	pass, err := e.sudoPassword()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if pass != "password" {
+		t.Fatalf("Wrong password, got '%s'", pass)
+	}
+
+	//
+	// A missing file is an error.
+	//
+	e.SetSudoPasswordFile(tmpfile.Name() + ".missing")
+	_, err = e.sudoPassword()
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+}
+
+// TestSudoPasswordFD tests reading the sudo password from a file-descriptor.
+func TestSudoPasswordFD(t *testing.T) {
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %s", err.Error())
+	}
+	w.Write([]byte("piped\r\n"))
+	w.Close()
+
+	e := New(nil)
+	e.SetSudoPasswordFD(int(r.Fd()))
+
+	pass, err := e.sudoPassword()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if pass != "piped" {
+		t.Fatalf("Wrong password, got '%s'", pass)
+	}
+}
+
+// TestSudoAskPass tests running a command to fetch the sudo password.
+func TestSudoAskPass(t *testing.T) {
+
+	e := New(nil)
+	e.SetSudoAskPass("echo")
+
+	//
+	// echo will output the prompt it is given.
+	//
+	pass, err := e.sudoPassword()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !strings.HasPrefix(pass, "Please enter your password") {
+		t.Fatalf("Wrong password, got '%s'", pass)
+	}
+
+	//
+	// A failing command is an error.
+	//
+	e.SetSudoAskPass("/does/not/exist")
+	_, err = e.sudoPassword()
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+}
+
+// TestEscalation tests that statements within Become-blocks inherit the
+// escalation, unless they have an explicit Sudo prefix.
+func TestEscalation(t *testing.T) {
+
+	e := New(nil)
+
+	tests := []struct {
+		become []string
+		prefix ast.Prefix
+		sudo   bool
+		user   string
+	}{
+		{nil, ast.Prefix{}, false, ""},
+		{nil, ast.Prefix{Sudo: true}, true, ""},
+		{[]string{"root"}, ast.Prefix{}, true, ""},
+		{[]string{"root", "app"}, ast.Prefix{}, true, "app"},
+		{[]string{"app"}, ast.Prefix{Sudo: true, SudoUser: "www-data"}, true, "www-data"},
+	}
+
+	for _, tst := range tests {
+		e.become = tst.become
+		opts := e.escalation(tst.prefix)
+		if opts.Sudo != tst.sudo || opts.User != tst.user {
+			t.Fatalf("Unexpected escalation within %v: %v", tst.become, opts)
+		}
+	}
+
+	opts := e.escalation(ast.Prefix{Timeout: 5 * time.Second})
+	if opts.Timeout != 5*time.Second {
+		t.Fatalf("Timeout was lost: %v", opts)
+	}
+}
+
+// TestSudoCopy tests installing files via sudo.
+func TestSudoCopy(t *testing.T) {
+
+	e, bin, stop := sshServer(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "sudocopy")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	local := filepath.Join(dir, "local")
+	remote := filepath.Join(dir, "remote")
+
+	ioutil.WriteFile(local, []byte("new content\n"), 0600)
+	hash, _ := util.HashFile(local)
+
+	//
+	// A missing file is created.
+	//
+	changed, err := e.sudoCopy(local, remote, hash, execOptions{Sudo: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !changed {
+		t.Fatalf("Expected a change")
+	}
+	data, _ := ioutil.ReadFile(remote)
+	if string(data) != "new content\n" {
+		t.Fatalf("Wrong content, got '%s'", data)
+	}
+	fi, _ := os.Stat(remote)
+	if fi.Mode().Perm() != 0644 {
+		t.Fatalf("Wrong mode, got %s", fi.Mode())
+	}
+	if !strings.Contains(sshLog(bin, "sudo"), "-n sh -c") {
+		t.Fatalf("The file was not installed via sudo: %s", sshLog(bin, "sudo"))
+	}
+
+	//
+	// An identical file is left alone, even if sudo shows warnings or
+	// has terminal line-endings.
+	//
+	for _, flag := range []string{"", "warn", "crlf"} {
+		if flag != "" {
+			ioutil.WriteFile(filepath.Join(bin, flag), nil, 0644)
+		}
+		changed, err = e.sudoCopy(local, remote, hash, execOptions{Sudo: true})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if changed {
+			t.Fatalf("Expected no change with '%s'", flag)
+		}
+	}
+	os.Remove(filepath.Join(bin, "warn"))
+	os.Remove(filepath.Join(bin, "crlf"))
+
+	//
+	// A different file is replaced, keeping its mode.
+	//
+	ioutil.WriteFile(remote, []byte("old content\n"), 0640)
+	os.Chmod(remote, 0640)
+
+	changed, err = e.sudoCopy(local, remote, hash, execOptions{Sudo: true, User: "bob"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !changed {
+		t.Fatalf("Expected a change")
+	}
+	data, _ = ioutil.ReadFile(remote)
+	if string(data) != "new content\n" {
+		t.Fatalf("Wrong content, got '%s'", data)
+	}
+	fi, _ = os.Stat(remote)
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("Wrong mode, got %s", fi.Mode())
+	}
+
+	//
+	// The upload was handed to the sudo user, rather than being made
+	// readable by everybody.
+	//
+	if !strings.Contains(sshLog(bin, "chown"), "-R bob "+os.TempDir()) {
+		t.Fatalf("The upload was not handed over: %s", sshLog(bin, "chown"))
+	}
+	if !strings.Contains(sshLog(bin, "sudo"), "-u bob -n sh -c") {
+		t.Fatalf("The file was not installed as bob: %s", sshLog(bin, "sudo"))
+	}
+
+	//
+	// No temporary files are left behind.
+	//
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Fatalf("Expected two files, got %d", len(files))
+	}
+}
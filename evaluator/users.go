@@ -0,0 +1,192 @@
+package evaluator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// accountMarker prefixes the output of getent and id, so that it can't be
+// confused with any warnings from sudo.
+const accountMarker = "deployr_account"
+
+// getent returns the fields of the named entry of the given database,
+// "passwd" or "group", or nil if there is no such entry.
+func getent(run commander, database string, name string, opts execOptions) ([]string, error) {
+	out, err := run(markOutput("getent "+database+" "+shellQuote(name), accountMarker), opts)
+	entry := strings.TrimSpace(strings.Join(markedLines(out, accountMarker), "\n"))
+
+	//
+	// getent exits with status 2 if there is no such entry, which
+	// is the only failure we expect.
+	//
+	if err != nil {
+		if entry == "" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to run 'getent %s %s': %s\n%s", database, name, err.Error(), out)
+	}
+	return strings.Split(entry, ":"), nil
+}
+
+// group ensures the named group exists, returning whether it was
+// created.
+func (e *Evaluator) group(run commander, name string, system string, opts execOptions) (bool, error) {
+
+	sys := false
+	if system != "" {
+		var err error
+		sys, err = strconv.ParseBool(system)
+		if err != nil {
+			return false, fmt.Errorf("invalid value for system '%s' - expected true or false", system)
+		}
+	}
+
+	entry, err := getent(run, "group", name, opts)
+	if err != nil {
+		return false, err
+	}
+	if entry != nil {
+		if e.Verbose {
+			e.printf("\tGroup %s already exists.\n", name)
+		}
+		return false, nil
+	}
+
+	cmd := "groupadd "
+	if sys {
+		cmd += "--system "
+	}
+	cmd += shellQuote(name)
+
+	out, err := run(cmd, opts)
+	if err != nil {
+		return false, fmt.Errorf("failed to run '%s': %s\n%s", cmd, err.Error(), out)
+	}
+	e.printf("\tGroup %s: created\n", name)
+	return true, nil
+}
+
+// user ensures the named user exists, with the given home directory,
+// shell, and supplementary groups, returning whether a change was made.
+//
+// Empty values are left alone, and the user is only ever added to the
+// groups, never removed from others.  Whether the user is a system user
+// only matters when it is created.
+func (e *Evaluator) user(run commander, name string, home string, shell string, system string, groups string, opts execOptions) (bool, error) {
+
+	sys := false
+	if system != "" {
+		var err error
+		sys, err = strconv.ParseBool(system)
+		if err != nil {
+			return false, fmt.Errorf("invalid value for system '%s' - expected true or false", system)
+		}
+	}
+
+	var wanted []string
+	for _, g := range strings.Split(groups, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			wanted = append(wanted, g)
+		}
+	}
+
+	//
+	// modify runs the given command, reporting the change.
+	//
+	modify := func(cmd string, change string) error {
+		out, err := run(cmd, opts)
+		if err != nil {
+			return fmt.Errorf("failed to run '%s': %s\n%s", cmd, err.Error(), out)
+		}
+		e.printf("\tUser %s: %s\n", name, change)
+		return nil
+	}
+
+	entry, err := getent(run, "passwd", name, opts)
+	if err != nil {
+		return false, err
+	}
+
+	//
+	// Create the user, if missing.
+	//
+	if entry == nil {
+		cmd := "useradd "
+		if sys {
+			cmd += "--system "
+		}
+		if home != "" {
+			cmd += "--home-dir " + shellQuote(home) + " --create-home "
+		}
+		if shell != "" {
+			cmd += "--shell " + shellQuote(shell) + " "
+		}
+		if len(wanted) > 0 {
+			cmd += "--groups " + shellQuote(strings.Join(wanted, ",")) + " "
+		}
+		cmd += shellQuote(name)
+
+		err = modify(cmd, "created")
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if len(entry) != 7 {
+		return false, fmt.Errorf("unexpected passwd entry for %s: %s", name, strings.Join(entry, ":"))
+	}
+
+	changed := false
+
+	if home != "" && entry[5] != home {
+		err = modify("usermod --home "+shellQuote(home)+" "+shellQuote(name), "home changed to "+home)
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	if shell != "" && entry[6] != shell {
+		err = modify("usermod --shell "+shellQuote(shell)+" "+shellQuote(name), "shell changed to "+shell)
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	if len(wanted) > 0 {
+		out, err := run(markOutput("id -nG "+shellQuote(name), accountMarker), opts)
+		if err != nil {
+			return false, fmt.Errorf("failed to run 'id -nG %s': %s\n%s", name, err.Error(), out)
+		}
+
+		member := make(map[string]bool)
+		for _, line := range markedLines(out, accountMarker) {
+			for _, g := range strings.Fields(line) {
+				member[g] = true
+			}
+		}
+
+		var missing []string
+		for _, g := range wanted {
+			if !member[g] {
+				missing = append(missing, g)
+			}
+		}
+
+		if len(missing) > 0 {
+			err = modify("usermod --append --groups "+shellQuote(strings.Join(missing, ","))+" "+shellQuote(name), "added to "+strings.Join(missing, ", "))
+			if err != nil {
+				return false, err
+			}
+			changed = true
+		}
+	}
+
+	if !changed && e.Verbose {
+		e.printf("\tUser %s doesn't need to be changed.\n", name)
+	}
+	return changed, nil
+}
@@ -0,0 +1,137 @@
+package evaluator
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/skx/deployr/ast"
+)
+
+// fakeAccounts pretends to be the account databases upon a remote host,
+// recording the commands which were run.  Commands starting with fail
+// fail, if it is set.
+type fakeAccounts struct {
+	entries map[string]string
+	groups  string
+	fail    string
+	run     []string
+}
+
+// execute handles a command, as a commander.
+//
+// Queries are answered as they would be via sudo, with a warning which
+// should be ignored.
+func (f *fakeAccounts) execute(cmd string, opts execOptions) ([]byte, error) {
+	marker := ""
+	if inner, m, ok := unmarkOutput(cmd); ok {
+		cmd, marker = inner, m
+	}
+	f.run = append(f.run, cmd)
+
+	if f.fail != "" && strings.HasPrefix(cmd, f.fail) {
+		return []byte(f.fail + ": failed\n"), fmt.Errorf("exit status 1")
+	}
+	if strings.HasPrefix(cmd, "getent ") {
+		if entry, ok := f.entries[cmd]; ok {
+			return markedReply(marker, entry), nil
+		}
+		return markedReply(marker, ""), fmt.Errorf("exit status 2")
+	}
+	if strings.HasPrefix(cmd, "id -nG ") {
+		return markedReply(marker, f.groups), nil
+	}
+	return nil, nil
+}
+
+// TestUser tests that users are only created, or modified, as required.
+func TestUser(t *testing.T) {
+
+	//
+	// A missing user is created.
+	//
+	fake := &fakeAccounts{}
+	e := New(&ast.Program{})
+	changed, err := e.user(fake.execute, "app", "/opt/app", "/usr/sbin/nologin", "true", "adm", execOptions{})
+	if err != nil || !changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+	expected := []string{
+		"getent passwd 'app'",
+		"useradd --system --home-dir '/opt/app' --create-home --shell '/usr/sbin/nologin' --groups 'adm' 'app'",
+	}
+	if !reflect.DeepEqual(fake.run, expected) {
+		t.Fatalf("Unexpected commands %v", fake.run)
+	}
+
+	//
+	// Failing to create the user is not a change.
+	//
+	fake = &fakeAccounts{fail: "useradd"}
+	changed, err = e.user(fake.execute, "app", "", "", "", "", execOptions{})
+	if err == nil || changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+
+	//
+	// An existing user is only changed if it differs.
+	//
+	entries := map[string]string{
+		"getent passwd 'app'": "app:x:999:999::/opt/app:/bin/sh",
+	}
+
+	fake = &fakeAccounts{entries: entries, groups: "app adm"}
+	changed, err = e.user(fake.execute, "app", "/opt/app", "/usr/sbin/nologin", "true", "adm,www-data", execOptions{})
+	if err != nil || !changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+	expected = []string{
+		"getent passwd 'app'",
+		"usermod --shell '/usr/sbin/nologin' 'app'",
+		"id -nG 'app'",
+		"usermod --append --groups 'www-data' 'app'",
+	}
+	if !reflect.DeepEqual(fake.run, expected) {
+		t.Fatalf("Unexpected commands %v", fake.run)
+	}
+
+	fake = &fakeAccounts{entries: entries, groups: "app adm"}
+	changed, err = e.user(fake.execute, "app", "/opt/app", "/bin/sh", "", "adm", execOptions{})
+	if err != nil || changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+
+	_, err = e.user(fake.execute, "app", "", "", "maybe", "", execOptions{})
+	if err == nil || !strings.Contains(err.Error(), "invalid value for system") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+}
+
+// TestGroup tests that groups are only created as required.
+func TestGroup(t *testing.T) {
+
+	fake := &fakeAccounts{entries: map[string]string{
+		"getent group 'adm'": "adm:x:4:syslog",
+	}}
+	e := New(&ast.Program{})
+
+	changed, err := e.group(fake.execute, "adm", "", execOptions{})
+	if err != nil || changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+
+	changed, err = e.group(fake.execute, "app", "true", execOptions{})
+	if err != nil || !changed {
+		t.Fatalf("Unexpected result %v %v", changed, err)
+	}
+
+	expected := []string{
+		"getent group 'adm'",
+		"getent group 'app'",
+		"groupadd --system 'app'",
+	}
+	if !reflect.DeepEqual(fake.run, expected) {
+		t.Fatalf("Unexpected commands %v", fake.run)
+	}
+}
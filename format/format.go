@@ -0,0 +1,188 @@
+// Package format rewrites recipes in a canonical form.
+//
+// Recipes are parsed, along with their comments, and the canonical form
+// is printed from the resulting program.
+//
+// The canonical form has one statement per line, single spaces between
+// arguments, consistently-quoted strings, statements within "Become"
+// blocks indented, and no more than a single blank line between
+// statements.  Comments are preserved.
+//
+// Strings which use line-continuations are left exactly as they were
+// written, because the whitespace following a continuation is part of
+// the value of the string.  Raw strings and heredocs are also left
+// as they were written, since they're used to hold text verbatim.
+package format
+
+import (
+	"strings"
+
+	"github.com/skx/deployr/ast"
+	"github.com/skx/deployr/lexer"
+	"github.com/skx/deployr/parser"
+	"github.com/skx/deployr/token"
+)
+
+// indentation is the text used to indent each level of a block.
+const indentation = "    "
+
+// printer holds our state as we format a recipe.
+type printer struct {
+
+	// out holds the formatted output.
+	out strings.Builder
+
+	// indent is the current indentation level.
+	indent int
+
+	// lastLine is the line of the input upon which the previous line
+	// of output ended.
+	lastLine int
+}
+
+// Source formats the given recipe, returning the canonical form.
+//
+// An error is returned if the recipe cannot be parsed, since we'll
+// never reformat a broken recipe.  Nor will we reformat one with parser
+// warnings, since the prefixes they concern aren't kept by the parser,
+// so would be silently removed.
+func Source(input string) (string, error) {
+
+	p := parser.New(lexer.NewWithComments(input))
+	program, err := p.Parse()
+	if err != nil {
+		return "", err
+	}
+
+	if warnings := p.Warnings(); len(warnings) > 0 {
+		var list parser.ErrorList
+		for _, w := range warnings {
+			list = append(list, &parser.Error{Pos: w.Pos, Message: w.Message + " - remove it before formatting"})
+		}
+		return "", list
+	}
+
+	return Program(program), nil
+}
+
+// Program returns the canonical form of the given program, which
+// should have been parsed with its comments.
+func Program(program *ast.Program) string {
+	p := &printer{}
+	p.statements(program.Statements)
+	p.comments(program.Comments)
+	return p.out.String()
+}
+
+// statements writes out the given statements, along with the comments
+// attached to them, and the bodies of any blocks.
+func (p *printer) statements(statements []ast.Statement) {
+	for _, s := range statements {
+		base := s.Common()
+
+		first := base.Start.Line
+		if first == 0 {
+			first = base.Token.Line
+		}
+
+		p.comments(base.Doc)
+		p.line(first, statement(s), base.Comment, lastLine(s))
+
+		if b, ok := s.(*ast.BecomeStatement); ok {
+			p.indent++
+			p.statements(b.Body)
+			p.comments(b.End.Doc)
+			p.indent--
+			p.line(b.End.Token.Line, b.End.Token.Literal, b.End.Comment, b.End.Token.Line)
+		}
+	}
+}
+
+// comments writes out the given comments, each upon its own line.
+func (p *printer) comments(comments []token.Token) {
+	for _, c := range comments {
+		p.line(c.Line, c.Literal, nil, c.Line)
+	}
+}
+
+// line writes out a line, which spanned the given lines of the input,
+// followed by the given comment if there is one.
+//
+// A single blank line is inserted if there were blank lines before it
+// in the input.
+func (p *printer) line(first int, text string, comment *token.Token, last int) {
+	if p.out.Len() > 0 && first > p.lastLine+1 {
+		p.out.WriteString("\n")
+	}
+
+	p.out.WriteString(strings.Repeat(indentation, p.indent))
+	p.out.WriteString(text)
+	if comment != nil {
+		p.out.WriteString(" " + comment.Literal)
+		if comment.Line > last {
+			last = comment.Line
+		}
+	}
+	p.out.WriteString("\n")
+
+	p.lastLine = last
+}
+
+// statement returns the canonical form of the given statement, with its
+// prefixes, upon a single line.
+func statement(s ast.Statement) string {
+	words := []string{s.Keyword().Literal}
+	if ps, ok := s.(ast.Prefixed); ok {
+		words[0] = ps.Prefixes().String() + words[0]
+	}
+
+	for _, arg := range s.Arguments() {
+		words = append(words, argument(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// argument returns the canonical form of the given argument.
+//
+// The value of an option, name="value", is quoted as any other string
+// would be.
+func argument(tok token.Token) string {
+	if tok.Type == token.STRING {
+		return Quote(tok)
+	}
+
+	name, value := ast.SplitOption(tok)
+	if tok.Raw != tok.Literal && strings.HasPrefix(tok.Raw, name+"=") {
+		raw := tok.Raw[len(name)+1:]
+		return name + "=" + Quote(token.Token{Type: token.STRING, Literal: value, Raw: raw})
+	}
+	return tok.Literal
+}
+
+// lastLine returns the line of the input upon which the given statement
+// ended, which is later than its first if a string spans several lines.
+func lastLine(s ast.Statement) int {
+	last := s.Keyword().Line
+	for _, arg := range s.Arguments() {
+		if end := arg.Line + strings.Count(arg.Raw, "\n"); end > last {
+			last = end
+		}
+	}
+	return last
+}
+
+// Quote returns the canonical source-form of the given string-token.
+//
+// Strings are double-quoted with the minimum of escaping, unless they
+// were written with line-continuations, as raw strings, or as heredocs,
+// in which case they're returned exactly as they were written.
+func Quote(tok token.Token) string {
+	if strings.Contains(tok.Raw, "\\\n") {
+		return tok.Raw
+	}
+	if strings.HasPrefix(tok.Raw, "`") || strings.HasPrefix(tok.Raw, "<<") {
+		return tok.Raw
+	}
+
+	return ast.Source(token.Token{Type: token.STRING, Literal: tok.Literal})
+}
@@ -0,0 +1,232 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/skx/deployr/ast"
+	"github.com/skx/deployr/lexer"
+	"github.com/skx/deployr/parser"
+)
+
+// TestFormat tests that recipes are rewritten in the canonical form.
+func TestFormat(t *testing.T) {
+
+	type TestCase struct {
+		input  string
+		output string
+	}
+
+	tests := []TestCase{
+
+		// Whitespace between arguments, and leading blank lines.
+		{"\n\n  DeployTo   foo@bar  \nSet  A   \"b\"\n",
+			"DeployTo foo@bar\nSet A \"b\"\n"},
+
+		// Multiple blank lines collapse to one.
+		{"Run \"a\"\n\n\n\nRun \"b\"",
+			"Run \"a\"\n\nRun \"b\"\n"},
+
+		// Several statements upon a single line.
+		{`Run "a" Run "b"`,
+			"Run \"a\"\nRun \"b\"\n"},
+
+		// Prefixes stay with their statement.
+		{"Sudo\n  Run \"a\"\nTimeout 10s Sudo -u app\nRun \"b\"",
+			"Sudo Run \"a\"\nTimeout 10s Sudo -u app Run \"b\"\n"},
+
+		// Prefixes are written in a consistent order.
+		{"Sudo Timeout 5m Run \"a\"\n\nSudo\nRun \"b\"",
+			"Timeout 5m Sudo Run \"a\"\n\nSudo Run \"b\"\n"},
+
+		// Escapes are canonical.
+		{`Run "tab\there \"quoted\" back\\slash"`,
+			"Run \"tab\\there \\\"quoted\\\" back\\\\slash\"\n"},
+
+		// Comments are kept, both trailing and upon their own line.
+		{"#!/usr/bin/env deployr\n# Setup\nSet A \"b\"    # trailing   \n\n\n# End\n",
+			"#!/usr/bin/env deployr\n# Setup\nSet A \"b\" # trailing\n\n# End\n"},
+
+		// Become blocks are indented, including nested blocks.
+		{"Become app\nRun \"a\"\n# comment\nBecome root\nRun \"b\"\nEnd\nEnd\nRun \"c\"",
+			"Become app\n    Run \"a\"\n    # comment\n    Become root\n        Run \"b\"\n    End\nEnd\nRun \"c\"\n"},
+
+		// Strings with continuations are untouched.
+		{"Run \"one \\\n     two\"   # comment\nRun \"c\"",
+			"Run \"one \\\n     two\" # comment\nRun \"c\"\n"},
+
+		// Options keep their values, quoted canonically.
+		{"RunScript   setup.sh  \"a\"   interpreter=\"/usr/bin/env  bash\" template=true",
+			"RunScript setup.sh \"a\" interpreter=\"/usr/bin/env  bash\" template=true\n"},
+
+		// Raw strings and heredocs are untouched, even within blocks.
+		{"Run   `echo \"x\"`\nBecome root\nRun <<EOF\n  echo \"\\t\"\nEOF\n   Run \"c\"\nEnd",
+			"Run `echo \"x\"`\nBecome root\n    Run <<EOF\n  echo \"\\t\"\nEOF\n    Run \"c\"\nEnd\n"},
+	}
+
+	for _, test := range tests {
+		out, err := Source(test.input)
+		if err != nil {
+			t.Fatalf("Unexpected error formatting '%s': %s", test.input, err.Error())
+		}
+		if out != test.output {
+			t.Errorf("Formatting '%s'\ngot:\n%s\nexpected:\n%s", test.input, out, test.output)
+		}
+
+		//
+		// Formatting is idempotent.
+		//
+		again, err := Source(out)
+		if err != nil {
+			t.Fatalf("Unexpected error reformatting '%s': %s", out, err.Error())
+		}
+		if again != out {
+			t.Errorf("Formatting is not idempotent\ngot:\n%s\nexpected:\n%s", again, out)
+		}
+	}
+}
+
+// TestRoundTrip tests that formatting a recipe doesn't change its
+// meaning, so parsing the formatted recipe gives the same program.
+func TestRoundTrip(t *testing.T) {
+
+	input := `#!/usr/bin/env deployr
+# Where we deploy to.
+DeployTo   deploy@example.com:2222   # production
+
+Set RELEASE "1.2"
+Set  GREETING   "tab\there \"quoted\""
+
+Become root
+    Package   nginx  curl state=present
+  Timeout 30s Run <<EOF
+echo "${RELEASE}"
+EOF
+    # Configure the application.
+    Become app
+        Sudo -u www-data   CopyTemplate ./templates/app.conf /etc/app.conf
+        IfChanged "systemctl restart app"   # only if needed
+    End
+    LineInFile /etc/hosts regexp="^127\\.0\\.0\\.1"   line=` + "`127.0.0.1 localhost`" + `
+# The end of the block.
+End   # done
+Local "date" set=NOW
+RunScript setup.sh "a \
+    b" interpreter="/usr/bin/env bash"
+# Trailing comment.
+`
+
+	program, err := parser.New(lexer.NewWithComments(input)).Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error parsing: %s", err.Error())
+	}
+
+	out := Program(program)
+
+	again, err := parser.New(lexer.NewWithComments(out)).Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error parsing formatted recipe: %s\n%s", err.Error(), out)
+	}
+
+	if dump(again) != dump(program) {
+		t.Fatalf("The program changed\ngot:\n%s\nexpected:\n%s", dump(again), dump(program))
+	}
+}
+
+// dump returns a description of the given program, which includes
+// everything but the positions of its tokens.
+func dump(program *ast.Program) string {
+	var out strings.Builder
+
+	var statements func(list []ast.Statement, depth int)
+	statements = func(list []ast.Statement, depth int) {
+		for _, s := range list {
+			indent := strings.Repeat("  ", depth)
+			base := s.Common()
+			for _, c := range base.Doc {
+				fmt.Fprintf(&out, "%s%s\n", indent, c.Literal)
+			}
+			fmt.Fprintf(&out, "%s%s", indent, s.Keyword().Type)
+			if ps, ok := s.(ast.Prefixed); ok {
+				fmt.Fprintf(&out, " %+v", ps.Prefixes())
+			}
+			for _, arg := range s.Arguments() {
+				fmt.Fprintf(&out, " %s:%q", arg.Type, arg.Literal)
+			}
+			if base.Comment != nil {
+				fmt.Fprintf(&out, " %s", base.Comment.Literal)
+			}
+			out.WriteString("\n")
+
+			if b, ok := s.(*ast.BecomeStatement); ok {
+				statements(b.Body, depth+1)
+				for _, c := range b.End.Doc {
+					fmt.Fprintf(&out, "%s  %s\n", indent, c.Literal)
+				}
+				fmt.Fprintf(&out, "%sEnd", indent)
+				if b.End.Comment != nil {
+					fmt.Fprintf(&out, " %s", b.End.Comment.Literal)
+				}
+				out.WriteString("\n")
+			}
+		}
+	}
+
+	statements(program.Statements, 0)
+	for _, c := range program.Comments {
+		fmt.Fprintf(&out, "%s\n", c.Literal)
+	}
+	return out.String()
+}
+
+// TestFormatError tests that broken recipes are not formatted.
+func TestFormatError(t *testing.T) {
+	_, err := Source(`Run`)
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+
+	//
+	// Nor are those with prefixes which have no effect, as they'd
+	// be dropped.
+	//
+	_, err = Source("Run \"a\"\nSudo Set A \"b\"\n")
+	if err == nil || !strings.Contains(err.Error(), "2:6: 'Sudo' has no effect on 'Set'") {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+}
+
+// TestDiff tests the generation of unified diffs.
+func TestDiff(t *testing.T) {
+
+	if Diff("x", "a\n", "a\n") != "" {
+		t.Fatalf("Expected no difference")
+	}
+
+	out := Diff("deploy.recipe", "a\nb\nc\n", "a\nB\nc\n")
+	expected := `--- deploy.recipe
++++ deploy.recipe
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+`
+	if out != expected {
+		t.Fatalf("Unexpected diff:\n%s", out)
+	}
+
+	//
+	// Distant changes are shown in separate hunks.
+	//
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	b := "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n"
+	out = Diff("f", a, b)
+	if strings.Count(out, "@@ -") != 2 {
+		t.Fatalf("Expected two hunks:\n%s", out)
+	}
+	if !strings.Contains(out, "@@ -1,4 +1,4 @@") || !strings.Contains(out, "@@ -9,4 +9,4 @@") {
+		t.Fatalf("Unexpected hunk ranges:\n%s", out)
+	}
+}
@@ -3,10 +3,11 @@ module github.com/skx/deployr
 go 1.12
 
 require (
+	filippo.io/age v1.2.1
 	github.com/davidmz/go-pageant v1.0.2
 	github.com/google/subcommands v1.2.0
-	github.com/pkg/sftp v1.13.6 // indirect
+	github.com/pkg/sftp v1.13.6
 	github.com/sfreiberg/simplessh v0.0.0-20220719182921-185eafd40485
-	golang.org/x/crypto v0.31.0 // indirect
+	golang.org/x/crypto v0.31.0
 	golang.org/x/term v0.27.0
 )
@@ -0,0 +1,218 @@
+// Package graph draws a parsed recipe as a graph.
+//
+// Statements are shown in the order they execute, with "Become" blocks
+// drawn around the statements within them.  Edges show which copy each
+// "IfChanged" depends upon, which statements set and use each variable,
+// and which local files are read by copies and scripts.
+//
+// Graphs may be rendered for Graphviz, as DOT, or for Mermaid.
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/skx/deployr/ast"
+	"github.com/skx/deployr/lint"
+)
+
+// maxLabel is the longest label we'll show for a statement.
+const maxLabel = 60
+
+// Edge kinds.
+const (
+	// next links a statement to the one executed after it.
+	next = "next"
+
+	// changed links a statement which records a change, such as a
+	// copy, to an IfChanged which depends upon it.
+	changed = "changed"
+
+	// sets links a statement to the variable it sets.
+	sets = "sets"
+
+	// uses links a variable to a statement which uses it.
+	uses = "uses"
+
+	// reads links a local file to a statement which reads it.
+	reads = "read by"
+)
+
+// edge is a link between two nodes.
+type edge struct {
+	from string
+	to   string
+	kind string
+}
+
+// graph holds the nodes and edges of a program.
+type graph struct {
+
+	// program is the program we're drawing.
+	program *ast.Program
+
+	// ids holds the node-ID of each statement.
+	ids map[ast.Statement]string
+
+	// variables holds the node-ID of each variable, by name.
+	variables map[string]string
+
+	// files holds the node-ID of each local file, by path.
+	files map[string]string
+
+	// edges holds the edges between nodes.
+	edges []edge
+}
+
+// build creates the graph of the given program.
+func build(program *ast.Program) *graph {
+	g := &graph{program: program}
+	g.ids = make(map[ast.Statement]string)
+	g.variables = make(map[string]string)
+	g.files = make(map[string]string)
+
+	//
+	// Find all the statements, in order.  "Become" blocks are
+	// drawn around their contents, rather than as nodes.
+	//
+	var statements []ast.Statement
+	ast.Walk(program.Statements, func(s ast.Statement) {
+		if _, ok := s.(*ast.BecomeStatement); ok {
+			return
+		}
+		g.ids[s] = fmt.Sprintf("s%d", len(statements)+1)
+		statements = append(statements, s)
+	})
+
+	//
+	// Find the variables, so we can number them.
+	//
+	var names []string
+	add := func(name string) {
+		if _, ok := g.variables[name]; !ok {
+			g.variables[name] = ""
+			names = append(names, name)
+		}
+	}
+	for _, s := range statements {
+		if name, ok := lint.SetsVariable(s); ok {
+			add(name)
+		}
+		for _, name := range usedVariables(s) {
+			add(name)
+		}
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		g.variables[name] = fmt.Sprintf("v%d", i+1)
+	}
+
+	//
+	// Find the local files read by copies and scripts.
+	//
+	var paths []string
+	for _, s := range statements {
+		if src, ok := lint.LocalSource(s); ok {
+			if _, ok := g.files[src]; !ok {
+				g.files[src] = ""
+				paths = append(paths, src)
+			}
+		}
+	}
+	sort.Strings(paths)
+	for i, src := range paths {
+		g.files[src] = fmt.Sprintf("f%d", i+1)
+	}
+
+	//
+	// Now the edges.
+	//
+	var copied ast.Statement
+	for i, s := range statements {
+		if i > 0 {
+			g.edges = append(g.edges, edge{g.ids[statements[i-1]], g.ids[s], next})
+		}
+
+		if lint.RecordsChange(s) {
+			copied = s
+		}
+		if _, ok := s.(*ast.IfChangedStatement); ok && copied != nil {
+			g.edges = append(g.edges, edge{g.ids[copied], g.ids[s], changed})
+		}
+
+		if name, ok := lint.SetsVariable(s); ok {
+			g.edges = append(g.edges, edge{g.ids[s], g.variables[name], sets})
+		}
+		for _, name := range usedVariables(s) {
+			g.edges = append(g.edges, edge{g.variables[name], g.ids[s], uses})
+		}
+		if src, ok := lint.LocalSource(s); ok {
+			g.edges = append(g.edges, edge{g.files[src], g.ids[s], reads})
+		}
+	}
+
+	return g
+}
+
+// names returns the names of the variables, sorted.
+func (g *graph) names() []string {
+	return sortedKeys(g.variables)
+}
+
+// paths returns the paths of the local files, sorted.
+func (g *graph) paths() []string {
+	return sortedKeys(g.files)
+}
+
+// sortedKeys returns the keys of the given map, sorted.
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// usedVariables returns the names of the variables used by the statement,
+// without duplicates.
+func usedVariables(s ast.Statement) []string {
+	var names []string
+	seen := make(map[string]bool)
+
+	add := func(name string) {
+		if !seen[name] && !strings.HasPrefix(name, "env:") {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, arg := range lint.ExpandedArguments(s) {
+		for _, ref := range lint.References(arg) {
+			name, _, _ := ast.SplitReference(ref)
+			add(name)
+		}
+	}
+	if pattern, ok := lint.TemplateSource(s); ok {
+		for _, name := range lint.TemplateUses(pattern) {
+			add(name)
+		}
+	}
+	return names
+}
+
+// label returns the label of a statement, upon a single line.
+func label(s ast.Statement) string {
+	text := strings.Join(strings.Fields(s.String()), " ")
+
+	runes := []rune(text)
+	if len(runes) > maxLabel {
+		text = string(runes[:maxLabel-3]) + "..."
+	}
+
+	if s.Pos().IsValid() {
+		text = fmt.Sprintf("%d: %s", s.Pos().Line, text)
+	}
+	return text
+}
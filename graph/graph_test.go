@@ -0,0 +1,113 @@
+package graph
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/skx/deployr/ast"
+	"github.com/skx/deployr/lexer"
+	"github.com/skx/deployr/parser"
+)
+
+// recipe is the program we draw in our tests.
+const recipe = `Set RELEASE "1.2"
+CopyFile app /srv/app-${RELEASE}
+IfChanged "systemctl restart app"
+Become root
+    Run "echo \"${RELEASE}\" ${env:HOME}"
+End
+`
+
+// parse is a helper which parses the given recipe.
+func parse(t *testing.T, input string) *ast.Program {
+	program, err := parser.New(lexer.New(input)).Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse program: %s", err.Error())
+	}
+	return program
+}
+
+// expectLines is a helper which ensures the given output contains each
+// of the given lines.
+func expectLines(t *testing.T, out string, lines ...string) {
+	for _, line := range lines {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Missing '%s' in output:\n%s", line, out)
+		}
+	}
+}
+
+// TestDOT tests drawing a recipe for Graphviz.
+func TestDOT(t *testing.T) {
+
+	out := DOT(parse(t, recipe))
+
+	expectLines(t, out,
+		"digraph recipe {",
+		`  s1 [label="1: Set RELEASE \"1.2\""];`,
+		"  subgraph cluster_1 {",
+		`    label="4: Become root";`,
+		`    s4 [label="5: Run \"echo \\\"${RELEASE}\\\" ${env:HOME}\""];`,
+		`  v1 [label="RELEASE", shape=ellipse];`,
+		"  s1 -> s2;",
+		"  s3 -> s4;",
+		`  s2 -> s3 [label="if changed", style=bold];`,
+		`  s1 -> v1 [label="sets", style=dashed];`,
+		`  v1 -> s2 [label="uses", style=dashed];`,
+		`  v1 -> s4 [label="uses", style=dashed];`,
+		`  f1 [label="app", shape=note];`,
+		`  f1 -> s2 [label="read by", style=dashed];`)
+
+	if strings.Contains(out, "env:HOME\"]") || strings.Contains(out, "v2") {
+		t.Errorf("Environmental variables should not be drawn:\n%s", out)
+	}
+}
+
+// TestMermaid tests drawing a recipe for Mermaid.
+func TestMermaid(t *testing.T) {
+
+	out := Mermaid(parse(t, recipe))
+
+	expectLines(t, out,
+		"flowchart TD",
+		`  s1["1: Set RELEASE #quot;1.2#quot;"]`,
+		`  subgraph b1 ["4: Become root"]`,
+		"  end",
+		`  v1(["RELEASE"])`,
+		"  s1 --> s2",
+		"  s2 ==>|if changed| s3",
+		"  s1 -.->|sets| v1",
+		"  v1 -.->|uses| s4",
+		`  f1[/"app"/]`,
+		"  f1 -.->|read by| s2")
+}
+
+// TestFiles tests that local files are drawn once, with edges to each
+// statement which reads them.
+func TestFiles(t *testing.T) {
+
+	out := DOT(parse(t, `CopyTemplate templates/ /etc/app/
+RunScript setup.sh
+Sudo CopyFile setup.sh /usr/local/bin/setup.sh
+`))
+
+	expectLines(t, out,
+		`  f1 [label="setup.sh", shape=note];`,
+		`  f2 [label="templates/", shape=note];`,
+		`  f2 -> s1 [label="read by", style=dashed];`,
+		`  f1 -> s2 [label="read by", style=dashed];`,
+		`  f1 -> s3 [label="read by", style=dashed];`)
+
+	if strings.Contains(out, "f3") {
+		t.Errorf("Files should be drawn once:\n%s", out)
+	}
+}
+
+// TestLabels tests that long labels are truncated.
+func TestLabels(t *testing.T) {
+
+	out := DOT(parse(t, `Run "`+strings.Repeat("x", 100)+`"`))
+	if !strings.Contains(out, `s1 [label="1: Run \"xxxx`) || !strings.Contains(out, `x..."];`) {
+		t.Fatalf("Label was not truncated:\n%s", out)
+	}
+}
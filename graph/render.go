@@ -0,0 +1,111 @@
+package graph
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skx/deployr/ast"
+)
+
+// DOT returns the graph of the given program, for Graphviz.
+func DOT(program *ast.Program) string {
+	g := build(program)
+
+	var out strings.Builder
+	out.WriteString("digraph recipe {\n")
+	out.WriteString("  node [shape=box];\n")
+
+	blocks := 0
+	var statements func(list []ast.Statement, indent string)
+	statements = func(list []ast.Statement, indent string) {
+		for _, s := range list {
+			if b, ok := s.(*ast.BecomeStatement); ok {
+				blocks++
+				fmt.Fprintf(&out, "%ssubgraph cluster_%d {\n", indent, blocks)
+				fmt.Fprintf(&out, "%s  label=%s;\n", indent, dotQuote(label(b)))
+				statements(b.Body, indent+"  ")
+				fmt.Fprintf(&out, "%s}\n", indent)
+				continue
+			}
+			fmt.Fprintf(&out, "%s%s [label=%s];\n", indent, g.ids[s], dotQuote(label(s)))
+		}
+	}
+	statements(program.Statements, "  ")
+
+	for _, name := range g.names() {
+		fmt.Fprintf(&out, "  %s [label=%s, shape=ellipse];\n", g.variables[name], dotQuote(name))
+	}
+	for _, src := range g.paths() {
+		fmt.Fprintf(&out, "  %s [label=%s, shape=note];\n", g.files[src], dotQuote(src))
+	}
+
+	for _, e := range g.edges {
+		switch e.kind {
+		case next:
+			fmt.Fprintf(&out, "  %s -> %s;\n", e.from, e.to)
+		case changed:
+			fmt.Fprintf(&out, "  %s -> %s [label=\"if changed\", style=bold];\n", e.from, e.to)
+		default:
+			fmt.Fprintf(&out, "  %s -> %s [label=\"%s\", style=dashed];\n", e.from, e.to, e.kind)
+		}
+	}
+
+	out.WriteString("}\n")
+	return out.String()
+}
+
+// Mermaid returns the graph of the given program, as a Mermaid flowchart.
+func Mermaid(program *ast.Program) string {
+	g := build(program)
+
+	var out strings.Builder
+	out.WriteString("flowchart TD\n")
+
+	blocks := 0
+	var statements func(list []ast.Statement, indent string)
+	statements = func(list []ast.Statement, indent string) {
+		for _, s := range list {
+			if b, ok := s.(*ast.BecomeStatement); ok {
+				blocks++
+				fmt.Fprintf(&out, "%ssubgraph b%d [%s]\n", indent, blocks, mermaidQuote(label(b)))
+				statements(b.Body, indent+"  ")
+				fmt.Fprintf(&out, "%send\n", indent)
+				continue
+			}
+			fmt.Fprintf(&out, "%s%s[%s]\n", indent, g.ids[s], mermaidQuote(label(s)))
+		}
+	}
+	statements(program.Statements, "  ")
+
+	for _, name := range g.names() {
+		fmt.Fprintf(&out, "  %s([%s])\n", g.variables[name], mermaidQuote(name))
+	}
+	for _, src := range g.paths() {
+		fmt.Fprintf(&out, "  %s[/%s/]\n", g.files[src], mermaidQuote(src))
+	}
+
+	for _, e := range g.edges {
+		switch e.kind {
+		case next:
+			fmt.Fprintf(&out, "  %s --> %s\n", e.from, e.to)
+		case changed:
+			fmt.Fprintf(&out, "  %s ==>|if changed| %s\n", e.from, e.to)
+		default:
+			fmt.Fprintf(&out, "  %s -.->|%s| %s\n", e.from, e.kind, e.to)
+		}
+	}
+
+	return out.String()
+}
+
+// dotQuote returns the given text as a quoted DOT string.
+func dotQuote(text string) string {
+	text = strings.Replace(text, "\\", "\\\\", -1)
+	text = strings.Replace(text, "\"", "\\\"", -1)
+	return "\"" + text + "\""
+}
+
+// mermaidQuote returns the given text as a quoted Mermaid label.
+func mermaidQuote(text string) string {
+	return "\"" + strings.Replace(text, "\"", "#quot;", -1) + "\""
+}
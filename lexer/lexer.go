@@ -5,6 +5,7 @@ package lexer
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/skx/deployr/token"
 )
@@ -15,15 +16,29 @@ type Lexer struct {
 	readPosition int    //next character position
 	ch           rune   //current character
 	characters   []rune //rune slice of input string
+	line         int    //line of the current character
+	column       int    //column of the current character
+	comments     bool   //should comments be returned as tokens?
 }
 
 // New a Lexer instance from string input.
 func New(input string) *Lexer {
-	l := &Lexer{characters: []rune(input)}
+	l := &Lexer{characters: []rune(input), line: 1}
 	l.readChar()
 	return l
 }
 
+// NewWithComments creates a Lexer instance from string input, which
+// returns comments as COMMENT tokens rather than skipping them.
+//
+// This is useful for tools which need to reproduce the input, such as
+// our formatter.
+func NewWithComments(input string) *Lexer {
+	l := New(input)
+	l.comments = true
+	return l
+}
+
 // Dump outputs the complete stream of tokens from the lexer,
 // consuming all input as it does so.
 func (l *Lexer) Dump() {
@@ -38,6 +53,12 @@ func (l *Lexer) Dump() {
 
 // read one forward character
 func (l *Lexer) readChar() {
+	if l.ch == rune('\n') {
+		l.line++
+		l.column = 0
+	}
+	l.column++
+
 	if l.readPosition >= len(l.characters) {
 		l.ch = rune(0)
 	} else {
@@ -53,19 +74,47 @@ func (l *Lexer) NextToken() token.Token {
 	var tok token.Token
 	l.skipWhitespace()
 
+	//
+	// Record where this token starts.
+	//
+	start := l.position
+	tok.Line = l.line
+	tok.Column = l.column
+
 	// skip shebang
 	if l.ch == rune('#') && l.peekChar() == rune('!') && l.position == 0 {
+		if l.comments {
+			return l.readComment(tok)
+		}
 		l.skipComment()
 		return (l.NextToken())
 	}
 
 	// skip single-line comments
 	if l.ch == rune('#') {
+		if l.comments {
+			return l.readComment(tok)
+		}
 		l.skipComment()
 		return (l.NextToken())
 	}
 
+	// heredocs
+	if l.ch == rune('<') && l.peekChar() == rune('<') {
+		return l.readHeredoc(tok)
+	}
+
 	switch l.ch {
+	case rune('`'):
+		str, err := l.readRawString()
+
+		if err == nil {
+			tok.Type = token.STRING
+			tok.Literal = str
+		} else {
+			tok.Type = token.ILLEGAL
+			tok.Literal = err.Error()
+		}
 	case rune('"'):
 		str, err := l.readString()
 
@@ -82,16 +131,52 @@ func (l *Lexer) NextToken() token.Token {
 	default:
 		tok.Literal = l.readIdentifier()
 		tok.Type = token.LookupIdentifier(tok.Literal)
+		tok.Raw = tok.Literal
 		return tok
 	}
 	l.readChar()
+	tok.Raw = l.source(start)
+	return tok
+}
+
+// source returns the input from the given position up to, but not
+// including, the current character.
+func (l *Lexer) source(start int) string {
+	end := l.position
+	if end > len(l.characters) {
+		end = len(l.characters)
+	}
+	if start > end {
+		return ""
+	}
+	return string(l.characters[start:end])
+}
+
+// readComment reads a comment, until the end of the line, returning it
+// as a COMMENT token.
+func (l *Lexer) readComment(tok token.Token) token.Token {
+	start := l.position
+	for l.ch != '\n' && l.ch != rune(0) {
+		l.readChar()
+	}
+
+	tok.Type = token.COMMENT
+	tok.Literal = strings.TrimRight(l.source(start), " \t\r")
+	tok.Raw = tok.Literal
 	return tok
 }
 
 // read Identifier
+//
+// An identifier which ends with "=" may be followed directly by a string,
+// as in name="value", so we stop there and leave the string to be read
+// as a token of its own.
 func (l *Lexer) readIdentifier() string {
 	position := l.position
 	for isIdentifier(l.ch) {
+		if l.position > position && l.characters[l.position-1] == '=' && isStringStart(l.ch, l.peekChar()) {
+			break
+		}
 		l.readChar()
 	}
 	return string(l.characters[position:l.position])
@@ -162,6 +247,85 @@ func (l *Lexer) readString() (string, error) {
 	return out, nil
 }
 
+// read a raw string, enclosed in backticks, in which there is no
+// escape-processing at all.
+func (l *Lexer) readRawString() (string, error) {
+	start := l.position + 1
+
+	for {
+		l.readChar()
+		if l.ch == '`' {
+			break
+		}
+		if l.ch == rune(0) {
+			return "", errors.New("unterminated raw string")
+		}
+	}
+
+	return string(l.characters[start:l.position]), nil
+}
+
+// readHeredoc reads a heredoc, returning it as a STRING token.
+//
+// A heredoc starts with "<<" and a delimiter, such as "<<EOF", at the
+// end of a line.  The lines which follow are the value of the string,
+// without any escape-processing, up to a line holding only the
+// delimiter.  The delimiter may be indented, and may be quoted as it
+// would be in a shell-script.
+func (l *Lexer) readHeredoc(tok token.Token) token.Token {
+	start := l.position
+
+	illegal := func(msg string) token.Token {
+		tok.Type = token.ILLEGAL
+		tok.Literal = msg
+		tok.Raw = l.source(start)
+		return tok
+	}
+
+	//
+	// Skip the "<<", and read the delimiter.
+	//
+	l.readChar()
+	l.readChar()
+	delimiter := strings.Trim(l.readIdentifier(), `'"`)
+	if delimiter == "" {
+		return illegal("missing heredoc delimiter")
+	}
+
+	for l.ch == rune(' ') || l.ch == rune('\t') || l.ch == rune('\r') {
+		l.readChar()
+	}
+	if l.ch != rune('\n') {
+		return illegal("unexpected text after heredoc delimiter '" + delimiter + "'")
+	}
+
+	//
+	// Now read each line, until we find the delimiter.
+	//
+	var body strings.Builder
+	for {
+		l.readChar()
+		position := l.position
+		for l.ch != rune('\n') && l.ch != rune(0) {
+			l.readChar()
+		}
+
+		line := l.source(position)
+		if strings.TrimSpace(line) == delimiter {
+			break
+		}
+		if l.ch == rune(0) {
+			return illegal("unterminated heredoc - missing '" + delimiter + "'")
+		}
+		body.WriteString(line + "\n")
+	}
+
+	tok.Type = token.STRING
+	tok.Literal = body.String()
+	tok.Raw = l.source(start)
+	return tok
+}
+
 // peek character
 func (l *Lexer) peekChar() rune {
 	if l.readPosition >= len(l.characters) {
@@ -175,6 +339,12 @@ func isIdentifier(ch rune) bool {
 	return !isWhitespace(ch) && !isEmpty(ch)
 }
 
+// determinate whether the given character, and the one following it,
+// start a string
+func isStringStart(ch rune, next rune) bool {
+	return ch == rune('"') || ch == rune('`') || (ch == rune('<') && next == rune('<'))
+}
+
 // is white space
 func isWhitespace(ch rune) bool {
 	return ch == rune(' ') || ch == rune('\t') || ch == rune('\n') || ch == rune('\r')
@@ -184,6 +184,135 @@ which continues"
 	}
 }
 
+// TestRawString checks that backtick strings have no escape-processing.
+func TestRawString(t *testing.T) {
+	input := "Run `echo \"${HOME}\" \\n\nls`\nRun \"id\""
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.RUN, "Run"},
+		{token.STRING, "echo \"${HOME}\" \\n\nls"},
+		{token.RUN, "Run"},
+		{token.STRING, "id"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if i == 3 && tok.Line != 3 {
+			t.Fatalf("tests[%d] - Line wrong, expected=3, got=%d", i, tok.Line)
+		}
+	}
+}
+
+// TestHeredoc checks that heredocs are read verbatim.
+func TestHeredoc(t *testing.T) {
+	input := `Run <<EOF
+if [ -e "/tmp/x" ]; then \
+    echo "\t"
+fi
+EOF
+Become root
+    Run <<'END'
+id
+    END
+End
+`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.RUN, "Run"},
+		{token.STRING, "if [ -e \"/tmp/x\" ]; then \\\n    echo \"\\t\"\nfi\n"},
+		{token.BECOME, "Become"},
+		{token.IDENT, "root"},
+		{token.RUN, "Run"},
+		{token.STRING, "id\n"},
+		{token.END, "End"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if i == 5 && tok.Raw != "<<'END'\nid\n    END" {
+			t.Fatalf("tests[%d] - Raw wrong, got=%q", i, tok.Raw)
+		}
+		if i == 6 && tok.Line != 10 {
+			t.Fatalf("tests[%d] - Line wrong, expected=10, got=%d", i, tok.Line)
+		}
+	}
+}
+
+// TestBrokenHeredoc checks that invalid heredocs and raw strings are
+// errors.
+func TestBrokenHeredoc(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"Run <<EOF\necho", "unterminated heredoc - missing 'EOF'"},
+		{"Run << EOF\necho\nEOF", "missing heredoc delimiter"},
+		{"Run <<EOF echo\nEOF", "unexpected text after heredoc delimiter 'EOF'"},
+		{"Run `echo", "unterminated raw string"},
+	}
+
+	for _, test := range tests {
+		l := New(test.input)
+		l.NextToken()
+		tok := l.NextToken()
+		if tok.Type != token.ILLEGAL || tok.Literal != test.expected {
+			t.Errorf("Lexing '%s' - expected error '%s', got %v", test.input, test.expected, tok)
+		}
+	}
+}
+
+// TestOptions checks that option values may be quoted.
+func TestOptions(t *testing.T) {
+	input := "a=b c=\"d e\" f=`g` h=<<EOF\ni\nEOF\nj=k=\"l\" m\"n"
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a=b"},
+		{token.IDENT, "c="},
+		{token.STRING, "d e"},
+		{token.IDENT, "f="},
+		{token.STRING, "g"},
+		{token.IDENT, "h="},
+		{token.STRING, "i\n"},
+		{token.IDENT, "j=k="},
+		{token.STRING, "l"},
+		{token.IDENT, "m\"n"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
 // TestDump just calls dump on some tokens.
 func TestDump(t *testing.T) {
 	input := `#!/usr/bin/env deployr
@@ -200,3 +329,70 @@ func TestDump(t *testing.T) {
 		t.Fatalf("We still have input, after dumping our stream")
 	}
 }
+
+// TestPositions tests that tokens record their line, column and source.
+func TestPositions(t *testing.T) {
+	input := `Run "one \
+  two"
+  Set x "\"y\""`
+
+	tests := []struct {
+		expectedType token.Type
+		line         int
+		column       int
+		raw          string
+	}{
+		{token.RUN, 1, 1, "Run"},
+		{token.STRING, 1, 5, "\"one \\\n  two\""},
+		{token.SET, 3, 3, "Set"},
+		{token.IDENT, 3, 7, "x"},
+		{token.STRING, 3, 9, `"\"y\""`},
+		{token.EOF, 3, 16, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Line != tt.line || tok.Column != tt.column {
+			t.Fatalf("tests[%d] - position wrong, expected=%d:%d, got=%d:%d", i, tt.line, tt.column, tok.Line, tok.Column)
+		}
+		if tok.Raw != tt.raw {
+			t.Fatalf("tests[%d] - raw wrong, expected=%q, got=%q", i, tt.raw, tok.Raw)
+		}
+	}
+}
+
+// TestCommentTokens tests that comments may be returned as tokens.
+func TestCommentTokens(t *testing.T) {
+	input := `#!/usr/bin/env deployr
+# This is a comment   
+Run "Steve" # trailing`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+		line            int
+	}{
+		{token.COMMENT, "#!/usr/bin/env deployr", 1},
+		{token.COMMENT, "# This is a comment", 2},
+		{token.RUN, "Run", 3},
+		{token.STRING, "Steve", 3},
+		{token.COMMENT, "# trailing", 3},
+		{token.EOF, "", 3},
+	}
+	l := NewWithComments(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Line != tt.line {
+			t.Fatalf("tests[%d] - line wrong, expected=%d, got=%d", i, tt.line, tok.Line)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+// Package lint performs static analysis of a parsed recipe.
+//
+// Unlike the parser, which only reports syntax errors, the linter looks
+// for recipes which are valid but which probably don't do what their
+// author intended - such as using a variable which is never set.
+package lint
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/skx/deployr/ast"
+	"github.com/skx/deployr/token"
+)
+
+// Warning holds a single problem found in a recipe.
+type Warning struct {
+	// Pos is the position of the statement the problem was found
+	// in, which is invalid if it relates to no statement.
+	Pos ast.Position
+
+	// Message describes the problem.
+	Message string
+}
+
+// String converts a warning to a human-readable form.
+func (w Warning) String() string {
+	if !w.Pos.IsValid() {
+		return w.Message
+	}
+	return fmt.Sprintf("%s: %s", w.Pos, w.Message)
+}
+
+// Linter holds our state.
+type Linter struct {
+
+	// Program is the parsed program we're examining.
+	Program *ast.Program
+
+	// Known holds the names of variables which are set outside the
+	// recipe, for example via the command-line.
+	Known map[string]bool
+
+	// Dir is the directory against which relative local paths are
+	// resolved, the current directory if empty.
+	Dir string
+
+	// statements holds all the statements of the program, including
+	// those within blocks, in order.
+	statements []ast.Statement
+
+	// warnings holds the problems we've found.
+	warnings []Warning
+}
+
+// predefined holds the names of the variables which are always set.
+var predefined = []string{"host", "port", "user"}
+
+// referenceRE matches references to variables, "${name}".
+var referenceRE = regexp.MustCompile(`\$\{([^\}]+)\}`)
+
+// templateRE matches uses of variables within templates, {{get "name"}}.
+var templateRE = regexp.MustCompile(`get\s+"([^"]+)"`)
+
+// actionRE matches the actions within templates, "{{ ... }}".
+var actionRE = regexp.MustCompile(`(?s)\{\{(.*?)\}\}`)
+
+// fieldRE matches field references within template actions, such as
+// ".name", since templates are executed with our variables as dot.
+var fieldRE = regexp.MustCompile(`(?:^|[\s(|])\.([A-Za-z_][A-Za-z0-9_]*)`)
+
+// New creates a new linter for the given program.
+func New(program *ast.Program) *Linter {
+	l := &Linter{Program: program}
+	l.Known = make(map[string]bool)
+	return l
+}
+
+// AddKnown records that the named variable is set outside the recipe.
+func (l *Linter) AddKnown(name string) {
+	l.Known[name] = true
+}
+
+// Lint examines the program, and returns all the problems found.
+func (l *Linter) Lint() []Warning {
+	l.warnings = nil
+
+	l.statements = nil
+	ast.Walk(l.Program.Statements, func(s ast.Statement) {
+		l.statements = append(l.statements, s)
+	})
+
+	l.checkIfChanged()
+	l.checkVariables()
+	l.checkSources()
+	l.checkDestinations()
+
+	return l.warnings
+}
+
+// local returns the given local path, resolved against our directory,
+// keeping any trailing "/" which marks a directory.
+func (l *Linter) local(p string) string {
+	if l.Dir == "" || filepath.IsAbs(p) {
+		return p
+	}
+	resolved := filepath.Join(l.Dir, p)
+	if strings.HasSuffix(p, "/") {
+		resolved += "/"
+	}
+	return resolved
+}
+
+// warn records a problem with the given statement.
+func (l *Linter) warn(s ast.Statement, format string, a ...interface{}) {
+	l.warnings = append(l.warnings, Warning{Pos: s.Pos(), Message: fmt.Sprintf(format, a...)})
+}
+
+// checkIfChanged warns about IfChanged statements which have no
+// preceding statement that records a change, and so can never run.
+func (l *Linter) checkIfChanged() {
+	changes := false
+
+	for _, s := range l.statements {
+		if RecordsChange(s) {
+			changes = true
+		}
+		if _, ok := s.(*ast.IfChangedStatement); ok && !changes {
+			l.warn(s, "IfChanged has no preceding statement which records a change, so will never run")
+		}
+	}
+}
+
+// checkVariables warns about variables which are used but never set,
+// and about variables which are set but never used.
+func (l *Linter) checkVariables() {
+
+	set := make(map[string]ast.Statement)
+	used := make(map[string]bool)
+
+	//
+	// Secrets files might set any variable, so if we load one we
+	// can't tell whether a variable is missing.
+	//
+	secrets := false
+
+	for _, s := range l.statements {
+		if name, ok := SetsVariable(s); ok {
+			if _, ok := set[name]; !ok {
+				set[name] = s
+			}
+		}
+
+		switch s := s.(type) {
+		case *ast.EnvStatement:
+			used[s.Name.Literal] = true
+		case *ast.LoadSecretsStatement:
+			secrets = true
+		}
+
+		//
+		// Variables might be used within a template.
+		//
+		if pattern, ok := TemplateSource(s); ok {
+			for _, name := range TemplateUses(l.local(pattern)) {
+				used[name] = true
+			}
+		}
+	}
+
+	for _, s := range l.statements {
+		for _, arg := range ExpandedArguments(s) {
+			for _, ref := range References(arg) {
+
+				name, modifier, _ := ast.SplitReference(ref)
+				used[name] = true
+
+				//
+				// Environmental variables are outside our
+				// control, and references with a default,
+				// or an explicit error, are deliberate.
+				//
+				if strings.HasPrefix(name, "env:") || modifier == ":-" || modifier == ":?" {
+					continue
+				}
+
+				if _, ok := set[name]; ok || l.Known[name] || secrets || isPredefined(name) {
+					continue
+				}
+				l.warn(s, "variable '%s' is used but never set", name)
+			}
+		}
+	}
+
+	for _, s := range l.statements {
+		name, ok := SetsVariable(s)
+		if !ok {
+			continue
+		}
+		if set[name] == s && !used[name] {
+			l.warn(s, "variable '%s' is set but never used", name)
+		}
+	}
+}
+
+// checkSources warns about copies, and scripts, whose local source
+// doesn't exist.
+func (l *Linter) checkSources() {
+	for _, s := range l.statements {
+		src, ok := LocalSource(s)
+		if !ok {
+			continue
+		}
+
+		//
+		// We can't know the value of variables.
+		//
+		if len(References(src)) > 0 {
+			continue
+		}
+
+		pattern := l.local(src)
+		if strings.HasSuffix(pattern, "/") {
+			pattern += "*"
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil || len(files) < 1 {
+			l.warn(s, "%s source '%s' does not exist", s.Keyword().Literal, src)
+		}
+	}
+}
+
+// checkDestinations warns about multiple copies, writes, or downloads,
+// to the same destination.
+func (l *Linter) checkDestinations() {
+	seen := make(map[string]ast.Statement)
+
+	for _, s := range l.statements {
+		dst, ok := destination(s)
+		if !ok {
+			continue
+		}
+
+		//
+		// Copying a glob to a directory is fine.
+		//
+		if strings.HasSuffix(dst, "/") {
+			continue
+		}
+
+		if prev, ok := seen[dst]; ok {
+			l.warn(s, "destination '%s' was already written at line %d", dst, prev.Pos().Line)
+			continue
+		}
+		seen[dst] = s
+	}
+}
+
+// References returns the contents of all the "${...}" references within
+// the given string.
+func References(in string) []string {
+	var refs []string
+	for _, m := range referenceRE.FindAllStringSubmatch(in, -1) {
+		refs = append(refs, m[1])
+	}
+	return refs
+}
+
+// copyPaths returns the source and destination of the given statement,
+// if it is a copy.
+func copyPaths(s ast.Statement) (string, string, bool) {
+	switch s := s.(type) {
+	case *ast.CopyFileStatement:
+		return s.Source.Literal, s.Destination.Literal, true
+	case *ast.CopyTemplateStatement:
+		return s.Source.Literal, s.Destination.Literal, true
+	}
+	return "", "", false
+}
+
+// LocalSource returns the local path, or glob, read by the given
+// statement, if it reads one.
+func LocalSource(s ast.Statement) (string, bool) {
+	if src, _, ok := copyPaths(s); ok {
+		return src, true
+	}
+	if r, ok := s.(*ast.RunScriptStatement); ok {
+		return r.Script.Literal, true
+	}
+	return "", false
+}
+
+// SetsVariable returns the name of the variable set by the given
+// statement, if it sets one.
+func SetsVariable(s ast.Statement) (string, bool) {
+	switch s := s.(type) {
+	case *ast.EnvStatement:
+		return s.Name.Literal, true
+	case *ast.LocalStatement:
+		return ast.Option(s.Options, "set")
+	case *ast.SecretStatement:
+		return s.Name.Literal, true
+	case *ast.SetStatement:
+		return s.Name.Literal, true
+	}
+	return "", false
+}
+
+// TemplateSource returns the local path, or glob, of the templates
+// expanded by the given statement, if it expands any.
+func TemplateSource(s ast.Statement) (string, bool) {
+	switch s := s.(type) {
+	case *ast.CopyTemplateStatement:
+		return s.Source.Literal, true
+	case *ast.RunScriptStatement:
+		if val, ok := ast.Option(s.Options, "template"); ok {
+			if expand, err := strconv.ParseBool(val); err == nil && expand {
+				return s.Script.Literal, true
+			}
+		}
+	}
+	return "", false
+}
+
+// destination returns the remote path written by the given statement,
+// if it writes one.
+func destination(s ast.Statement) (string, bool) {
+	if _, dst, ok := copyPaths(s); ok {
+		return dst, true
+	}
+	switch s := s.(type) {
+	case *ast.DownloadStatement:
+		return s.Destination.Literal, true
+	case *ast.WriteFileStatement:
+		return s.Destination.Literal, true
+	}
+	return "", false
+}
+
+// RecordsChange returns true if the given statement records whether it
+// changed the remote host, which a following IfChanged depends upon.
+func RecordsChange(s ast.Statement) bool {
+	switch s.(type) {
+	case *ast.BlockInFileStatement, *ast.CopyFileStatement, *ast.CopyTemplateStatement:
+		return true
+	case *ast.DirectoryStatement, *ast.DownloadStatement, *ast.GroupStatement:
+		return true
+	case *ast.LineInFileStatement, *ast.PackageStatement, *ast.RemoveStatement:
+		return true
+	case *ast.ServiceStatement, *ast.SymlinkStatement, *ast.UserStatement:
+		return true
+	case *ast.WriteFileStatement:
+		return true
+	}
+	return false
+}
+
+// ExpandedArguments returns those arguments of the given statement which
+// will have variables expanded when executed.
+func ExpandedArguments(s ast.Statement) []string {
+	switch s := s.(type) {
+	case *ast.BlockInFileStatement:
+		return append([]string{s.Path.Literal}, optionValues(s.Options)...)
+	case *ast.CopyFileStatement:
+		return []string{s.Source.Literal, s.Destination.Literal}
+	case *ast.CopyTemplateStatement:
+		return []string{s.Source.Literal, s.Destination.Literal}
+	case *ast.DeployToStatement:
+		return []string{s.Target.Literal}
+	case *ast.DirectoryStatement:
+		return append([]string{s.Path.Literal}, optionValues(s.Options)...)
+	case *ast.DownloadStatement:
+		return append([]string{s.URL.Literal, s.Destination.Literal}, optionValues(s.Options)...)
+	case *ast.FetchStatement:
+		return []string{s.Source.Literal, s.Destination.Literal}
+	case *ast.GroupStatement:
+		return append([]string{s.Name.Literal}, optionValues(s.Options)...)
+	case *ast.IfChangedStatement:
+		return []string{s.Command.Literal}
+	case *ast.LineInFileStatement:
+		return append([]string{s.Path.Literal}, optionValues(s.Options)...)
+	case *ast.LoadSecretsStatement:
+		return []string{s.Path.Literal}
+	case *ast.LocalStatement:
+		return []string{s.Command.Literal}
+	case *ast.PackageStatement:
+		var args []string
+		for _, name := range s.Names {
+			args = append(args, name.Literal)
+		}
+		if state, ok := ast.Option(s.Options, "state"); ok {
+			args = append(args, state)
+		}
+		return args
+	case *ast.RemoveStatement:
+		return []string{s.Path.Literal}
+	case *ast.RunStatement:
+		return []string{s.Command.Literal}
+	case *ast.RunScriptStatement:
+		args := []string{s.Script.Literal}
+		for _, arg := range s.Args {
+			args = append(args, arg.Literal)
+		}
+		if interpreter, ok := ast.Option(s.Options, "interpreter"); ok {
+			args = append(args, interpreter)
+		}
+		return args
+	case *ast.ServiceStatement:
+		return append([]string{s.Name.Literal}, optionValues(s.Options)...)
+	case *ast.SetStatement:
+		return []string{s.Value.Literal}
+	case *ast.SecretStatement:
+		return []string{s.Value.Literal}
+	case *ast.SymlinkStatement:
+		return []string{s.Target.Literal, s.Link.Literal}
+	case *ast.UserStatement:
+		return append([]string{s.Name.Literal}, optionValues(s.Options)...)
+	case *ast.WriteFileStatement:
+		return []string{s.Destination.Literal, s.Content.Literal}
+	}
+	return nil
+}
+
+// optionValues returns the values of the given options.
+func optionValues(options []token.Token) []string {
+	var values []string
+	for _, opt := range options {
+		_, value := ast.SplitOption(opt)
+		values = append(values, value)
+	}
+	return values
+}
+
+// TemplateUses returns the names of variables used within the templates
+// matching the given pattern, via {{get "name"}} or {{.name}}.
+func TemplateUses(pattern string) []string {
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "*"
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, action := range actionRE.FindAllStringSubmatch(string(data), -1) {
+			for _, m := range templateRE.FindAllStringSubmatch(action[1], -1) {
+				names = append(names, m[1])
+			}
+			for _, m := range fieldRE.FindAllStringSubmatch(action[1], -1) {
+				names = append(names, m[1])
+			}
+		}
+	}
+	return names
+}
+
+// isPredefined returns true if the named variable is always set.
+func isPredefined(name string) bool {
+	for _, p := range predefined {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
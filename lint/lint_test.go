@@ -0,0 +1,236 @@
+package lint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skx/deployr/lexer"
+	"github.com/skx/deployr/parser"
+)
+
+// lintProgram is a helper which parses and lints the given recipe.
+func lintProgram(t *testing.T, input string, known ...string) []Warning {
+
+	p := parser.New(lexer.New(input))
+	program, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse program: %s", err.Error())
+	}
+
+	l := New(program)
+	for _, k := range known {
+		l.AddKnown(k)
+	}
+	return l.Lint()
+}
+
+// expectWarnings is a helper which ensures that the given warnings
+// contain the expected messages, in order.
+func expectWarnings(t *testing.T, warnings []Warning, expected ...string) {
+	if len(warnings) != len(expected) {
+		t.Fatalf("Expected %d warnings, got %d: %v", len(expected), len(warnings), warnings)
+	}
+	for i, msg := range expected {
+		if !strings.Contains(warnings[i].String(), msg) {
+			t.Fatalf("Warning %d was '%s', expected '%s'", i, warnings[i].String(), msg)
+		}
+	}
+}
+
+// TestClean tests that a good recipe has no warnings.
+func TestClean(t *testing.T) {
+
+	tmpfile, err := ioutil.TempFile("", "lint")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %s", err.Error())
+	}
+	defer os.Remove(tmpfile.Name())
+
+	input := `
+Set RELEASE "1.2"
+Env CI_TAG
+CopyFile ` + tmpfile.Name() + ` /tmp/${RELEASE}
+IfChanged "echo ${user}@${host}:${port} ${CI_TAG} ${env:HOME} ${MISSING:-default}"
+`
+	expectWarnings(t, lintProgram(t, input))
+}
+
+// TestIfChanged tests that IfChanged without a copy is reported.
+func TestIfChanged(t *testing.T) {
+	warnings := lintProgram(t, `IfChanged "/bin/true"`)
+	expectWarnings(t, warnings, "1:1: IfChanged has no preceding")
+}
+
+// TestVariables tests that unset and unused variables are reported.
+func TestVariables(t *testing.T) {
+
+	input := `
+Set UNUSED "1"
+Set USED "2"
+Run "echo ${USED} ${MISSING} ${KNOWN}"
+`
+	warnings := lintProgram(t, input, "KNOWN")
+	expectWarnings(t, warnings,
+		"4:1: variable 'MISSING' is used but never set",
+		"2:1: variable 'UNUSED' is set but never used")
+
+	//
+	// Loading secrets means any variable might be set.
+	//
+	input = `
+LoadSecrets "secrets.enc"
+Run "echo ${API_KEY}"
+`
+	expectWarnings(t, lintProgram(t, input))
+}
+
+// TestBlocks tests that statements within blocks are examined.
+func TestBlocks(t *testing.T) {
+
+	input := `
+Become root
+    Run "echo ${MISSING}"
+End
+`
+	expectWarnings(t, lintProgram(t, input),
+		"3:5: variable 'MISSING' is used but never set")
+}
+
+// TestTemplateUses tests that variables used only within a template are
+// not reported as unused.
+func TestTemplateUses(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	tmpl := filepath.Join(dir, "app.conf")
+	ioutil.WriteFile(tmpl, []byte(`release={{get "RELEASE"}}
+port={{.PORT}}
+{{if eq .MODE "debug"}}debug=true{{end}}
+`), 0644)
+
+	input := `
+Set RELEASE "1.2"
+Set PORT "8080"
+Set MODE "debug"
+Set UNUSED "yes"
+CopyTemplate ` + tmpl + ` /etc/app.conf
+`
+	expectWarnings(t, lintProgram(t, input),
+		"5:1: variable 'UNUSED'")
+
+	names := TemplateUses(tmpl)
+	if strings.Join(names, ",") != "RELEASE,PORT,MODE" {
+		t.Fatalf("Wrong template uses, got %v", names)
+	}
+}
+
+// TestSources tests that missing copy-sources are reported, as are
+// duplicate destinations.
+func TestSources(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "one"), []byte("one"), 0644)
+
+	input := `
+CopyFile ` + dir + `/one /etc/one
+CopyFile ` + dir + `/missing /etc/two
+CopyTemplate ` + dir + `/one /etc/one
+CopyFile ` + dir + `/ /etc/
+CopyFile ` + dir + `/ /etc/
+`
+	expectWarnings(t, lintProgram(t, input),
+		"3:1: CopyFile source",
+		"4:1: destination '/etc/one' was already written at line 2")
+}
+
+// TestDir tests that relative sources are resolved against the given
+// directory.
+func TestDir(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "conf"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "conf", "app.conf"), []byte(`port={{get "PORT"}}`), 0644)
+
+	p := parser.New(lexer.New(`
+Set PORT "8080"
+CopyTemplate conf/app.conf /etc/app.conf
+CopyFile conf/ /etc/app/
+CopyFile conf/missing /etc/missing
+`))
+	program, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse program: %s", err.Error())
+	}
+
+	l := New(program)
+	l.Dir = dir
+	expectWarnings(t, l.Lint(),
+		"5:1: CopyFile source 'conf/missing' does not exist")
+}
+
+// TestWriteFile tests that writes record changes, use variables, and
+// are included in the check for duplicate destinations.
+func TestWriteFile(t *testing.T) {
+
+	input := `
+WriteFile /etc/app/env <<EOF
+RELEASE=${RELEASE}
+EOF
+IfChanged "systemctl restart app"
+WriteFile "/etc/app/env" "empty"
+`
+	expectWarnings(t, lintProgram(t, input),
+		"2:1: variable 'RELEASE' is used but never set",
+		"6:1: destination '/etc/app/env' was already written at line 2")
+}
+
+// TestRunScript tests that scripts must exist, and that variables used
+// within scripts which are templates are found.
+func TestRunScript(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "setup.sh"), []byte(`echo {{get "RELEASE"}}`), 0755)
+
+	input := `
+Set RELEASE "1.2"
+RunScript ` + dir + `/setup.sh "${MODE}" template=true
+RunScript ` + dir + `/missing.sh
+`
+	expectWarnings(t, lintProgram(t, input),
+		"3:1: variable 'MODE' is used but never set",
+		"4:1: RunScript source")
+}
+
+// TestLocal tests that local commands may set variables.
+func TestLocal(t *testing.T) {
+
+	input := `
+Local "git describe" set=VERSION
+Local "date +%s" set=UNUSED
+Run "echo ${VERSION}"
+`
+	expectWarnings(t, lintProgram(t, input),
+		"3:1: variable 'UNUSED' is set but never used")
+}
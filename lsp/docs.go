@@ -0,0 +1,160 @@
+package lsp
+
+// primitive holds the documentation for a single primitive.
+type primitive struct {
+	// usage shows how the primitive is written.
+	usage string
+
+	// summary is a one-line description.
+	summary string
+
+	// details holds any further description, in markdown.
+	details string
+}
+
+// primitives holds the documentation for each of our keywords, which is
+// shown when hovering over them and when completing them.
+var primitives = map[string]primitive{
+	"Become": {
+		usage:   "Become user ... End",
+		summary: "Run the statements within the block as the given user.",
+		details: "Every statement within the block behaves as if it were prefixed with `Sudo -u user`.  `Become root` is equivalent to `Sudo`.  Blocks may be nested, and an explicit `Sudo` prefix takes precedence.",
+	},
+	"BecomeMethod": {
+		usage:   "BecomeMethod sudo|doas|su",
+		summary: "Specify how privileges are escalated for `Sudo` and `Become`.",
+		details: "The default is `sudo`, which may also be changed via the `-become-method` flag.",
+	},
+	"BlockInFile": {
+		usage:   "BlockInFile remote/path [marker=name] content=\"lines\"",
+		summary: "Ensure a remote file contains the given block of lines, between `# BEGIN` and `# END` marker lines.",
+		details: "If the markers are present the lines between them are replaced, otherwise the block is appended.  The file is only replaced if it changed, atomically, and a following `IfChanged` runs if it was.",
+	},
+	"CopyFile": {
+		usage:   "CopyFile local/path remote/path",
+		summary: "Copy a local file, or glob of files, to the remote host.",
+		details: "If the remote file was already identical no change is made, and a following `IfChanged` will not run.",
+	},
+	"CopyTemplate": {
+		usage:   "CopyTemplate local/path remote/path",
+		summary: "Expand a local template, or glob of templates, and copy the result to the remote host.",
+		details: "Variables are available within the template as `{{get \"name\"}}`.  If the remote file was already identical no change is made, and a following `IfChanged` will not run.",
+	},
+	"DeployTo": {
+		usage:   "DeployTo [user@]hostname[:port]",
+		summary: "Specify the host to connect to.",
+		details: "This may instead be given upon the command-line via the `-target` flag.",
+	},
+	"End": {
+		usage:   "End",
+		summary: "Close a `Become` block.",
+	},
+	"Directory": {
+		usage:   "Directory remote/path [mode=0755] [owner=user:group]",
+		summary: "Ensure the given directory exists upon the remote host, with the given mode and owner.",
+		details: "Missing parent directories are created too.  Only the changes required are made, and a following `IfChanged` runs if any were.  Within a `Become` block, or with a `Sudo` prefix, the directory is managed as the given user.  With `-nop` the changes are reported, but not made.",
+	},
+	"Download": {
+		usage:   "Download URL remote/path [sha256=checksum] [mode=0755]",
+		summary: "Download the given URL to a file upon the remote host, verifying its checksum.",
+		details: "The URL is fetched upon the remote host via `curl`, or `wget`, and the transfer is skipped if the file already matches the checksum.  The download is written beside the file then renamed into place.  Within a `Become` block, or with a `Sudo` prefix, the file is downloaded as the given user.",
+	},
+	"Env": {
+		usage:   "Env NAME",
+		summary: "Import the environmental variable `$NAME` as a read-only variable.",
+		details: "If the variable is not set the recipe fails.",
+	},
+	"Fetch": {
+		usage:   "Fetch remote/path local/path",
+		summary: "Download a remote file, or glob of files, from the remote host.",
+		details: "Missing local directories are created.  Use variables such as `${host}` within the local path to keep the files from each host apart.  Within a `Become` block, or with a `Sudo` prefix, the files are read as the given user.",
+	},
+	"Group": {
+		usage:   "Group name [system=true]",
+		summary: "Ensure the given group exists upon the remote host, creating it if required.",
+	},
+	"IfChanged": {
+		usage:   "IfChanged \"command\"",
+		summary: "Run a command upon the remote host if the previous statement which records changes, such as a copy, changed something.",
+	},
+	"LineInFile": {
+		usage:   "LineInFile remote/path [regexp=pattern] line=\"line\"",
+		summary: "Ensure a remote file contains the given line.",
+		details: "With `regexp` the last line matching the regular expression is replaced, otherwise the line is appended if it isn't already present.  The file is only replaced if it changed, atomically, and a following `IfChanged` runs if it was.",
+	},
+	"LoadSecrets": {
+		usage:   "LoadSecrets \"path/to/secrets.enc\"",
+		summary: "Decrypt the given age-encrypted file, and set the read-only variables it contains.",
+	},
+	"Local": {
+		usage:   "Local \"command\" [set=name]",
+		summary: "Run a command upon the local host, failing the recipe if it fails.",
+		details: "The command is run via `sh -c`, or via `cmd /C` upon Windows.  With `set` the output of the command is stored in the named variable, rather than shown.",
+	},
+	"Package": {
+		usage:   "Package name ... [state=present|absent|latest]",
+		summary: "Ensure the given packages are installed, removed, or upgraded, via apt, dnf, yum, or apk.",
+		details: "The packages are changed together, and only if required, so a following `IfChanged` runs only if something was installed, removed, or upgraded.  The default state is `present`.",
+	},
+	"Remove": {
+		usage:   "Remove remote/path",
+		summary: "Ensure the given path doesn't exist upon the remote host, removing it, and anything beneath it, if it does.",
+		details: "A symlink is removed, rather than what it points to.  Within a `Become` block, or with a `Sudo` prefix, the path is removed as the given user.  With `-nop` the change is reported, but not made.",
+	},
+	"Run": {
+		usage:   "Run \"command\"",
+		summary: "Run a command upon the remote host.",
+	},
+	"RunScript": {
+		usage:   "RunScript local/script \"arg\" ... [interpreter=bash] [template=true]",
+		summary: "Upload a local script to the remote host, run it with the given arguments, then remove it.",
+		details: "Without an `interpreter` the script is executed directly, so should start with a `#!` line.  With `template=true` the script is expanded as a template, as with `CopyTemplate`, before it is uploaded.",
+	},
+	"Secret": {
+		usage:   "Secret name \"value\"",
+		summary: "Set a variable, as with `Set`, redacting its value from all output.",
+	},
+	"Service": {
+		usage:   "Service name [state=running|stopped|restarted|reloaded] [enabled=true|false]",
+		summary: "Ensure the given systemd service is in the given state, and is enabled at boot, or not.",
+		details: "Only the changes required are made, and a following `IfChanged` runs if any were.  If unit files were copied, or written, beneath a `systemd` directory then `systemctl daemon-reload` is run first.",
+	},
+	"Set": {
+		usage:   "Set name \"value\"",
+		summary: "Set a variable.",
+		details: "Variables are used as `${name}` within arguments, and within templates.",
+	},
+	"Sudo": {
+		usage:   "Sudo [-u user] statement",
+		summary: "Run the following `Run`, `RunScript`, `IfChanged`, `BlockInFile`, `CopyFile`, `CopyTemplate`, `Directory`, `Download`, `Fetch`, `Group`, `LineInFile`, `Package`, `Remove`, `Service`, `Symlink`, `User`, or `WriteFile` as root, or the given user.",
+	},
+	"Symlink": {
+		usage:   "Symlink target remote/link",
+		summary: "Ensure the given symlink exists upon the remote host, and points to the target.",
+		details: "A symlink pointing elsewhere is replaced atomically, but other files are never replaced.  Within a `Become` block, or with a `Sudo` prefix, the symlink is managed as the given user.  With `-nop` the change is reported, but not made.",
+	},
+	"Timeout": {
+		usage:   "Timeout duration statement",
+		summary: "Kill the following `Run`, `RunScript`, `IfChanged`, or `Local` if it runs for longer than the given duration, such as `30s`.",
+		details: "The command is killed along with anything it started.  Remote commands are killed via `timeout` upon the remote host, so this works for those run via `Sudo`, or within `Become`, too.",
+	},
+	"User": {
+		usage:   "User name [home=/path] [shell=/path] [system=true] [groups=a,b]",
+		summary: "Ensure the given user exists upon the remote host, with the given home directory, shell, and supplementary groups.",
+		details: "Missing users are created, and existing users modified only if they differ.  Users are added to the given groups, but never removed from others.  `system` only applies when the user is created.",
+	},
+	"WriteFile": {
+		usage:   "WriteFile remote/path \"content\"",
+		summary: "Write the given content, which is usually a heredoc, to a file upon the remote host.",
+		details: "Variables are expanded within the content.  If the remote file was already identical no change is made, and a following `IfChanged` will not run.",
+	},
+}
+
+// markdown returns the documentation for the given primitive, as markdown.
+func (p primitive) markdown() string {
+	out := "```\n" + p.usage + "\n```\n\n" + p.summary
+	if p.details != "" {
+		out += "\n\n" + p.details
+	}
+	return out
+}
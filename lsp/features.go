@@ -0,0 +1,328 @@
+package lsp
+
+import (
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/skx/deployr/ast"
+	"github.com/skx/deployr/lexer"
+	"github.com/skx/deployr/lint"
+	"github.com/skx/deployr/parser"
+	"github.com/skx/deployr/token"
+)
+
+// diagnostics returns the problems found in the given recipe.
+//
+// Syntax errors are reported as errors, while problems found by the
+// linter are reported as warnings.  Local paths are resolved against
+// the directory holding the recipe, rather than our own.
+func diagnostics(uri string, text string) []diagnostic {
+	result := []diagnostic{}
+	lines := strings.Split(text, "\n")
+
+	p := parser.New(lexer.New(text))
+	program, err := p.Parse()
+	if err != nil {
+		list, _ := err.(parser.ErrorList)
+		for _, e := range list {
+			result = append(result, diagnostic{
+				Range:    wordRange(lines, e.Pos),
+				Severity: severityError,
+				Source:   "deployr",
+				Message:  e.Message,
+			})
+		}
+		return result
+	}
+
+	for _, w := range p.Warnings() {
+		result = append(result, diagnostic{
+			Range:    wordRange(lines, w.Pos),
+			Severity: severityWarning,
+			Source:   "deployr",
+			Message:  w.Message,
+		})
+	}
+	linter := lint.New(program)
+	linter.Dir = documentDir(uri)
+	for _, w := range linter.Lint() {
+		result = append(result, diagnostic{
+			Range:    wordRange(lines, w.Pos),
+			Severity: severityWarning,
+			Source:   "deployr",
+			Message:  w.Message,
+		})
+	}
+	return result
+}
+
+// completion returns the completions at the given position.
+//
+// At the start of a statement we complete the names of primitives, and
+// for the source of a copy we complete local paths.
+func (s *Server) completion(params positionParams) []completionItem {
+	result := []completionItem{}
+
+	lines := strings.Split(s.documents[params.TextDocument.URI], "\n")
+	if params.Position.Line >= len(lines) {
+		return result
+	}
+
+	//
+	// Find the word being completed, and those before it.
+	//
+	before := []rune(lines[params.Position.Line])
+	if params.Position.Character < len(before) {
+		before = before[:params.Position.Character]
+	}
+	start := len(before)
+	for start > 0 && !unicode.IsSpace(before[start-1]) {
+		start--
+	}
+	partial := string(before[start:])
+	words := skipPrefixes(strings.Fields(string(before[:start])))
+
+	replace := textRange{
+		Start: position{Line: params.Position.Line, Character: start},
+		End:   position{Line: params.Position.Line, Character: len(before)},
+	}
+
+	switch {
+	case len(words) == 0:
+		for _, name := range token.Keywords() {
+			doc := primitives[name]
+			result = append(result, completionItem{
+				Label:         name,
+				Kind:          kindKeyword,
+				Detail:        doc.summary,
+				Documentation: &markupContent{Kind: "markdown", Value: doc.markdown()},
+			})
+		}
+
+	case len(words) == 1 && (words[0] == token.COPYFILE || words[0] == token.COPYTEMPLATE || words[0] == token.RUNSCRIPT):
+		result = append(result, paths(params.TextDocument.URI, partial, replace)...)
+	}
+
+	return result
+}
+
+// skipPrefixes removes any "Sudo" and "Timeout" prefixes from the start
+// of the given words.
+func skipPrefixes(words []string) []string {
+	for len(words) > 0 {
+		switch {
+		case words[0] == token.SUDO && len(words) > 2 && words[1] == "-u":
+			words = words[3:]
+		case words[0] == token.SUDO:
+			words = words[1:]
+		case words[0] == token.TIMEOUT && len(words) > 1:
+			words = words[2:]
+		default:
+			return words
+		}
+	}
+	return words
+}
+
+// paths returns completions of the given partial local path, which is
+// relative to the directory holding the document.
+func paths(uri string, partial string, replace textRange) []completionItem {
+	var result []completionItem
+
+	dir, prefix := "", partial
+	if i := strings.LastIndex(partial, "/"); i >= 0 {
+		dir, prefix = partial[:i+1], partial[i+1:]
+	}
+
+	search := dir
+	if !filepath.IsAbs(dir) {
+		search = filepath.Join(documentDir(uri), dir)
+	}
+
+	entries, err := ioutil.ReadDir(search)
+	if err != nil {
+		return result
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(prefix, ".") {
+			continue
+		}
+
+		item := completionItem{Label: dir + name, Kind: kindFile}
+		if entry.IsDir() {
+			item.Label += "/"
+			item.Kind = kindFolder
+		}
+		item.TextEdit = &textEdit{Range: replace, NewText: item.Label}
+		result = append(result, item)
+	}
+	return result
+}
+
+// documentDir returns the local directory holding the given document.
+func documentDir(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "."
+	}
+	return filepath.Dir(filepath.FromSlash(u.Path))
+}
+
+// hover returns the documentation of the primitive at the given position.
+func (s *Server) hover(params positionParams) *hover {
+	tok, _, ok := tokenAt(s.documents[params.TextDocument.URI], params.Position)
+	if !ok || tok.Type == token.IDENT || tok.Type == token.STRING {
+		return nil
+	}
+
+	doc, ok := primitives[tok.Literal]
+	if !ok {
+		return nil
+	}
+
+	return &hover{
+		Contents: markupContent{Kind: "markdown", Value: doc.markdown()},
+		Range:    tokenRange(tok),
+	}
+}
+
+// definition returns the location(s) at which the variable referenced
+// at the given position is set.
+func (s *Server) definition(params positionParams) []location {
+	text := s.documents[params.TextDocument.URI]
+
+	tok, offset, ok := tokenAt(text, params.Position)
+	if !ok || (tok.Type != token.IDENT && tok.Type != token.STRING) {
+		return nil
+	}
+
+	name := referenceAt([]rune(tok.Raw), offset)
+	if name == "" {
+		return nil
+	}
+
+	//
+	// Look for "Set name" and "Secret name".
+	//
+	var result []location
+	var prev token.Token
+	l := lexer.New(text)
+	for {
+		tok := l.NextToken()
+		if tok.Type == token.EOF || tok.Type == token.ILLEGAL {
+			break
+		}
+		if (prev.Type == token.SET || prev.Type == token.SECRET) && tok.Type == token.IDENT && tok.Literal == name {
+			result = append(result, location{URI: params.TextDocument.URI, Range: tokenRange(tok)})
+		}
+		prev = tok
+	}
+	return result
+}
+
+// referenceAt returns the name of the variable referenced, as "${name}",
+// at the given offset within the source of a token.
+func referenceAt(raw []rune, offset int) string {
+
+	//
+	// Find the start of the reference, which must not be closed
+	// before the offset.
+	//
+	start := -1
+	for i := offset; i >= 0; i-- {
+		if i+1 < len(raw) && raw[i] == '$' && raw[i+1] == '{' {
+			start = i
+			break
+		}
+		if raw[i] == '}' && i != offset {
+			return ""
+		}
+	}
+	if start < 0 {
+		return ""
+	}
+
+	end := start + 2
+	for end < len(raw) && raw[end] != '}' {
+		end++
+	}
+	if end >= len(raw) {
+		return ""
+	}
+
+	name, _, _ := ast.SplitReference(string(raw[start+2 : end]))
+	if strings.HasPrefix(name, "env:") {
+		return ""
+	}
+	return name
+}
+
+// tokenAt returns the token at the given position within the recipe,
+// along with the offset of the position within the token's source.
+func tokenAt(text string, pos position) (token.Token, int, bool) {
+	l := lexer.New(text)
+	for {
+		tok := l.NextToken()
+		if tok.Type == token.EOF || tok.Type == token.ILLEGAL {
+			return tok, 0, false
+		}
+
+		line, char := tok.Line-1, tok.Column-1
+		for i, r := range []rune(tok.Raw) {
+			if line == pos.Line && char == pos.Character {
+				return tok, i, true
+			}
+			if r == '\n' {
+				line++
+				char = 0
+			} else {
+				char++
+			}
+		}
+	}
+}
+
+// tokenRange returns the span of the first line of the given token.
+func tokenRange(tok token.Token) textRange {
+	raw := []rune(tok.Raw)
+	length := 0
+	for length < len(raw) && raw[length] != '\n' {
+		length++
+	}
+
+	return textRange{
+		Start: position{Line: tok.Line - 1, Character: tok.Column - 1},
+		End:   position{Line: tok.Line - 1, Character: tok.Column - 1 + length},
+	}
+}
+
+// wordRange returns the span of the word at the given position, which
+// is used to highlight a problem.
+func wordRange(lines []string, pos ast.Position) textRange {
+	if !pos.IsValid() || pos.Line > len(lines) {
+		return textRange{}
+	}
+
+	line := []rune(lines[pos.Line-1])
+	start := pos.Column - 1
+	if start > len(line) {
+		start = len(line)
+	}
+	end := start
+	for end < len(line) && !unicode.IsSpace(line[end]) {
+		end++
+	}
+
+	return textRange{
+		Start: position{Line: pos.Line - 1, Character: start},
+		End:   position{Line: pos.Line - 1, Character: end},
+	}
+}
@@ -0,0 +1,247 @@
+// Package lsp implements a language server for recipes.
+//
+// The server speaks the Language Server Protocol, via JSON-RPC, over a
+// pair of streams - usually STDIN and STDOUT.  It offers diagnostics,
+// completion, hover documentation, and go-to-definition of variables.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Server holds our state.
+type Server struct {
+
+	// in is the stream we read requests from.
+	in *bufio.Reader
+
+	// out is the stream we write responses to.
+	out io.Writer
+
+	// documents holds the text of each open document, by URI.
+	documents map[string]string
+
+	// shutdown is true once the client has asked us to shutdown.
+	shutdown bool
+}
+
+// New creates a new server, reading requests from the given reader and
+// writing responses to the given writer.
+func New(in io.Reader, out io.Writer) *Server {
+	s := &Server{in: bufio.NewReader(in), out: out}
+	s.documents = make(map[string]string)
+	return s
+}
+
+// Serve handles requests until the client asks us to exit.
+//
+// An error is returned if the client exits without first asking us to
+// shutdown, or if the connection fails.
+func (s *Server) Serve() error {
+	for {
+		body, err := s.read()
+		if err != nil {
+			if err == io.EOF && s.shutdown {
+				return nil
+			}
+			return err
+		}
+
+		var req request
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			s.replyError(nil, codeParseError, err.Error())
+			continue
+		}
+
+		if req.Method == "exit" {
+			if !s.shutdown {
+				return errors.New("exit without shutdown")
+			}
+			return nil
+		}
+
+		err = s.handle(&req)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handle dispatches a single request, or notification.
+func (s *Server) handle(req *request) error {
+
+	//
+	// Once we've been told to shutdown we only expect to exit.
+	//
+	if s.shutdown {
+		if req.ID != nil {
+			return s.replyError(req.ID, codeInvalidRequest, "server is shutting down")
+		}
+		return nil
+	}
+
+	switch req.Method {
+	case "initialize":
+		var result initializeResult
+		result.Capabilities.TextDocumentSync = 1
+		result.Capabilities.HoverProvider = true
+		result.Capabilities.DefinitionProvider = true
+		result.Capabilities.CompletionProvider.TriggerCharacters = []string{"/"}
+		result.ServerInfo.Name = "deployr"
+		return s.reply(req.ID, result)
+
+	case "initialized":
+		return nil
+
+	case "shutdown":
+		s.shutdown = true
+		return s.reply(req.ID, nil)
+
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if !s.decode(req, &params) {
+			return nil
+		}
+		s.documents[params.TextDocument.URI] = params.TextDocument.Text
+		return s.publish(params.TextDocument.URI)
+
+	case "textDocument/didChange":
+		var params didChangeParams
+		if !s.decode(req, &params) {
+			return nil
+		}
+		for _, change := range params.ContentChanges {
+			s.documents[params.TextDocument.URI] = change.Text
+		}
+		return s.publish(params.TextDocument.URI)
+
+	case "textDocument/didClose":
+		var params didCloseParams
+		if !s.decode(req, &params) {
+			return nil
+		}
+		delete(s.documents, params.TextDocument.URI)
+		return s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+			URI:         params.TextDocument.URI,
+			Diagnostics: []diagnostic{},
+		})
+
+	case "textDocument/completion":
+		var params positionParams
+		if !s.decode(req, &params) {
+			return nil
+		}
+		return s.reply(req.ID, s.completion(params))
+
+	case "textDocument/hover":
+		var params positionParams
+		if !s.decode(req, &params) {
+			return nil
+		}
+		return s.reply(req.ID, s.hover(params))
+
+	case "textDocument/definition":
+		var params positionParams
+		if !s.decode(req, &params) {
+			return nil
+		}
+		return s.reply(req.ID, s.definition(params))
+	}
+
+	//
+	// Unknown notifications are ignored, unknown requests are errors.
+	//
+	if req.ID != nil {
+		return s.replyError(req.ID, codeMethodNotFound, fmt.Sprintf("unknown method %s", req.Method))
+	}
+	return nil
+}
+
+// decode unmarshals the parameters of the given request, replying with
+// an error if they're invalid.
+func (s *Server) decode(req *request, params interface{}) bool {
+	err := json.Unmarshal(req.Params, params)
+	if err != nil {
+		if req.ID != nil {
+			s.replyError(req.ID, codeInvalidParams, err.Error())
+		}
+		return false
+	}
+	return true
+}
+
+// publish sends the diagnostics for the given document.
+func (s *Server) publish(uri string) error {
+	return s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+		URI:         uri,
+		Diagnostics: diagnostics(uri, s.documents[uri]),
+	})
+}
+
+// reply sends the result of a request.
+func (s *Server) reply(id *json.RawMessage, result interface{}) error {
+	return s.write(response{JSONRPC: "2.0", ID: id, Result: result})
+}
+
+// replyError sends the failure of a request.
+func (s *Server) replyError(id *json.RawMessage, code int, message string) error {
+	return s.write(errorResponse{JSONRPC: "2.0", ID: id, Error: responseError{Code: code, Message: message}})
+}
+
+// notify sends a notification.
+func (s *Server) notify(method string, params interface{}) error {
+	return s.write(notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// read returns the body of the next message.
+//
+// Each message has a set of headers, including the length of the body,
+// followed by a blank line.
+func (s *Server) read() ([]byte, error) {
+	length := -1
+
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid header '%s'", line)
+			}
+		}
+	}
+
+	if length < 0 {
+		return nil, errors.New("missing Content-Length header")
+	}
+
+	body := make([]byte, length)
+	_, err := io.ReadFull(s.in, body)
+	return body, err
+}
+
+// write sends a message.
+func (s *Server) write(msg interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
@@ -0,0 +1,256 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skx/deployr/token"
+)
+
+// session is a helper which runs the server against the given messages,
+// and returns the messages it sent.
+func session(t *testing.T, messages ...string) []map[string]interface{} {
+
+	var in bytes.Buffer
+	for _, msg := range messages {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(msg), msg)
+	}
+
+	var out bytes.Buffer
+	err := New(&in, &out).Serve()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	//
+	// Read back the messages we sent.
+	//
+	var result []map[string]interface{}
+	s := New(nil, nil)
+	s.in = bufio.NewReader(&out)
+	for {
+		body, err := s.read()
+		if err != nil {
+			break
+		}
+		var msg map[string]interface{}
+		err = json.Unmarshal(body, &msg)
+		if err != nil {
+			t.Fatalf("Invalid message %s: %s", body, err.Error())
+		}
+		result = append(result, msg)
+	}
+	return result
+}
+
+// open returns a didOpen notification for the given recipe.
+func open(uri string, text string) string {
+	params, _ := json.Marshal(didOpenParams{TextDocument: textDocumentItem{URI: uri, Text: text}})
+	return `{"jsonrpc":"2.0","method":"textDocument/didOpen","params":` + string(params) + `}`
+}
+
+// at returns a request of the given method, at the given position.
+func at(id int, method string, uri string, line int, char int) string {
+	return fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"%s","params":{"textDocument":{"uri":"%s"},"position":{"line":%d,"character":%d}}}`,
+		id, method, uri, line, char)
+}
+
+// shutdown holds the messages which end a session.
+var shutdown = []string{
+	`{"jsonrpc":"2.0","id":99,"method":"shutdown"}`,
+	`{"jsonrpc":"2.0","method":"exit"}`,
+}
+
+// TestLifecycle tests initialization, unknown methods, and shutdown.
+func TestLifecycle(t *testing.T) {
+
+	out := session(t,
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","method":"initialized","params":{}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"bogus"}`,
+		shutdown[0], shutdown[1])
+
+	if len(out) != 3 {
+		t.Fatalf("Expected three responses, got %v", out)
+	}
+	caps := out[0]["result"].(map[string]interface{})["capabilities"].(map[string]interface{})
+	if caps["hoverProvider"] != true || caps["definitionProvider"] != true {
+		t.Fatalf("Unexpected capabilities %v", caps)
+	}
+	if out[1]["error"].(map[string]interface{})["code"].(float64) != codeMethodNotFound {
+		t.Fatalf("Expected an error for an unknown method, got %v", out[1])
+	}
+
+	//
+	// Exiting without shutting down is an error.
+	//
+	in := strings.NewReader(fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(shutdown[1]), shutdown[1]))
+	err := New(in, ioutil.Discard).Serve()
+	if err == nil || !strings.Contains(err.Error(), "without shutdown") {
+		t.Fatalf("Expected an error exiting without shutdown, got %v", err)
+	}
+}
+
+// TestDiagnostics tests that syntax errors and warnings are reported.
+func TestDiagnostics(t *testing.T) {
+
+	out := session(t,
+		open("file:///tmp/a.recipe", "Run \"/usr/bin/id\"\nSet name\nRun\n"),
+		open("file:///tmp/b.recipe", "IfChanged \"/bin/true\"\n"),
+		shutdown[0], shutdown[1])
+
+	if len(out) != 3 {
+		t.Fatalf("Expected three messages, got %v", out)
+	}
+
+	diags := out[0]["params"].(map[string]interface{})["diagnostics"].([]interface{})
+	if len(diags) != 2 {
+		t.Fatalf("Expected two diagnostics, got %v", diags)
+	}
+	for i, d := range diags {
+		diag := d.(map[string]interface{})
+		start := diag["range"].(map[string]interface{})["start"].(map[string]interface{})
+		if diag["severity"].(float64) != severityError || start["line"].(float64) != float64(2+i) {
+			t.Fatalf("Unexpected diagnostic %v", diag)
+		}
+	}
+
+	diags = out[1]["params"].(map[string]interface{})["diagnostics"].([]interface{})
+	if len(diags) != 1 || !strings.Contains(diags[0].(map[string]interface{})["message"].(string), "IfChanged") {
+		t.Fatalf("Unexpected diagnostics %v", diags)
+	}
+
+	//
+	// Local paths are found beside the recipe, wherever we run.
+	//
+	dir, err := ioutil.TempDir("", "lsp")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "app.conf"), []byte("app"), 0644)
+
+	uri := "file://" + filepath.ToSlash(dir) + "/deploy.recipe"
+	out = session(t,
+		open(uri, "CopyFile app.conf /etc/app.conf\nCopyFile db.conf /etc/db.conf\n"),
+		shutdown[0], shutdown[1])
+
+	diags = out[0]["params"].(map[string]interface{})["diagnostics"].([]interface{})
+	if len(diags) != 1 || !strings.Contains(diags[0].(map[string]interface{})["message"].(string), "'db.conf' does not exist") {
+		t.Fatalf("Unexpected diagnostics %v", diags)
+	}
+}
+
+// TestCompletion tests completing primitives and local paths.
+func TestCompletion(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "lsp")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "conf"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "conf", "app.conf"), []byte("app"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "conf", "db.conf"), []byte("db"), 0644)
+
+	uri := "file://" + filepath.ToSlash(dir) + "/deploy.recipe"
+	out := session(t,
+		open(uri, "Ru\nSudo -u app C\nCopyFile conf/a\nCopyFile co\n"),
+		at(1, "textDocument/completion", uri, 0, 2),
+		at(2, "textDocument/completion", uri, 1, 13),
+		at(3, "textDocument/completion", uri, 2, 15),
+		at(4, "textDocument/completion", uri, 3, 11),
+		shutdown[0], shutdown[1])
+
+	labels := func(msg map[string]interface{}) []string {
+		var result []string
+		for _, item := range msg["result"].([]interface{}) {
+			result = append(result, item.(map[string]interface{})["label"].(string))
+		}
+		return result
+	}
+
+	keywords := strings.Join(token.Keywords(), " ")
+	if strings.Join(labels(out[1]), " ") != keywords {
+		t.Fatalf("Unexpected completions %v", labels(out[1]))
+	}
+	if strings.Join(labels(out[2]), " ") != keywords {
+		t.Fatalf("Unexpected completions after prefix %v", labels(out[2]))
+	}
+	if strings.Join(labels(out[3]), " ") != "conf/app.conf" {
+		t.Fatalf("Unexpected path completions %v", labels(out[3]))
+	}
+	if strings.Join(labels(out[4]), " ") != "conf/" {
+		t.Fatalf("Unexpected path completions %v", labels(out[4]))
+	}
+}
+
+// TestHover tests that hovering over a primitive shows its documentation.
+func TestHover(t *testing.T) {
+
+	uri := "file:///tmp/deploy.recipe"
+	out := session(t,
+		open(uri, "# comment\n  CopyFile a b\n"),
+		at(1, "textDocument/hover", uri, 1, 4),
+		at(2, "textDocument/hover", uri, 1, 11),
+		at(3, "textDocument/hover", uri, 0, 3),
+		shutdown[0], shutdown[1])
+
+	result, ok := out[1]["result"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected a hover result, got %v", out[1])
+	}
+	contents := result["contents"].(map[string]interface{})["value"].(string)
+	if !strings.Contains(contents, "CopyFile local/path remote/path") {
+		t.Fatalf("Unexpected hover %s", contents)
+	}
+	if out[2]["result"] != nil || out[3]["result"] != nil {
+		t.Fatalf("Expected no hover for arguments or comments, got %v %v", out[2], out[3])
+	}
+}
+
+// TestDefinition tests finding where a variable is set.
+func TestDefinition(t *testing.T) {
+
+	uri := "file:///tmp/deploy.recipe"
+	out := session(t,
+		open(uri, "Set RELEASE \"1.2\"\nRun \"echo ${RELEASE:-none} ${env:HOME}\"\nCopyFile a /srv/${RELEASE}\n"),
+		at(1, "textDocument/definition", uri, 1, 14),
+		at(2, "textDocument/definition", uri, 2, 19),
+		at(3, "textDocument/definition", uri, 1, 30),
+		at(4, "textDocument/definition", uri, 1, 6),
+		shutdown[0], shutdown[1])
+
+	for _, i := range []int{1, 2} {
+		locations, ok := out[i]["result"].([]interface{})
+		if !ok || len(locations) != 1 {
+			t.Fatalf("Expected one location, got %v", out[i])
+		}
+		start := locations[0].(map[string]interface{})["range"].(map[string]interface{})["start"].(map[string]interface{})
+		if start["line"].(float64) != 0 || start["character"].(float64) != 4 {
+			t.Fatalf("Unexpected location %v", start)
+		}
+	}
+
+	if out[3]["result"] != nil || out[4]["result"] != nil {
+		t.Fatalf("Expected no definitions, got %v %v", out[3], out[4])
+	}
+}
+
+// TestDocs tests that every primitive is documented.
+func TestDocs(t *testing.T) {
+	for _, name := range token.Keywords() {
+		if _, ok := primitives[name]; !ok {
+			t.Errorf("Primitive %s has no documentation", name)
+		}
+	}
+}
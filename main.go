@@ -20,7 +20,11 @@ func main() {
 	subcommands.Register(subcommands.HelpCommand(), "")
 	subcommands.Register(subcommands.FlagsCommand(), "")
 	subcommands.Register(subcommands.CommandsCommand(), "")
+	subcommands.Register(&fmtCmd{}, "")
+	subcommands.Register(&graphCmd{}, "")
 	subcommands.Register(&lexCmd{}, "")
+	subcommands.Register(&lintCmd{}, "")
+	subcommands.Register(&lspCmd{}, "")
 	subcommands.Register(&parseCmd{}, "")
 	subcommands.Register(&runCmd{}, "")
 	subcommands.Register(&versionCmd{}, "")
@@ -1,13 +1,20 @@
 // Package parser is the package which parses our input.
 //
 // Given a lexer, wrapping a given input-file, we parse tokens from
-// it into a series of statements which we then return for processing.
+// it into a tree of statements which we then return for processing.
+//
+// If the lexer returns comments they're attached to the statements
+// they precede, or follow upon the same line.
 package parser
 
 import (
 	"fmt"
+	"regexp"
+	"time"
+
+	"strings"
 
-	"github.com/skx/deployr/statement"
+	"github.com/skx/deployr/ast"
 	"github.com/skx/deployr/token"
 )
 
@@ -32,6 +39,48 @@ type tokenizer interface {
 type Parser struct {
 	// Our tokenizer.
 	Tokenizer tokenizer
+
+	// pending holds tokens which have been read, then pushed back.
+	pending []token.Token
+
+	// held holds the comments which preceded each pending token.
+	held [][]token.Token
+
+	// recent holds the comments which preceded the last token we
+	// read, and recentLine the value of lastLine before we read it,
+	// so that both may be restored if the token is pushed back.
+	recent     []token.Token
+	recentLine int
+
+	// program is the program we're building.
+	program *ast.Program
+
+	// become holds any open "Become" blocks, innermost last.
+	become []*ast.BecomeStatement
+
+	// comments holds comments which have been read, but not yet
+	// attached to a statement.
+	comments []token.Token
+
+	// last is the most recently completed statement, to which a
+	// comment upon the same line will be attached.
+	last *ast.Base
+
+	// lastLine is the line upon which the last token we read ended.
+	lastLine int
+
+	// prefix is the position of the first prefix, such as "Sudo",
+	// preceding the statement we're about to parse.
+	prefix ast.Position
+
+	// warnings holds any non-fatal problems found while parsing.
+	warnings []Warning
+
+	// errors holds the errors found while parsing.
+	errors ErrorList
+
+	// current is the last token we read.
+	current token.Token
 }
 
 // New returns a new Parser object, consuming tokens from the specified
@@ -42,25 +91,68 @@ func New(tk tokenizer) *Parser {
 }
 
 // Parse the given program, catching errors.
-func (p *Parser) Parse() ([]statement.Statement, error) {
-	var result []statement.Statement
+func (p *Parser) Parse() (*ast.Program, error) {
+	p.program = &ast.Program{}
+	result := p.program
 
 	//
 	// Does the next command use Sudo?
 	//
 	sudo := false
 
+	//
+	// If so which user should it run as?
+	//
+	sudoUser := ""
+
+	//
+	// Does the next command have a timeout?
+	//
+	var timeout time.Duration
+
 	//
 	// We have a lexer, so we process each token in-turn until we
 	// hit the end-of-file.
 	//
 	run := true
+	failures := 0
 	for run {
 
+		//
+		// If the previous statement failed to parse then forget
+		// any prefixes which preceded it.
+		//
+		if len(p.errors) > failures {
+			failures = len(p.errors)
+			sudo, sudoUser, timeout = false, "", 0
+			p.prefix = ast.Position{}
+		}
+
 		//
 		// Get the next token.
 		//
-		tok := p.Tokenizer.NextToken()
+		tok := p.nextToken()
+
+		//
+		// Any comments we find now are not upon the same line
+		// as the previous statement.
+		//
+		p.last = nil
+
+		//
+		// "Sudo" and "Timeout" are prefixes which only apply to
+		// some statements.  If they precede anything else they
+		// have no effect, which we note.
+		//
+		if sudo && !prefixApplies(token.SUDO, tok.Type) {
+			p.warnf(tok, "'Sudo' has no effect on '%s'", tok.Type)
+			sudo = false
+			sudoUser = ""
+		}
+		if timeout > 0 && !prefixApplies(token.TIMEOUT, tok.Type) {
+			p.warnf(tok, "'Timeout' has no effect on '%s'", tok.Type)
+			timeout = 0
+		}
 
 		//
 		// Process each token-type appropriately.
@@ -78,7 +170,8 @@ func (p *Parser) Parse() ([]statement.Statement, error) {
 			// That might be a bogus number (if we supported numbers),
 			// or an unterminated string.
 			//
-			return result, fmt.Errorf("error received from the lexer - %s", tok.Literal)
+			p.fail(tok, fmt.Errorf("error received from the lexer - %s", tok.Literal))
+			continue
 		case "IDENT":
 			//
 			// If we find a bare-ident which is not an argument
@@ -90,7 +183,8 @@ func (p *Parser) Parse() ([]statement.Statement, error) {
 			//
 			// Either way this is an error.
 			//
-			return result, fmt.Errorf("found unexpected identifier '%s'", tok.Literal)
+			p.fail(tok, fmt.Errorf("found unexpected identifier '%s'", tok.Literal))
+			continue
 		case "STRING":
 			//
 			// If we find a bare-string which is not an argument
@@ -102,7 +196,82 @@ func (p *Parser) Parse() ([]statement.Statement, error) {
 			//
 			// Either way this is an error.
 			//
-			return result, fmt.Errorf("found unexpected string '%s'", tok.Literal)
+			p.fail(tok, fmt.Errorf("found unexpected string '%s'", tok.Literal))
+			continue
+		case "Become":
+
+			//
+			// We should have one argument to Become:
+			//
+			//  1. IDENT
+			//
+			// (Here IDENT means "user".)
+			//
+			expected := []token.Token{
+				{Type: "IDENT"},
+			}
+
+			//
+			// Get the arguments, validating types.
+			//
+			args, err := p.GetArguments(expected)
+
+			//
+			// Error?
+			//
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			//
+			// Open the block - statements will be added to it
+			// until we see the matching "End".
+			//
+			s := &ast.BecomeStatement{Base: p.base(tok), User: args[0]}
+			p.add(s)
+			p.become = append(p.become, s)
+
+		case "BecomeMethod":
+
+			//
+			// We should have one argument to BecomeMethod:
+			//
+			//  1. IDENT
+			//
+			expected := []token.Token{
+				{Type: "IDENT"},
+			}
+
+			//
+			// Get the arguments, validating types.
+			//
+			args, err := p.GetArguments(expected)
+
+			//
+			// Error?
+			//
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			//
+			// Ensure the method is one we support.
+			//
+			switch args[0].Literal {
+			case "sudo", "doas", "su":
+			default:
+				p.fail(tok, fmt.Errorf("unknown become method '%s' - expected sudo, doas, or su", args[0].Literal))
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.BecomeMethodStatement{Base: p.base(tok), Method: args[0]}
+			p.add(s)
+
 		case "CopyTemplate":
 			//
 			// We should have two arguments to CopyTemplate:
@@ -126,15 +295,23 @@ func (p *Parser) Parse() ([]statement.Statement, error) {
 			// Error?
 			//
 			if err != nil {
-				return result, err
+				p.fail(tok, err)
+				continue
 			}
 
 			//
 			// Otherwise we can store this statement.
 			//
-			s := statement.Statement{Token: tok}
-			s.Arguments = args
-			result = append(result, s)
+			s := &ast.CopyTemplateStatement{Base: p.base(tok), Source: args[0], Destination: args[1]}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
 
 		case "CopyFile":
 
@@ -160,15 +337,23 @@ func (p *Parser) Parse() ([]statement.Statement, error) {
 			// Error?
 			//
 			if err != nil {
-				return result, err
+				p.fail(tok, err)
+				continue
 			}
 
 			//
 			// Otherwise we can store this statement.
 			//
-			s := statement.Statement{Token: tok}
-			s.Arguments = args
-			result = append(result, s)
+			s := &ast.CopyFileStatement{Base: p.base(tok), Source: args[0], Destination: args[1]}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
 
 		case "DeployTo":
 			//
@@ -189,15 +374,47 @@ func (p *Parser) Parse() ([]statement.Statement, error) {
 			// Error?
 			//
 			if err != nil {
-				return result, err
+				p.fail(tok, err)
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.DeployToStatement{Base: p.base(tok), Target: args[0]}
+			p.add(s)
+
+		case "Env":
+
+			//
+			// We should have one argument to Env:
+			//
+			//  1. IDENT
+			//
+			// (Here IDENT means the name of the variable.)
+			//
+			expected := []token.Token{
+				{Type: "IDENT"},
+			}
+
+			//
+			// Get the arguments, validating types.
+			//
+			args, err := p.GetArguments(expected)
+
+			//
+			// Error?
+			//
+			if err != nil {
+				p.fail(tok, err)
+				continue
 			}
 
 			//
 			// Otherwise we can store this statement.
 			//
-			s := statement.Statement{Token: tok}
-			s.Arguments = args
-			result = append(result, s)
+			s := &ast.EnvStatement{Base: p.base(tok), Name: args[0]}
+			p.add(s)
 
 		case "IfChanged":
 
@@ -219,22 +436,61 @@ func (p *Parser) Parse() ([]statement.Statement, error) {
 			// Error?
 			//
 			if err != nil {
-				return result, err
+				p.fail(tok, err)
+				continue
 			}
 
 			//
 			// Otherwise we can store this statement.
 			//
-			s := statement.Statement{Token: tok}
-			s.Arguments = args
+			s := &ast.IfChangedStatement{Base: p.base(tok), Command: args[0]}
 
 			//
 			// Preserve the SUDO state
 			//
-			s.Sudo = sudo
+			s.Sudo, s.SudoUser = sudo, sudoUser
 			sudo = false
+			sudoUser = ""
+
+			//
+			// Preserve the timeout
+			//
+			s.Timeout = timeout
+			timeout = 0
+
+			p.add(s)
+
+		case "LoadSecrets":
+
+			//
+			// We should have one argument to LoadSecrets:
+			//
+			//  1. String
+			//
+			// (Here the string is the path to the secrets file.)
+			//
+			expected := []token.Token{
+				{Type: "STRING"},
+			}
+
+			//
+			// Get the arguments, validating types.
+			//
+			args, err := p.GetArguments(expected)
+
+			//
+			// Error?
+			//
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
 
-			result = append(result, s)
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.LoadSecretsStatement{Base: p.base(tok), Path: args[0]}
+			p.add(s)
 
 		case "Run":
 
@@ -256,22 +512,62 @@ func (p *Parser) Parse() ([]statement.Statement, error) {
 			// Error?
 			//
 			if err != nil {
-				return result, err
+				p.fail(tok, err)
+				continue
 			}
 
 			//
 			// Otherwise we can store this statement.
 			//
-			s := statement.Statement{Token: tok}
-			s.Arguments = args
+			s := &ast.RunStatement{Base: p.base(tok), Command: args[0]}
 
 			//
 			// Preserve the SUDO state
 			//
-			s.Sudo = sudo
+			s.Sudo, s.SudoUser = sudo, sudoUser
 			sudo = false
+			sudoUser = ""
+
+			//
+			// Preserve the timeout
+			//
+			s.Timeout = timeout
+			timeout = 0
+
+			p.add(s)
+
+		case "Secret":
+
+			//
+			// We should have two arguments to Secret, as with
+			// Set:
+			//
+			//  1. Ident.
+			//  2. String
+			//
+			expected := []token.Token{
+				{Type: "IDENT"},
+				{Type: "STRING"},
+			}
+
+			//
+			// Get the arguments, validating types.
+			//
+			args, err := p.GetArguments(expected)
+
+			//
+			// Error?
+			//
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
 
-			result = append(result, s)
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.SecretStatement{Base: p.base(tok), Name: args[0], Value: args[1]}
+			p.add(s)
 
 		case "Set":
 
@@ -295,52 +591,1019 @@ func (p *Parser) Parse() ([]statement.Statement, error) {
 			// Error?
 			//
 			if err != nil {
-				return result, err
+				p.fail(tok, err)
+				continue
 			}
 
 			//
 			// Otherwise we can store this statement.
 			//
-			s := statement.Statement{Token: tok}
-			s.Arguments = args
-			result = append(result, s)
+			s := &ast.SetStatement{Base: p.base(tok), Name: args[0], Value: args[1]}
+			p.add(s)
 
 		case "Sudo":
 			sudo = true
+			p.startPrefix(tok)
 
-		case "EOF":
+			//
+			// Sudo may be followed by "-u user", to run as a
+			// user other than root.
+			//
+			next := p.nextToken()
+			if next.Type == "IDENT" && next.Literal == "-u" {
+
+				expected := []token.Token{
+					{Type: "IDENT"},
+				}
+
+				args, err := p.GetArguments(expected)
+				if err != nil {
+					p.fail(tok, err)
+					continue
+				}
+				sudoUser = args[0].Literal
+			} else {
+				p.unreadToken(next)
+			}
+
+		case "Timeout":
+			p.startPrefix(tok)
 
 			//
-			// This causes our parsing-loop to terminate.
+			// We should have one argument to Timeout:
 			//
-			run = false
-		default:
+			//  1. IDENT
+			//
+			// (Here IDENT means "duration", such as "30s".)
+			//
+			expected := []token.Token{
+				{Type: "IDENT"},
+			}
 
 			//
-			// If we hit this point there is a token-type we
-			// did not handle.
+			// Get the arguments, validating types.
 			//
-			return nil, fmt.Errorf("unhandled statement - %v", tok)
+			args, err := p.GetArguments(expected)
 
-		}
-	}
-	return result, nil
-}
+			//
+			// Error?
+			//
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
 
-// GetArguments fetches arguments from the lexer, ensuring they're
-// the expected types.
-func (p *Parser) GetArguments(expected []token.Token) ([]token.Token, error) {
-	var ret []token.Token
+			//
+			// Ensure the duration is valid.
+			//
+			timeout, err = time.ParseDuration(args[0].Literal)
+			if err != nil {
+				p.fail(tok, fmt.Errorf("invalid timeout '%s' - %s", args[0].Literal, err.Error()))
+				continue
+			}
+			if timeout <= 0 {
+				p.fail(tok, fmt.Errorf("invalid timeout '%s' - must be positive", args[0].Literal))
+				continue
+			}
 
-	for i, arg := range expected {
+		case "BlockInFile":
 
-		next := p.Tokenizer.NextToken()
-		if next.Type != arg.Type {
-			return nil, fmt.Errorf("expected %v as argument %d - Got %v", arg.Type, i+1, next.Type)
-		}
+			//
+			// We should have one argument to BlockInFile:
+			//
+			//  1. IDENT or STRING
+			//
+			// (Here the argument is the remote path.)
+			//
+			// It must be followed by the option "content", and
+			// may be followed by the option "marker".
+			//
+			path, err := p.getArgument(1, "IDENT", "STRING")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
 
-		ret = append(ret, next)
+			options := p.getOptions()
+			if !p.checkOptions(tok, options, "marker", "content") {
+				continue
+			}
+			if _, ok := ast.Option(options, "content"); !ok {
+				p.errorf(ast.Position{Line: path.Line, Column: path.Column}, "BlockInFile requires the option 'content'")
+				continue
+			}
 
-	}
-	return ret, nil
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.BlockInFileStatement{Base: p.base(tok), Path: path, Options: options}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
+
+		case "Directory":
+
+			//
+			// We should have one argument to Directory:
+			//
+			//  1. IDENT or STRING
+			//
+			// (Here the argument is the remote path.)
+			//
+			// It may be followed by the options "mode" and
+			// "owner".
+			//
+			path, err := p.getArgument(1, "IDENT", "STRING")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			options := p.getOptions()
+			if !p.checkOptions(tok, options, "mode", "owner") {
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.DirectoryStatement{Base: p.base(tok), Path: path, Options: options}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
+
+		case "Download":
+
+			//
+			// We should have two arguments to Download:
+			//
+			//  1. IDENT or STRING
+			//  2. IDENT or STRING
+			//
+			// (Here the arguments are the URL, and the remote
+			// path.)
+			//
+			// They may be followed by the options "sha256" and
+			// "mode".
+			//
+			url, err := p.getArgument(1, "IDENT", "STRING")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+			dst, err := p.getArgument(2, "IDENT", "STRING")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			options := p.getOptions()
+			if !p.checkOptions(tok, options, "sha256", "mode") {
+				continue
+			}
+			if sum, ok := ast.Option(options, "sha256"); ok && !strings.Contains(sum, "${") && !checksumRE.MatchString(sum) {
+				p.errorf(ast.Position{Line: url.Line, Column: url.Column}, "option 'sha256' must be 64 hexadecimal characters")
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.DownloadStatement{Base: p.base(tok), URL: url, Destination: dst, Options: options}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
+
+		case "Fetch":
+
+			//
+			// We should have two arguments to Fetch:
+			//
+			//  1. IDENT
+			//  2. IDENT
+			//
+			// (Here IDENT means "path".)
+			//
+			expected := []token.Token{
+				{Type: "IDENT"},
+				{Type: "IDENT"},
+			}
+
+			//
+			// Get the arguments, validating types.
+			//
+			args, err := p.GetArguments(expected)
+
+			//
+			// Error?
+			//
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.FetchStatement{Base: p.base(tok), Source: args[0], Destination: args[1]}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
+
+		case "Group":
+
+			//
+			// We should have one argument to Group:
+			//
+			//  1. IDENT
+			//
+			// (Here IDENT means "name".)
+			//
+			// It may be followed by the option "system".
+			//
+			name, err := p.getArgument(1, "IDENT")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			options := p.getOptions()
+			if !p.checkOptions(tok, options, "system") {
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.GroupStatement{Base: p.base(tok), Name: name, Options: options}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
+
+		case "LineInFile":
+
+			//
+			// We should have one argument to LineInFile:
+			//
+			//  1. IDENT or STRING
+			//
+			// (Here the argument is the remote path.)
+			//
+			// It must be followed by the option "line", and may
+			// be followed by the option "regexp".
+			//
+			path, err := p.getArgument(1, "IDENT", "STRING")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			options := p.getOptions()
+			if !p.checkOptions(tok, options, "regexp", "line") {
+				continue
+			}
+			if _, ok := ast.Option(options, "line"); !ok {
+				p.errorf(ast.Position{Line: path.Line, Column: path.Column}, "LineInFile requires the option 'line'")
+				continue
+			}
+			if re, ok := ast.Option(options, "regexp"); ok {
+				if _, err := regexp.Compile(re); err != nil {
+					p.errorf(ast.Position{Line: path.Line, Column: path.Column}, "invalid regexp for LineInFile: %s", err.Error())
+					continue
+				}
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.LineInFileStatement{Base: p.base(tok), Path: path, Options: options}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
+
+		case "Local":
+
+			//
+			// We should have one argument to Local:
+			//
+			//  1. STRING
+			//
+			// (Here STRING means "command".)
+			//
+			// It may be followed by the option "set", naming
+			// the variable to store its output in.
+			//
+			command, err := p.getArgument(1, "STRING")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			options := p.getOptions()
+			if !p.checkOptions(tok, options, "set") {
+				continue
+			}
+			if name, ok := ast.Option(options, "set"); ok && name == "" {
+				p.errorf(ast.Position{Line: options[0].Line, Column: options[0].Column}, "option 'set' requires the name of a variable")
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.LocalStatement{Base: p.base(tok), Command: command, Options: options}
+
+			//
+			// Preserve the Timeout state
+			//
+			s.Timeout = timeout
+			timeout = 0
+
+			p.add(s)
+
+		case "Package":
+
+			//
+			// We should have at least one argument to Package:
+			//
+			//  1. IDENT
+			//
+			// (Here IDENT means "name".)
+			//
+			// Any number of further names may follow, and then
+			// the option "state".
+			//
+			name, err := p.getArgument(1, "IDENT")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+			if strings.Contains(name.Literal, "=") {
+				p.fail(tok, fmt.Errorf("expected the name of a package as argument 1 - Got option '%s'", name.Literal))
+				continue
+			}
+
+			names := []token.Token{name}
+			for {
+				next := p.nextToken()
+				if next.Type != "IDENT" || strings.Contains(next.Literal, "=") {
+					p.unreadToken(next)
+					break
+				}
+				names = append(names, next)
+			}
+
+			options := p.getOptions()
+			if !p.checkOptions(tok, options, "state") {
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.PackageStatement{Base: p.base(tok), Names: names, Options: options}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
+
+		case "Remove":
+
+			//
+			// We should have one argument to Remove:
+			//
+			//  1. IDENT or STRING
+			//
+			// (Here the argument is the remote path.)
+			//
+			path, err := p.getArgument(1, "IDENT", "STRING")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.RemoveStatement{Base: p.base(tok), Path: path}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
+
+		case "RunScript":
+
+			//
+			// We should have at least one argument to RunScript:
+			//
+			//  1. IDENT
+			//
+			// (Here IDENT means "path".)
+			//
+			// Any number of STRING arguments may follow, to be
+			// passed to the script, and then any options.
+			//
+			script, err := p.getArgument(1, "IDENT")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			var args []token.Token
+			for {
+				next := p.nextToken()
+				if next.Type != "STRING" {
+					p.unreadToken(next)
+					break
+				}
+				args = append(args, next)
+			}
+
+			options := p.getOptions()
+			if !p.checkOptions(tok, options, "interpreter", "template") {
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.RunScriptStatement{Base: p.base(tok), Script: script, Args: args, Options: options}
+
+			//
+			// Preserve the SUDO + Timeout state
+			//
+			s.Sudo, s.SudoUser, s.Timeout = sudo, sudoUser, timeout
+			sudo = false
+			sudoUser = ""
+			timeout = 0
+
+			p.add(s)
+
+		case "Service":
+
+			//
+			// We should have one argument to Service:
+			//
+			//  1. IDENT
+			//
+			// (Here IDENT means "name".)
+			//
+			// It must be followed by at least one of the options
+			// "state" and "enabled".
+			//
+			name, err := p.getArgument(1, "IDENT")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			options := p.getOptions()
+			if !p.checkOptions(tok, options, "state", "enabled") {
+				continue
+			}
+			if len(options) < 1 {
+				p.errorf(ast.Position{Line: name.Line, Column: name.Column}, "Service requires the option 'state' or 'enabled'")
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.ServiceStatement{Base: p.base(tok), Name: name, Options: options}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
+
+		case "Symlink":
+
+			//
+			// We should have two arguments to Symlink:
+			//
+			//  1. IDENT or STRING
+			//  2. IDENT or STRING
+			//
+			// (Here the arguments are the target, and the remote
+			// path of the link.)
+			//
+			target, err := p.getArgument(1, "IDENT", "STRING")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+			link, err := p.getArgument(2, "IDENT", "STRING")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.SymlinkStatement{Base: p.base(tok), Target: target, Link: link}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
+
+		case "User":
+
+			//
+			// We should have one argument to User:
+			//
+			//  1. IDENT
+			//
+			// (Here IDENT means "name".)
+			//
+			// It may be followed by the options "home", "shell",
+			// "system", and "groups".
+			//
+			name, err := p.getArgument(1, "IDENT")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			options := p.getOptions()
+			if !p.checkOptions(tok, options, "home", "shell", "system", "groups") {
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.UserStatement{Base: p.base(tok), Name: name, Options: options}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
+
+		case "WriteFile":
+
+			//
+			// We should have two arguments to WriteFile:
+			//
+			//  1. IDENT or STRING
+			//  2. STRING
+			//
+			// (Here the first argument is the remote path, which
+			// may be quoted, and the second the content.)
+			//
+			dst, err := p.getArgument(1, "IDENT", "STRING")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+			content, err := p.getArgument(2, "STRING")
+			if err != nil {
+				p.fail(tok, err)
+				continue
+			}
+
+			//
+			// Otherwise we can store this statement.
+			//
+			s := &ast.WriteFileStatement{Base: p.base(tok), Destination: dst, Content: content}
+
+			//
+			// Preserve the SUDO state
+			//
+			s.Sudo, s.SudoUser = sudo, sudoUser
+			sudo = false
+			sudoUser = ""
+
+			p.add(s)
+
+		case "End":
+
+			//
+			// Close the innermost "Become" block.
+			//
+			if len(p.become) < 1 {
+				p.fail(tok, fmt.Errorf("found 'End' without a matching 'Become'"))
+				continue
+			}
+			block := p.become[len(p.become)-1]
+			p.become = p.become[:len(p.become)-1]
+
+			block.End = p.base(tok)
+			p.last = &block.End
+
+		case "EOF":
+
+			//
+			// Ensure all our blocks were closed.  There's
+			// nothing left to skip, so we just record the
+			// errors.
+			//
+			for _, block := range p.become {
+				p.errorf(block.Pos(), "missing 'End' for 'Become %s'", block.User.Literal)
+			}
+			p.become = nil
+
+			//
+			// Any remaining comments are attached to nothing.
+			//
+			result.Comments = p.takeComments()
+
+			//
+			// This causes our parsing-loop to terminate.
+			//
+			run = false
+		default:
+
+			//
+			// If we hit this point there is a token-type we
+			// did not handle.
+			//
+			p.fail(tok, fmt.Errorf("unhandled statement - %v", tok))
+
+		}
+	}
+	if len(p.errors) > 0 {
+		return result, p.errors
+	}
+	return result, nil
+}
+
+// Warning is a non-fatal problem found while parsing.
+type Warning struct {
+	// Pos is the position of the statement the problem was found in.
+	Pos ast.Position
+
+	// Message describes the problem.
+	Message string
+}
+
+// String converts a warning to a human-readable form.
+func (w Warning) String() string {
+	if !w.Pos.IsValid() {
+		return w.Message
+	}
+	return fmt.Sprintf("%s: %s", w.Pos, w.Message)
+}
+
+// Warnings returns any non-fatal problems which were found while parsing,
+// such as prefixes which had no effect.
+func (p *Parser) Warnings() []Warning {
+	return p.warnings
+}
+
+// Error is a problem found while parsing.
+type Error struct {
+	// Pos is the position at which the problem was found.
+	Pos ast.Position
+
+	// Message describes the problem.
+	Message string
+}
+
+// Error converts an error to a human-readable form.
+func (e *Error) Error() string {
+	if !e.Pos.IsValid() {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Pos, e.Message)
+}
+
+// ErrorList holds all the errors found while parsing, in the order they
+// were found.
+//
+// Parse returns an ErrorList as its error, so callers may report each
+// problem rather than only the first.
+type ErrorList []*Error
+
+// Error returns the first error, along with a count of any others.
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+// warnf records a non-fatal problem with the statement introduced by
+// the given token.
+func (p *Parser) warnf(tok token.Token, format string, a ...interface{}) {
+	p.warnings = append(p.warnings, Warning{
+		Pos:     ast.Position{Line: tok.Line, Column: tok.Column},
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+// errorf records an error found at the given position.
+func (p *Parser) errorf(pos ast.Position, format string, a ...interface{}) {
+	p.errors = append(p.errors, &Error{Pos: pos, Message: fmt.Sprintf(format, a...)})
+}
+
+// fail records an error found while parsing the statement introduced by
+// the given token, at the position of the last token read.
+//
+// Tokens are then skipped until the next keyword, so that we may carry
+// on parsing and report any further errors in one pass.
+func (p *Parser) fail(start token.Token, err error) {
+	p.errorf(ast.Position{Line: p.current.Line, Column: p.current.Column}, "%s", err.Error())
+
+	next := p.current
+	if next == start {
+		next = p.nextToken()
+	}
+	for next.Type != token.EOF && !isKeyword(next) {
+		next = p.nextToken()
+	}
+	p.unreadToken(next)
+}
+
+// checksumRE matches a SHA256 checksum.
+var checksumRE = regexp.MustCompile("^[0-9a-fA-F]{64}$")
+
+// isKeyword returns true if the given token is a keyword, which begins
+// a statement.
+func isKeyword(tok token.Token) bool {
+	return token.LookupIdentifier(string(tok.Type)) == tok.Type && tok.Type != token.IDENT
+}
+
+// prefixApplies returns true if the given prefix, "Sudo" or "Timeout",
+// applies to the statement of the given type.
+//
+// Prefixes may be combined, so each applies to the other.
+func prefixApplies(prefix token.Type, statement token.Type) bool {
+	switch statement {
+	case token.RUN, token.IFCHANGED, token.RUNSCRIPT, token.SUDO, token.TIMEOUT:
+		return true
+	case token.BLOCKINFILE, token.COPYFILE, token.COPYTEMPLATE, token.DIRECTORY, token.DOWNLOAD, token.FETCH, token.GROUP, token.LINEINFILE:
+		return prefix == token.SUDO
+	case token.PACKAGE, token.REMOVE, token.SERVICE, token.SYMLINK, token.USER, token.WRITEFILE:
+		return prefix == token.SUDO
+	case token.LOCAL:
+		return prefix == token.TIMEOUT
+	}
+	return false
+}
+
+// base returns the fields common to all statements, for a statement
+// introduced by the given keyword.
+//
+// Any comments read since the previous statement are attached to it.
+func (p *Parser) base(tok token.Token) ast.Base {
+	start := p.prefix
+	if !start.IsValid() {
+		start = ast.Position{Line: tok.Line, Column: tok.Column}
+	}
+	p.prefix = ast.Position{}
+
+	return ast.Base{Token: tok, Start: start, Doc: p.takeComments()}
+}
+
+// startPrefix records the position of the given prefix, if it is the
+// first to precede the next statement.
+func (p *Parser) startPrefix(tok token.Token) {
+	if !p.prefix.IsValid() {
+		p.prefix = ast.Position{Line: tok.Line, Column: tok.Column}
+	}
+}
+
+// add stores a completed statement, either within the innermost open
+// "Become" block or at the top-level of our program.
+func (p *Parser) add(s ast.Statement) {
+	if len(p.become) > 0 {
+		block := p.become[len(p.become)-1]
+		block.Body = append(block.Body, s)
+	} else {
+		p.program.Statements = append(p.program.Statements, s)
+	}
+	p.last = s.Common()
+}
+
+// takeComments returns the comments which have not yet been attached to
+// a statement, and forgets them.
+func (p *Parser) takeComments() []token.Token {
+	comments := p.comments
+	p.comments = nil
+	return comments
+}
+
+// nextToken returns the next token, either one which was previously
+// pushed back or the next from our tokenizer.
+//
+// Comments are not returned, if our tokenizer produces them, instead
+// they're stored to be attached to a statement.
+func (p *Parser) nextToken() token.Token {
+	var tok token.Token
+	var comments []token.Token
+
+	if len(p.pending) > 0 {
+		tok = p.pending[len(p.pending)-1]
+		comments = p.held[len(p.held)-1]
+		p.pending = p.pending[:len(p.pending)-1]
+		p.held = p.held[:len(p.held)-1]
+	} else {
+		tok = p.Tokenizer.NextToken()
+		for tok.Type == token.COMMENT {
+			comments = append(comments, tok)
+			tok = p.Tokenizer.NextToken()
+		}
+	}
+
+	for _, comment := range comments {
+
+		//
+		// A comment upon the same line as the end of the previous
+		// statement belongs to it.
+		//
+		if p.last != nil && p.last.Comment == nil && len(p.comments) == 0 && comment.Line == p.lastLine {
+			comment := comment
+			p.last.Comment = &comment
+		} else {
+			p.comments = append(p.comments, comment)
+		}
+	}
+
+	p.recent, p.recentLine = comments, p.lastLine
+	p.lastLine = tok.Line + strings.Count(tok.Raw, "\n")
+	p.current = tok
+	return tok
+}
+
+// unreadToken pushes back a token, such that it will be returned by
+// the next call to nextToken.
+//
+// The token must be the last one we read.  The comments which preceded
+// it are pushed back too, so that when we read ahead, for options, they
+// are attached to the following statement rather than the current one.
+func (p *Parser) unreadToken(tok token.Token) {
+	for i := len(p.recent) - 1; i >= 0; i-- {
+		comment := p.recent[i]
+		if n := len(p.comments); n > 0 && p.comments[n-1] == comment {
+			p.comments = p.comments[:n-1]
+		} else if p.last != nil && p.last.Comment != nil && *p.last.Comment == comment {
+			p.last.Comment = nil
+		}
+	}
+
+	p.pending = append(p.pending, tok)
+	p.held = append(p.held, p.recent)
+	p.lastLine = p.recentLine
+	p.recent = nil
+}
+
+// GetArguments fetches arguments from the lexer, ensuring they're
+// the expected types.
+func (p *Parser) GetArguments(expected []token.Token) ([]token.Token, error) {
+	var ret []token.Token
+
+	for i, arg := range expected {
+
+		next := p.nextToken()
+		if next.Type != arg.Type {
+			return nil, fmt.Errorf("expected %v as argument %d - Got %v", arg.Type, i+1, next.Type)
+		}
+
+		ret = append(ret, next)
+
+	}
+	return ret, nil
+}
+
+// getArgument fetches a single argument from the lexer, ensuring it is
+// one of the expected types.
+//
+// The number of the argument is used to report errors.
+func (p *Parser) getArgument(n int, types ...token.Type) (token.Token, error) {
+	next := p.nextToken()
+	for _, t := range types {
+		if next.Type == t {
+			return next, nil
+		}
+	}
+
+	var names []string
+	for _, t := range types {
+		names = append(names, string(t))
+	}
+	return next, fmt.Errorf("expected %s as argument %d - Got %v", strings.Join(names, " or "), n, next.Type)
+}
+
+// getOptions fetches any options from the lexer, which follow the
+// arguments of a statement.
+//
+// Options are written as "name=value".  If the value is a string, as in
+// name="a value", the name and the string are merged into one token.
+func (p *Parser) getOptions() []token.Token {
+	var options []token.Token
+
+	for {
+		next := p.nextToken()
+		if next.Type != "IDENT" || !strings.Contains(next.Literal, "=") {
+			p.unreadToken(next)
+			return options
+		}
+
+		if strings.HasSuffix(next.Literal, "=") {
+			value := p.nextToken()
+			if value.Type == "STRING" {
+				next.Literal += value.Literal
+				next.Raw += value.Raw
+			} else {
+				p.unreadToken(value)
+			}
+		}
+		options = append(options, next)
+	}
+}
+
+// checkOptions ensures that the given options, of the statement
+// introduced by the given token, are amongst those allowed and are
+// not repeated.
+//
+// Errors are recorded against the option, and false returned.
+func (p *Parser) checkOptions(tok token.Token, options []token.Token, allowed ...string) bool {
+	valid := true
+	seen := make(map[string]bool)
+
+	for _, opt := range options {
+		name, _ := ast.SplitOption(opt)
+		pos := ast.Position{Line: opt.Line, Column: opt.Column}
+
+		known := false
+		for _, a := range allowed {
+			if name == a {
+				known = true
+			}
+		}
+
+		switch {
+		case !known:
+			p.errorf(pos, "unknown option '%s' for '%s' - expected %s", name, tok.Literal, strings.Join(allowed, ", "))
+			valid = false
+		case seen[name]:
+			p.errorf(pos, "option '%s' given more than once", name)
+			valid = false
+		}
+		seen[name] = true
+	}
+	return valid
 }
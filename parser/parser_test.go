@@ -10,7 +10,9 @@ package parser
 import (
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/skx/deployr/ast"
 	"github.com/skx/deployr/token"
 )
 
@@ -38,6 +40,17 @@ func (f *FakeLexer) NextToken() token.Token {
 	return t
 }
 
+//
+// prefixes returns the prefixes of the given statement, which are empty
+// if it can't have any.
+//
+func prefixes(s ast.Statement) ast.Prefix {
+	if p, ok := s.(ast.Prefixed); ok {
+		return p.Prefixes()
+	}
+	return ast.Prefix{}
+}
+
 // TestEOF just runs a basic sanity-check
 func TestEOF(t *testing.T) {
 
@@ -59,7 +72,7 @@ func TestEOF(t *testing.T) {
 		t.Fatalf("Found unexpected error parsing: %s\n", err.Error())
 	}
 
-	if len(program) != 0 {
+	if len(program.Statements) != 0 {
 		t.Fatalf("Unexpected length\n")
 	}
 }
@@ -108,14 +121,14 @@ func testSingleArgument(t *testing.T, tokenName token.Type, validType token.Type
 	//
 	// We expect our statement to be "DeployTo" with the argument
 	// pointing to example.com
-	if program[0].Token.Type != tokenName {
-		t.Fatalf("Unexpected statement-type : %s\n", program[0].Token.Type)
+	if program.Statements[0].Keyword().Type != tokenName {
+		t.Fatalf("Unexpected statement-type : %s\n", program.Statements[0].Keyword().Type)
 	}
-	if len(program[0].Arguments) != 1 {
-		t.Fatalf("Unexpected argument length - got %d\n", len(program[0].Arguments))
+	if len(program.Statements[0].Arguments()) != 1 {
+		t.Fatalf("Unexpected argument length - got %d\n", len(program.Statements[0].Arguments()))
 	}
-	if program[0].Arguments[0].Literal != "My argument here" {
-		t.Fatalf("Unexpected argument: %s\n", program[0].Arguments[0].Literal)
+	if program.Statements[0].Arguments()[0].Literal != "My argument here" {
+		t.Fatalf("Unexpected argument: %s\n", program.Statements[0].Arguments()[0].Literal)
 	}
 
 	// Parse the invalid program
@@ -143,25 +156,69 @@ func TestDeployTo(t *testing.T) {
 	testSingleArgument(t, "DeployTo", "IDENT", "STRING")
 }
 
+// TestEnv tests "Env" handling.
+func TestEnv(t *testing.T) {
+	testSingleArgument(t, "Env", "IDENT", "STRING")
+}
+
 // TestIfChanged tests "IfChanged" handling.
 func TestIfChanged(t *testing.T) {
 	testSingleArgument(t, "IfChanged", "STRING", "IDENT")
 }
 
-// TestCopy tests our two copy operations.
+// TestLoadSecrets tests "LoadSecrets" handling.
+func TestLoadSecrets(t *testing.T) {
+	testSingleArgument(t, "LoadSecrets", "STRING", "IDENT")
+}
+
+// TestSecret tests "Secret" handling, which matches "Set".
+func TestSecret(t *testing.T) {
+
+	valid := []token.Token{
+		{Type: "Secret", Literal: "Secret"},
+		{Type: "IDENT", Literal: "API_KEY"},
+		{Type: "STRING", Literal: "s3cr3t"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	p := New(NewFakeLexer(valid))
+	program, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Received unexpected error parsing: %s\n", err.Error())
+	}
+	if len(program.Statements) != 1 || len(program.Statements[0].Arguments()) != 2 {
+		t.Fatalf("Unexpected program: %v\n", program)
+	}
+
+	bogus := []token.Token{
+		{Type: "Secret", Literal: "Secret"},
+		{Type: "STRING", Literal: "API_KEY"},
+		{Type: "STRING", Literal: "s3cr3t"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	p = New(NewFakeLexer(bogus))
+	_, err = p.Parse()
+	if err == nil {
+		t.Fatalf("Expected to receive an error, got none")
+	}
+}
+
+// TestCopy tests our two copy operations, and "Fetch" which takes the
+// same arguments.
 //
-// We call first of all with two IDENTS, which is valid.  Then try two
-// bogus versions calling with:
+// We call first of all with two IDENTS, and "Sudo", which is valid.  Then
+// try two bogus versions calling with:
 //   STRING IDENT
 //   IDENT  STRING
 // This should ensure that the argument testing is exercised.
 func TestCopy(t *testing.T) {
 
 	//
-	// We'll repeat our tests with both "CopyFile" and
-	// "CopyTemplate"
+	// We'll repeat our tests with "CopyFile", "CopyTemplate",
+	// and "Fetch".
 	//
-	terms := []token.Type{"CopyFile", "CopyTemplate"}
+	terms := []token.Type{"CopyFile", "CopyTemplate", "Fetch"}
 
 	for _, term := range terms {
 
@@ -169,6 +226,7 @@ func TestCopy(t *testing.T) {
 		// A program which is valid.
 		//
 		valid := []token.Token{
+			{Type: "Sudo", Literal: "Sudo"},
 			{Type: term, Literal: string(term)},
 			{Type: "IDENT", Literal: "/path/to/src"},
 			{Type: "IDENT", Literal: "/path/to/dst"},
@@ -185,11 +243,14 @@ func TestCopy(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Received unexpected error parsing: %s\n", err.Error())
 		}
-		if len(program) != 1 {
-			t.Fatalf("Our program should have one statement - found %d\n", len(program))
+		if len(program.Statements) != 1 {
+			t.Fatalf("Our program should have one statement - found %d\n", len(program.Statements))
 		}
-		if len(program[0].Arguments) != 2 {
-			t.Fatalf("Our statement should have two arguments - found %d\n", len(program[0].Arguments))
+		if len(program.Statements[0].Arguments()) != 2 {
+			t.Fatalf("Our statement should have two arguments - found %d\n", len(program.Statements[0].Arguments()))
+		}
+		if !prefixes(program.Statements[0]).Sudo || len(pv.Warnings()) != 0 {
+			t.Fatalf("Our statement should honour sudo %v", pv.Warnings())
 		}
 
 		//
@@ -245,6 +306,531 @@ func TestCopy(t *testing.T) {
 	}
 }
 
+// TestWriteFile tests "WriteFile" handling, which accepts a quoted or
+// unquoted path, and honours "Sudo".
+func TestWriteFile(t *testing.T) {
+
+	for _, pathType := range []token.Type{"IDENT", "STRING"} {
+
+		valid := []token.Token{
+			{Type: "Sudo", Literal: "Sudo"},
+			{Type: "WriteFile", Literal: "WriteFile"},
+			{Type: pathType, Literal: "/etc/app/env"},
+			{Type: "STRING", Literal: "NAME=${name}\n"},
+			{Type: "EOF", Literal: "EOF"},
+		}
+
+		p := New(NewFakeLexer(valid))
+		program, err := p.Parse()
+		if err != nil {
+			t.Fatalf("Received unexpected error parsing: %s\n", err.Error())
+		}
+		if len(program.Statements) != 1 {
+			t.Fatalf("Our program should have one statement - found %d\n", len(program.Statements))
+		}
+		args := program.Statements[0].Arguments()
+		if len(args) != 2 || args[0].Literal != "/etc/app/env" || args[1].Literal != "NAME=${name}\n" {
+			t.Fatalf("Unexpected arguments %v\n", args)
+		}
+		if !prefixes(program.Statements[0]).Sudo {
+			t.Fatalf("Expected sudo to be set")
+		}
+		if len(p.Warnings()) != 0 {
+			t.Fatalf("Unexpected warnings %v", p.Warnings())
+		}
+	}
+
+	bogus := [][]token.Token{
+		{
+			{Type: "WriteFile", Literal: "WriteFile"},
+			{Type: "Run", Literal: "Run"},
+			{Type: "STRING", Literal: "content"},
+			{Type: "EOF", Literal: "EOF"},
+		},
+		{
+			{Type: "WriteFile", Literal: "WriteFile"},
+			{Type: "IDENT", Literal: "/etc/app/env"},
+			{Type: "IDENT", Literal: "content"},
+			{Type: "EOF", Literal: "EOF"},
+		},
+	}
+	errors := []string{
+		"expected IDENT or STRING as argument 1 - Got Run",
+		"expected STRING as argument 2 - Got IDENT",
+	}
+
+	for i, toks := range bogus {
+		_, err := New(NewFakeLexer(toks)).Parse()
+		if err == nil {
+			t.Fatalf("Expected to receive an error, got none")
+		}
+		if !strings.Contains(err.Error(), errors[i]) {
+			t.Fatalf("Our error was misleading: %s", err.Error())
+		}
+	}
+}
+
+// TestRunScript tests "RunScript" handling, with arguments and options.
+func TestRunScript(t *testing.T) {
+
+	valid := []token.Token{
+		{Type: "Timeout", Literal: "Timeout"},
+		{Type: "IDENT", Literal: "5m"},
+		{Type: "RunScript", Literal: "RunScript"},
+		{Type: "IDENT", Literal: "setup.sh"},
+		{Type: "STRING", Literal: "one"},
+		{Type: "STRING", Literal: "two"},
+		{Type: "IDENT", Literal: "interpreter=", Raw: "interpreter="},
+		{Type: "STRING", Literal: "/usr/bin/env bash", Raw: "\"/usr/bin/env bash\""},
+		{Type: "IDENT", Literal: "template=true", Raw: "template=true"},
+		{Type: "Run", Literal: "Run"},
+		{Type: "STRING", Literal: "id"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	p := New(NewFakeLexer(valid))
+	program, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Received unexpected error parsing: %s\n", err.Error())
+	}
+	if len(program.Statements) != 2 {
+		t.Fatalf("Our program should have two statements - found %d\n", len(program.Statements))
+	}
+
+	s, ok := program.Statements[0].(*ast.RunScriptStatement)
+	if !ok {
+		t.Fatalf("Unexpected statement %v", program.Statements[0])
+	}
+	if len(s.Args) != 2 || s.Args[1].Literal != "two" {
+		t.Fatalf("Unexpected arguments %v", s.Args)
+	}
+	if interpreter, _ := ast.Option(s.Options, "interpreter"); interpreter != "/usr/bin/env bash" {
+		t.Fatalf("Unexpected interpreter '%s'", interpreter)
+	}
+	if s.Timeout != 5*time.Minute {
+		t.Fatalf("Expected the timeout to apply")
+	}
+	if s.String() != `Timeout 5m RunScript setup.sh "one" "two" interpreter="/usr/bin/env bash" template=true` {
+		t.Fatalf("Unexpected source-form %s", s.String())
+	}
+
+	//
+	// Unknown and repeated options are errors.
+	//
+	bogus := []token.Token{
+		{Type: "RunScript", Literal: "RunScript"},
+		{Type: "IDENT", Literal: "setup.sh"},
+		{Type: "IDENT", Literal: "user=bob"},
+		{Type: "IDENT", Literal: "template=true"},
+		{Type: "IDENT", Literal: "template=false"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	_, err = New(NewFakeLexer(bogus)).Parse()
+	list, ok := err.(ErrorList)
+	if !ok || len(list) != 2 {
+		t.Fatalf("Expected two errors, got %v", err)
+	}
+	if list[0].Message != "unknown option 'user' for 'RunScript' - expected interpreter, template" {
+		t.Fatalf("Our error was misleading: %s", list[0])
+	}
+	if list[1].Message != "option 'template' given more than once" {
+		t.Fatalf("Our error was misleading: %s", list[1])
+	}
+}
+
+// TestLocal tests "Local" handling, which honours "Timeout" but not
+// "Sudo".
+func TestLocal(t *testing.T) {
+
+	valid := []token.Token{
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "Timeout", Literal: "Timeout"},
+		{Type: "IDENT", Literal: "1m"},
+		{Type: "Local", Literal: "Local"},
+		{Type: "STRING", Literal: "git describe"},
+		{Type: "IDENT", Literal: "set=VERSION"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	p := New(NewFakeLexer(valid))
+	program, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Received unexpected error parsing: %s\n", err.Error())
+	}
+
+	s, ok := program.Statements[0].(*ast.LocalStatement)
+	if !ok {
+		t.Fatalf("Unexpected statement %v", program.Statements[0])
+	}
+	if name, _ := ast.Option(s.Options, "set"); name != "VERSION" {
+		t.Fatalf("Unexpected variable '%s'", name)
+	}
+	if s.Timeout != time.Minute {
+		t.Fatalf("Expected the timeout to apply")
+	}
+	if len(p.Warnings()) != 1 || !strings.Contains(p.Warnings()[0].String(), "'Sudo' has no effect on 'Local'") {
+		t.Fatalf("Unexpected warnings %v", p.Warnings())
+	}
+
+	bogus := []token.Token{
+		{Type: "Local", Literal: "Local"},
+		{Type: "STRING", Literal: "git describe"},
+		{Type: "IDENT", Literal: "set="},
+		{Type: "EOF", Literal: "EOF"},
+	}
+	_, err = New(NewFakeLexer(bogus)).Parse()
+	if err == nil || !strings.Contains(err.Error(), "requires the name of a variable") {
+		t.Fatalf("Expected an error for an empty variable name, got %v", err)
+	}
+}
+
+// TestPackage tests parsing of the Package primitive.
+func TestPackage(t *testing.T) {
+
+	valid := []token.Token{
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "Package", Literal: "Package"},
+		{Type: "IDENT", Literal: "nginx"},
+		{Type: "IDENT", Literal: "curl"},
+		{Type: "IDENT", Literal: "state=latest"},
+		{Type: "Run", Literal: "Run"},
+		{Type: "STRING", Literal: "uptime"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	program, err := New(NewFakeLexer(valid)).Parse()
+	if err != nil {
+		t.Fatalf("Received unexpected error parsing: %s\n", err.Error())
+	}
+	if len(program.Statements) != 2 {
+		t.Fatalf("Unexpected statements %v", program.Statements)
+	}
+
+	s, ok := program.Statements[0].(*ast.PackageStatement)
+	if !ok {
+		t.Fatalf("Unexpected statement %v", program.Statements[0])
+	}
+	if len(s.Names) != 2 || !s.Sudo {
+		t.Fatalf("Unexpected statement %v", s)
+	}
+	if s.String() != "Sudo Package nginx curl state=latest" {
+		t.Fatalf("Unexpected source %s", s.String())
+	}
+
+	bogus := [][]token.Token{
+		{
+			{Type: "Package", Literal: "Package"},
+			{Type: "EOF", Literal: "EOF"},
+		},
+		{
+			{Type: "Package", Literal: "Package"},
+			{Type: "IDENT", Literal: "state=present"},
+			{Type: "EOF", Literal: "EOF"},
+		},
+		{
+			{Type: "Package", Literal: "Package"},
+			{Type: "IDENT", Literal: "nginx"},
+			{Type: "IDENT", Literal: "version=1.2"},
+			{Type: "EOF", Literal: "EOF"},
+		},
+	}
+	for _, toks := range bogus {
+		_, err = New(NewFakeLexer(toks)).Parse()
+		if err == nil {
+			t.Fatalf("Expected an error parsing %v", toks)
+		}
+	}
+}
+
+// TestService tests parsing of the Service primitive.
+func TestService(t *testing.T) {
+
+	valid := []token.Token{
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "Service", Literal: "Service"},
+		{Type: "IDENT", Literal: "overseer-worker"},
+		{Type: "IDENT", Literal: "state=running"},
+		{Type: "IDENT", Literal: "enabled=true"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	program, err := New(NewFakeLexer(valid)).Parse()
+	if err != nil {
+		t.Fatalf("Received unexpected error parsing: %s\n", err.Error())
+	}
+
+	s, ok := program.Statements[0].(*ast.ServiceStatement)
+	if !ok {
+		t.Fatalf("Unexpected statement %v", program.Statements[0])
+	}
+	if s.Name.Literal != "overseer-worker" || !s.Sudo {
+		t.Fatalf("Unexpected statement %v", s)
+	}
+	if state, _ := ast.Option(s.Options, "state"); state != "running" {
+		t.Fatalf("Unexpected state '%s'", state)
+	}
+	if s.String() != "Sudo Service overseer-worker state=running enabled=true" {
+		t.Fatalf("Unexpected source %s", s.String())
+	}
+
+	bogus := [][]token.Token{
+		{
+			{Type: "Service", Literal: "Service"},
+			{Type: "IDENT", Literal: "nginx"},
+			{Type: "EOF", Literal: "EOF"},
+		},
+		{
+			{Type: "Service", Literal: "Service"},
+			{Type: "IDENT", Literal: "nginx"},
+			{Type: "IDENT", Literal: "running=true"},
+			{Type: "EOF", Literal: "EOF"},
+		},
+	}
+	for _, toks := range bogus {
+		_, err = New(NewFakeLexer(toks)).Parse()
+		if err == nil {
+			t.Fatalf("Expected an error parsing %v", toks)
+		}
+	}
+}
+
+// TestAccounts tests parsing of the User and Group primitives.
+func TestAccounts(t *testing.T) {
+
+	valid := []token.Token{
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "Group", Literal: "Group"},
+		{Type: "IDENT", Literal: "app"},
+		{Type: "IDENT", Literal: "system=true"},
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "User", Literal: "User"},
+		{Type: "IDENT", Literal: "app"},
+		{Type: "IDENT", Literal: "home=/opt/app"},
+		{Type: "IDENT", Literal: "shell=/usr/sbin/nologin"},
+		{Type: "IDENT", Literal: "groups=adm"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	program, err := New(NewFakeLexer(valid)).Parse()
+	if err != nil {
+		t.Fatalf("Received unexpected error parsing: %s\n", err.Error())
+	}
+	if len(program.Statements) != 2 {
+		t.Fatalf("Unexpected statements %v", program.Statements)
+	}
+
+	g, ok := program.Statements[0].(*ast.GroupStatement)
+	if !ok || !g.Sudo || g.Name.Literal != "app" {
+		t.Fatalf("Unexpected statement %v", program.Statements[0])
+	}
+	u, ok := program.Statements[1].(*ast.UserStatement)
+	if !ok || !u.Sudo {
+		t.Fatalf("Unexpected statement %v", program.Statements[1])
+	}
+	if home, _ := ast.Option(u.Options, "home"); home != "/opt/app" {
+		t.Fatalf("Unexpected home '%s'", home)
+	}
+
+	bogus := []token.Token{
+		{Type: "User", Literal: "User"},
+		{Type: "IDENT", Literal: "app"},
+		{Type: "IDENT", Literal: "uid=1000"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+	_, err = New(NewFakeLexer(bogus)).Parse()
+	if err == nil || !strings.Contains(err.Error(), "unknown option 'uid'") {
+		t.Fatalf("Expected an error for an unknown option, got %v", err)
+	}
+}
+
+// TestEdits tests parsing of the LineInFile and BlockInFile primitives.
+func TestEdits(t *testing.T) {
+
+	valid := []token.Token{
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "LineInFile", Literal: "LineInFile"},
+		{Type: "IDENT", Literal: "/etc/ssh/sshd_config"},
+		{Type: "IDENT", Literal: "regexp=^#?PermitRootLogin"},
+		{Type: "IDENT", Literal: "line=PermitRootLogin no"},
+		{Type: "BlockInFile", Literal: "BlockInFile"},
+		{Type: "STRING", Literal: "/etc/hosts"},
+		{Type: "IDENT", Literal: "marker=app"},
+		{Type: "IDENT", Literal: "content=10.0.0.1 db"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	program, err := New(NewFakeLexer(valid)).Parse()
+	if err != nil {
+		t.Fatalf("Received unexpected error parsing: %s\n", err.Error())
+	}
+	if len(program.Statements) != 2 {
+		t.Fatalf("Unexpected statements %v", program.Statements)
+	}
+
+	l, ok := program.Statements[0].(*ast.LineInFileStatement)
+	if !ok || !l.Sudo || l.Path.Literal != "/etc/ssh/sshd_config" {
+		t.Fatalf("Unexpected statement %v", program.Statements[0])
+	}
+	if line, _ := ast.Option(l.Options, "line"); line != "PermitRootLogin no" {
+		t.Fatalf("Unexpected line '%s'", line)
+	}
+	b, ok := program.Statements[1].(*ast.BlockInFileStatement)
+	if !ok || b.Sudo || b.Path.Literal != "/etc/hosts" {
+		t.Fatalf("Unexpected statement %v", program.Statements[1])
+	}
+
+	bogus := map[string][]token.Token{
+		"requires the option 'line'": {
+			{Type: "LineInFile", Literal: "LineInFile"},
+			{Type: "IDENT", Literal: "/etc/hosts"},
+			{Type: "IDENT", Literal: "regexp=app$"},
+			{Type: "EOF", Literal: "EOF"},
+		},
+		"invalid regexp": {
+			{Type: "LineInFile", Literal: "LineInFile"},
+			{Type: "IDENT", Literal: "/etc/hosts"},
+			{Type: "IDENT", Literal: "regexp=(app"},
+			{Type: "IDENT", Literal: "line=app"},
+			{Type: "EOF", Literal: "EOF"},
+		},
+		"requires the option 'content'": {
+			{Type: "BlockInFile", Literal: "BlockInFile"},
+			{Type: "IDENT", Literal: "/etc/hosts"},
+			{Type: "EOF", Literal: "EOF"},
+		},
+	}
+	for message, toks := range bogus {
+		_, err = New(NewFakeLexer(toks)).Parse()
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Fatalf("Expected an error containing '%s', got %v", message, err)
+		}
+	}
+}
+
+// TestFilesystem tests parsing of the Directory, Symlink, and Remove
+// primitives, which honour "Sudo".
+func TestFilesystem(t *testing.T) {
+
+	valid := []token.Token{
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "Directory", Literal: "Directory"},
+		{Type: "IDENT", Literal: "/opt/app/bin"},
+		{Type: "IDENT", Literal: "mode=0755"},
+		{Type: "IDENT", Literal: "owner=app:app"},
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "IDENT", Literal: "-u"},
+		{Type: "IDENT", Literal: "app"},
+		{Type: "Symlink", Literal: "Symlink"},
+		{Type: "IDENT", Literal: "/opt/app/bin/app-1.0"},
+		{Type: "IDENT", Literal: "/opt/app/bin/app"},
+		{Type: "Remove", Literal: "Remove"},
+		{Type: "STRING", Literal: "/opt/app/bin/app-0.9"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	p := New(NewFakeLexer(valid))
+	program, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Received unexpected error parsing: %s\n", err.Error())
+	}
+	if len(program.Statements) != 3 {
+		t.Fatalf("Unexpected statements %v", program.Statements)
+	}
+	if len(p.Warnings()) != 0 {
+		t.Fatalf("Unexpected warnings %v", p.Warnings())
+	}
+
+	d, ok := program.Statements[0].(*ast.DirectoryStatement)
+	if !ok || d.Path.Literal != "/opt/app/bin" || !d.Sudo {
+		t.Fatalf("Unexpected statement %v", program.Statements[0])
+	}
+	if owner, _ := ast.Option(d.Options, "owner"); owner != "app:app" {
+		t.Fatalf("Unexpected owner '%s'", owner)
+	}
+	if d.String() != "Sudo Directory /opt/app/bin mode=0755 owner=app:app" {
+		t.Fatalf("Unexpected source %s", d.String())
+	}
+	l, ok := program.Statements[1].(*ast.SymlinkStatement)
+	if !ok || l.Target.Literal != "/opt/app/bin/app-1.0" || l.Link.Literal != "/opt/app/bin/app" {
+		t.Fatalf("Unexpected statement %v", program.Statements[1])
+	}
+	if !l.Sudo || l.SudoUser != "app" {
+		t.Fatalf("Unexpected prefixes %v", l.Prefix)
+	}
+	r, ok := program.Statements[2].(*ast.RemoveStatement)
+	if !ok || r.Path.Literal != "/opt/app/bin/app-0.9" || r.Sudo {
+		t.Fatalf("Unexpected statement %v", program.Statements[2])
+	}
+
+	bogus := []token.Token{
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "Symlink", Literal: "Symlink"},
+		{Type: "IDENT", Literal: "/opt/app/bin/app-1.0"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+	_, err = New(NewFakeLexer(bogus)).Parse()
+	if err == nil || !strings.Contains(err.Error(), "argument 2") {
+		t.Fatalf("Expected an error for a missing argument, got %v", err)
+	}
+}
+
+// TestDownload tests parsing of the Download primitive.
+func TestDownload(t *testing.T) {
+
+	sum := strings.Repeat("ab", 32)
+
+	valid := []token.Token{
+		{Type: "Download", Literal: "Download"},
+		{Type: "IDENT", Literal: "https://example.com/app"},
+		{Type: "IDENT", Literal: "/opt/app/app"},
+		{Type: "IDENT", Literal: "sha256=" + sum},
+		{Type: "IDENT", Literal: "mode=0755"},
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "Download", Literal: "Download"},
+		{Type: "STRING", Literal: "https://example.com/${VERSION}"},
+		{Type: "IDENT", Literal: "/opt/app/app-${VERSION}"},
+		{Type: "IDENT", Literal: "sha256=${SUM}"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	p := New(NewFakeLexer(valid))
+	program, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Received unexpected error parsing: %s\n", err.Error())
+	}
+	if len(program.Statements) != 2 || len(p.Warnings()) != 0 {
+		t.Fatalf("Unexpected statements %v %v", program.Statements, p.Warnings())
+	}
+
+	d, ok := program.Statements[0].(*ast.DownloadStatement)
+	if !ok || d.URL.Literal != "https://example.com/app" || d.Destination.Literal != "/opt/app/app" || d.Sudo {
+		t.Fatalf("Unexpected statement %v", program.Statements[0])
+	}
+	if val, _ := ast.Option(d.Options, "sha256"); val != sum {
+		t.Fatalf("Unexpected checksum '%s'", val)
+	}
+	d, ok = program.Statements[1].(*ast.DownloadStatement)
+	if !ok || !d.Sudo {
+		t.Fatalf("Unexpected statement %v", program.Statements[1])
+	}
+	if d.String() != "Sudo Download \"https://example.com/${VERSION}\" /opt/app/app-${VERSION} sha256=${SUM}" {
+		t.Fatalf("Unexpected source %s", d.String())
+	}
+
+	bogus := []token.Token{
+		{Type: "Download", Literal: "Download"},
+		{Type: "IDENT", Literal: "https://example.com/app"},
+		{Type: "IDENT", Literal: "/opt/app/app"},
+		{Type: "IDENT", Literal: "sha256=abc"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+	_, err = New(NewFakeLexer(bogus)).Parse()
+	if err == nil || !strings.Contains(err.Error(), "64 hexadecimal characters") {
+		t.Fatalf("Expected an error for a bogus checksum, got %v", err)
+	}
+}
+
 // TestBareString tests our error-handling.
 func TestBareString(t *testing.T) {
 
@@ -269,8 +855,8 @@ func TestBareString(t *testing.T) {
 	if err == nil {
 		t.Fatalf("We expected an error, but saw none!")
 	}
-	if len(program) != 0 {
-		t.Fatalf("Unexpected length, wanted 0 got %d\n", len(program))
+	if len(program.Statements) != 0 {
+		t.Fatalf("Unexpected length, wanted 0 got %d\n", len(program.Statements))
 	}
 }
 
@@ -298,8 +884,8 @@ func TestBareIdentifier(t *testing.T) {
 	if err == nil {
 		t.Fatalf("We expected an error, but saw none!")
 	}
-	if len(program) != 0 {
-		t.Fatalf("Unexpected length, wanted 0 got %d\n", len(program))
+	if len(program.Statements) != 0 {
+		t.Fatalf("Unexpected length, wanted 0 got %d\n", len(program.Statements))
 	}
 }
 
@@ -356,8 +942,8 @@ func TestIllegal(t *testing.T) {
 	if err == nil {
 		t.Fatalf("We expected an error, but saw none!")
 	}
-	if len(program) != 0 {
-		t.Fatalf("Unexpected length, wanted 0 got %d\n", len(program))
+	if len(program.Statements) != 0 {
+		t.Fatalf("Unexpected length, wanted 0 got %d\n", len(program.Statements))
 	}
 	if !strings.Contains(err.Error(), "I like cake") {
 		t.Fatalf("Our error didn't contain the message we set: %s\n", err.Error())
@@ -393,11 +979,11 @@ func TestSet(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Received unexpected error parsing: %s\n", err.Error())
 	}
-	if len(program) != 1 {
-		t.Fatalf("Our program should have one statement - found %d\n", len(program))
+	if len(program.Statements) != 1 {
+		t.Fatalf("Our program should have one statement - found %d\n", len(program.Statements))
 	}
-	if len(program[0].Arguments) != 2 {
-		t.Fatalf("Our statement should have two arguments - found %d\n", len(program[0].Arguments))
+	if len(program.Statements[0].Arguments()) != 2 {
+		t.Fatalf("Our statement should have two arguments - found %d\n", len(program.Statements[0].Arguments()))
 	}
 
 	//
@@ -475,8 +1061,8 @@ func TestSudoHandling(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Received an unexpected error!")
 	}
-	if len(program) != 0 {
-		t.Fatalf("Unexpected length, wanted 0 got %d\n", len(program))
+	if len(program.Statements) != 0 {
+		t.Fatalf("Unexpected length, wanted 0 got %d\n", len(program.Statements))
 	}
 }
 
@@ -517,16 +1103,16 @@ func TestSudoFlag(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Received an unexpected error!")
 	}
-	if len(program) != 1 {
-		t.Fatalf("Unexpected length, wanted 1 got %d\n", len(program))
+	if len(program.Statements) != 1 {
+		t.Fatalf("Unexpected length, wanted 1 got %d\n", len(program.Statements))
 	}
 
 	//
 	// The statement will use sudo
 	//
 
-	if program[0].Sudo != true {
-		t.Fatalf("We expected our Run command to use sudo %v", program[0])
+	if prefixes(program.Statements[0]).Sudo != true {
+		t.Fatalf("We expected our Run command to use sudo %v", program.Statements[0])
 	}
 
 	//
@@ -542,14 +1128,485 @@ func TestSudoFlag(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Received an unexpected error!")
 	}
-	if len(program) != 1 {
-		t.Fatalf("Unexpected length, wanted 1 got %d\n", len(program))
+	if len(program.Statements) != 1 {
+		t.Fatalf("Unexpected length, wanted 1 got %d\n", len(program.Statements))
 	}
 
 	//
 	// The statement will not use sudo
 	//
-	if program[0].Sudo != false {
-		t.Fatalf("We didn't expect our Run command to use sudo %v", program[0])
+	if prefixes(program.Statements[0]).Sudo != false {
+		t.Fatalf("We didn't expect our Run command to use sudo %v", program.Statements[0])
+	}
+}
+
+// TestTimeout tests that we set the timeout for a command, and that
+// bogus durations are rejected.
+func TestTimeout(t *testing.T) {
+
+	//
+	// The stream of tokens we'll parse expecting a timeout to be set.
+	//
+	valid := []token.Token{
+		{Type: "Timeout", Literal: "Timeout"},
+		{Type: "IDENT", Literal: "30s"},
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "Run", Literal: "Run"},
+		{Type: "STRING", Literal: "/bin/ls"},
+		{Type: "Run", Literal: "Run"},
+		{Type: "STRING", Literal: "/bin/ls"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	fl := NewFakeLexer(valid)
+	p := New(fl)
+	program, err := p.Parse()
+
+	if err != nil {
+		t.Fatalf("Received an unexpected error: %s", err.Error())
+	}
+	if len(program.Statements) != 2 {
+		t.Fatalf("Unexpected length, wanted 2 got %d\n", len(program.Statements))
+	}
+	if prefixes(program.Statements[0]).Timeout != 30*time.Second {
+		t.Fatalf("We expected a timeout of 30s, got %v", prefixes(program.Statements[0]).Timeout)
+	}
+	if !prefixes(program.Statements[0]).Sudo {
+		t.Fatalf("We expected our Run command to use sudo %v", program.Statements[0])
+	}
+
+	//
+	// The timeout only applies to the next command.
+	//
+	if prefixes(program.Statements[1]).Timeout != 0 {
+		t.Fatalf("We expected no timeout, got %v", prefixes(program.Statements[1]).Timeout)
+	}
+
+	//
+	// Now some bogus durations.
+	//
+	bogus := []string{"30", "steve", "-5s", "0s"}
+
+	for _, dur := range bogus {
+
+		invalid := []token.Token{
+			{Type: "Timeout", Literal: "Timeout"},
+			{Type: "IDENT", Literal: dur},
+			{Type: "Run", Literal: "Run"},
+			{Type: "STRING", Literal: "/bin/ls"},
+			{Type: "EOF", Literal: "EOF"},
+		}
+
+		fl = NewFakeLexer(invalid)
+		p = New(fl)
+		_, err = p.Parse()
+
+		if err == nil {
+			t.Fatalf("Expected an error parsing timeout '%s', got none", dur)
+		}
+		if !strings.Contains(err.Error(), "invalid timeout") {
+			t.Fatalf("Our error was misleading: %s", err.Error())
+		}
+	}
+}
+
+// TestSudoUser tests that "Sudo -u user" records the user, and that
+// Sudo may be applied to file-copies.
+func TestSudoUser(t *testing.T) {
+
+	toks := []token.Token{
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "IDENT", Literal: "-u"},
+		{Type: "IDENT", Literal: "app"},
+		{Type: "Run", Literal: "Run"},
+		{Type: "STRING", Literal: "/usr/bin/id"},
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "CopyFile", Literal: "CopyFile"},
+		{Type: "IDENT", Literal: "local"},
+		{Type: "IDENT", Literal: "/etc/remote"},
+		{Type: "CopyTemplate", Literal: "CopyTemplate"},
+		{Type: "IDENT", Literal: "local"},
+		{Type: "IDENT", Literal: "/etc/remote"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	fl := NewFakeLexer(toks)
+	p := New(fl)
+	program, err := p.Parse()
+
+	if err != nil {
+		t.Fatalf("Received an unexpected error: %s", err.Error())
+	}
+	if len(program.Statements) != 3 {
+		t.Fatalf("Unexpected length, wanted 3 got %d\n", len(program.Statements))
+	}
+	if !prefixes(program.Statements[0]).Sudo || prefixes(program.Statements[0]).SudoUser != "app" {
+		t.Fatalf("We expected our Run command to use sudo as app %v", program.Statements[0])
+	}
+	if !prefixes(program.Statements[1]).Sudo || prefixes(program.Statements[1]).SudoUser != "" {
+		t.Fatalf("We expected our CopyFile command to use sudo as root %v", program.Statements[1])
+	}
+	if prefixes(program.Statements[2]).Sudo {
+		t.Fatalf("We didn't expect our CopyTemplate command to use sudo %v", program.Statements[2])
+	}
+
+	//
+	// A missing user is an error.
+	//
+	bogus := []token.Token{
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "IDENT", Literal: "-u"},
+		{Type: "Run", Literal: "Run"},
+		{Type: "STRING", Literal: "/usr/bin/id"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	fl = NewFakeLexer(bogus)
+	p = New(fl)
+	_, err = p.Parse()
+
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+}
+
+// TestBecome tests that statements within a Become-block are nested
+// within it.
+func TestBecome(t *testing.T) {
+
+	toks := []token.Token{
+		{Type: "Become", Literal: "Become"},
+		{Type: "IDENT", Literal: "root"},
+		{Type: "Run", Literal: "Run"},
+		{Type: "STRING", Literal: "/usr/bin/id"},
+		{Type: "Become", Literal: "Become"},
+		{Type: "IDENT", Literal: "app"},
+		{Type: "Run", Literal: "Run"},
+		{Type: "STRING", Literal: "/usr/bin/id"},
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "IDENT", Literal: "-u"},
+		{Type: "IDENT", Literal: "www-data"},
+		{Type: "Run", Literal: "Run"},
+		{Type: "STRING", Literal: "/usr/bin/id"},
+		{Type: "End", Literal: "End"},
+		{Type: "CopyFile", Literal: "CopyFile"},
+		{Type: "IDENT", Literal: "local"},
+		{Type: "IDENT", Literal: "/etc/remote"},
+		{Type: "End", Literal: "End"},
+		{Type: "Run", Literal: "Run"},
+		{Type: "STRING", Literal: "/usr/bin/id"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	fl := NewFakeLexer(toks)
+	p := New(fl)
+	program, err := p.Parse()
+
+	if err != nil {
+		t.Fatalf("Received an unexpected error: %s", err.Error())
+	}
+	if len(program.Statements) != 2 {
+		t.Fatalf("Unexpected length, wanted 2 got %d\n", len(program.Statements))
+	}
+
+	outer, ok := program.Statements[0].(*ast.BecomeStatement)
+	if !ok || outer.User.Literal != "root" || len(outer.Body) != 3 {
+		t.Fatalf("Unexpected outer block %v", program.Statements[0])
+	}
+	if outer.End.Token.Type != "End" {
+		t.Fatalf("Outer block has no End %v", outer.End)
+	}
+
+	inner, ok := outer.Body[1].(*ast.BecomeStatement)
+	if !ok || inner.User.Literal != "app" || len(inner.Body) != 2 {
+		t.Fatalf("Unexpected inner block %v", outer.Body[1])
+	}
+
+	//
+	// The explicit prefix is kept, but nothing is inherited.
+	//
+	if prefixes(inner.Body[0]).Sudo {
+		t.Fatalf("Statement inherited escalation %v", inner.Body[0])
+	}
+	if p := prefixes(inner.Body[1]); !p.Sudo || p.SudoUser != "www-data" {
+		t.Fatalf("Statement lost escalation %v", inner.Body[1])
+	}
+
+	//
+	// Walking the tree visits every statement in order.
+	//
+	var seen []string
+	ast.Walk(program.Statements, func(s ast.Statement) {
+		seen = append(seen, string(s.Keyword().Type))
+	})
+	if strings.Join(seen, " ") != "Become Run Become Run Run CopyFile Run" {
+		t.Fatalf("Unexpected walk %v", seen)
+	}
+}
+
+// TestComments tests that comments are attached to the statements they
+// precede, or follow upon the same line.
+func TestComments(t *testing.T) {
+
+	toks := []token.Token{
+		{Type: "COMMENT", Literal: "# one", Line: 1},
+		{Type: "COMMENT", Literal: "# two", Line: 2},
+		{Type: "Run", Literal: "Run", Line: 3},
+		{Type: "STRING", Literal: "/usr/bin/id", Line: 3},
+		{Type: "COMMENT", Literal: "# trailing", Line: 3},
+		{Type: "COMMENT", Literal: "# three", Line: 4},
+		{Type: "Become", Literal: "Become", Line: 5},
+		{Type: "IDENT", Literal: "root", Line: 5},
+		{Type: "COMMENT", Literal: "# four", Line: 6},
+		{Type: "End", Literal: "End", Line: 7},
+		{Type: "COMMENT", Literal: "# end", Line: 7},
+		{Type: "COMMENT", Literal: "# last", Line: 8},
+		{Type: "EOF", Literal: "EOF", Line: 9},
+	}
+
+	p := New(NewFakeLexer(toks))
+	program, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Received an unexpected error: %s", err.Error())
+	}
+	if len(program.Statements) != 2 {
+		t.Fatalf("Unexpected length, wanted 2 got %d\n", len(program.Statements))
+	}
+
+	run := program.Statements[0].Common()
+	if len(run.Doc) != 2 || run.Doc[0].Literal != "# one" || run.Doc[1].Literal != "# two" {
+		t.Fatalf("Unexpected doc-comments %v", run.Doc)
+	}
+	if run.Comment == nil || run.Comment.Literal != "# trailing" {
+		t.Fatalf("Unexpected trailing comment %v", run.Comment)
+	}
+
+	block := program.Statements[1].(*ast.BecomeStatement)
+	if len(block.Doc) != 1 || block.Doc[0].Literal != "# three" || block.Comment != nil {
+		t.Fatalf("Unexpected block comments %v %v", block.Doc, block.Comment)
+	}
+	if len(block.End.Doc) != 1 || block.End.Doc[0].Literal != "# four" {
+		t.Fatalf("Unexpected End doc-comments %v", block.End.Doc)
+	}
+	if block.End.Comment == nil || block.End.Comment.Literal != "# end" {
+		t.Fatalf("Unexpected End comment %v", block.End.Comment)
+	}
+
+	if len(program.Comments) != 1 || program.Comments[0].Literal != "# last" {
+		t.Fatalf("Unexpected final comments %v", program.Comments)
+	}
+}
+
+// TestOptionComments tests that comments following a statement with
+// options, which are read ahead, are attached correctly.
+func TestOptionComments(t *testing.T) {
+
+	toks := []token.Token{
+		{Type: "Run", Literal: "Run", Line: 1},
+		{Type: "STRING", Literal: "uptime", Line: 1},
+		{Type: "RunScript", Literal: "RunScript", Line: 2},
+		{Type: "IDENT", Literal: "deploy.sh", Line: 2},
+		{Type: "IDENT", Literal: "interpreter=bash", Line: 2},
+		{Type: "COMMENT", Literal: "# trailing", Line: 2},
+		{Type: "COMMENT", Literal: "# doc", Line: 3},
+		{Type: "RunScript", Literal: "RunScript", Line: 4},
+		{Type: "IDENT", Literal: "check.sh", Line: 4},
+		{Type: "IDENT", Literal: "template=true", Line: 4},
+		{Type: "EOF", Literal: "EOF", Line: 5},
+	}
+
+	program, err := New(NewFakeLexer(toks)).Parse()
+	if err != nil {
+		t.Fatalf("Received an unexpected error: %s", err.Error())
+	}
+	if len(program.Statements) != 3 {
+		t.Fatalf("Unexpected length, wanted 3 got %d\n", len(program.Statements))
+	}
+
+	if run := program.Statements[0].Common(); run.Comment != nil {
+		t.Fatalf("Unexpected trailing comment %v", run.Comment)
+	}
+
+	first := program.Statements[1].Common()
+	if len(first.Doc) != 0 || first.Comment == nil || first.Comment.Literal != "# trailing" {
+		t.Fatalf("Unexpected comments %v %v", first.Doc, first.Comment)
+	}
+
+	second := program.Statements[2].Common()
+	if len(second.Doc) != 1 || second.Doc[0].Literal != "# doc" {
+		t.Fatalf("Unexpected doc-comments %v", second.Doc)
+	}
+}
+
+// TestBecomeErrors tests that unbalanced Become-blocks are errors, as
+// are unknown methods.
+func TestBecomeErrors(t *testing.T) {
+
+	tests := []struct {
+		toks  []token.Token
+		error string
+	}{
+		{[]token.Token{
+			{Type: "Become", Literal: "Become"},
+			{Type: "IDENT", Literal: "root"},
+			{Type: "EOF", Literal: "EOF"},
+		}, "missing 'End'"},
+		{[]token.Token{
+			{Type: "End", Literal: "End"},
+			{Type: "EOF", Literal: "EOF"},
+		}, "without a matching"},
+		{[]token.Token{
+			{Type: "BecomeMethod", Literal: "BecomeMethod"},
+			{Type: "IDENT", Literal: "pkexec"},
+			{Type: "EOF", Literal: "EOF"},
+		}, "unknown become method"},
+	}
+
+	for _, tst := range tests {
+
+		fl := NewFakeLexer(tst.toks)
+		p := New(fl)
+		_, err := p.Parse()
+
+		if err == nil {
+			t.Fatalf("Expected an error, got none")
+		}
+		if !strings.Contains(err.Error(), tst.error) {
+			t.Fatalf("Our error was misleading: %s", err.Error())
+		}
+	}
+}
+
+// TestPrefixWarnings tests that prefixes which have no effect are
+// reported, and don't leak into later statements.
+func TestPrefixWarnings(t *testing.T) {
+
+	toks := []token.Token{
+		{Type: "Sudo", Literal: "Sudo"},
+		{Type: "Set", Literal: "Set"},
+		{Type: "IDENT", Literal: "name"},
+		{Type: "STRING", Literal: "value"},
+		{Type: "Timeout", Literal: "Timeout"},
+		{Type: "IDENT", Literal: "5s"},
+		{Type: "CopyFile", Literal: "CopyFile"},
+		{Type: "IDENT", Literal: "local"},
+		{Type: "IDENT", Literal: "remote"},
+		{Type: "Run", Literal: "Run"},
+		{Type: "STRING", Literal: "/usr/bin/id"},
+		{Type: "EOF", Literal: "EOF"},
+	}
+
+	p := New(NewFakeLexer(toks))
+	program, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Received an unexpected error: %s", err.Error())
+	}
+	if len(program.Statements) != 3 {
+		t.Fatalf("Unexpected length, wanted 3 got %d\n", len(program.Statements))
+	}
+	if prefixes(program.Statements[2]).Sudo || prefixes(program.Statements[2]).Timeout != 0 {
+		t.Fatalf("Prefixes leaked into a later statement: %v", program.Statements[2])
+	}
+
+	warnings := p.Warnings()
+	if len(warnings) != 2 {
+		t.Fatalf("Expected two warnings, got %v", warnings)
+	}
+	if !strings.Contains(warnings[0].String(), "'Sudo' has no effect on 'Set'") {
+		t.Fatalf("Unexpected warning: %s", warnings[0])
+	}
+	if !strings.Contains(warnings[1].String(), "'Timeout' has no effect on 'CopyFile'") {
+		t.Fatalf("Unexpected warning: %s", warnings[1])
+	}
+}
+
+// TestErrorPosition tests that we can find where an error occurred.
+func TestErrorPosition(t *testing.T) {
+
+	toks := []token.Token{
+		{Type: "Run", Literal: "Run", Line: 1, Column: 1},
+		{Type: "STRING", Literal: "/usr/bin/id", Line: 1, Column: 5},
+		{Type: "Set", Literal: "Set", Line: 2, Column: 3},
+		{Type: "STRING", Literal: "name", Line: 2, Column: 7},
+		{Type: "EOF", Literal: "EOF", Line: 3, Column: 1},
+	}
+
+	p := New(NewFakeLexer(toks))
+	_, err := p.Parse()
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+	list, ok := err.(ErrorList)
+	if !ok || len(list) != 1 {
+		t.Fatalf("Expected a single error, got %v", err)
+	}
+	if list[0].Pos.String() != "2:7" {
+		t.Fatalf("Unexpected error position %s", list[0].Pos)
+	}
+	if err.Error() != "2:7: expected IDENT as argument 1 - Got STRING" {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+}
+
+// TestErrorRecovery tests that we carry on after an error, reporting
+// all the errors we find.
+func TestErrorRecovery(t *testing.T) {
+
+	toks := []token.Token{
+		{Type: "Run", Literal: "Run", Line: 1, Column: 1},
+		{Type: "Set", Literal: "Set", Line: 2, Column: 1},
+		{Type: "IDENT", Literal: "name", Line: 2, Column: 5},
+		{Type: "STRING", Literal: "steve", Line: 2, Column: 10},
+		{Type: "IDENT", Literal: "bogus", Line: 3, Column: 1},
+		{Type: "STRING", Literal: "more", Line: 3, Column: 7},
+		{Type: "Sudo", Literal: "Sudo", Line: 4, Column: 1},
+		{Type: "Timeout", Literal: "Timeout", Line: 4, Column: 6},
+		{Type: "IDENT", Literal: "soon", Line: 4, Column: 14},
+		{Type: "Run", Literal: "Run", Line: 5, Column: 1},
+		{Type: "STRING", Literal: "/usr/bin/id", Line: 5, Column: 5},
+		{Type: "End", Literal: "End", Line: 6, Column: 1},
+		{Type: "Become", Literal: "Become", Line: 7, Column: 1},
+		{Type: "IDENT", Literal: "root", Line: 7, Column: 8},
+		{Type: "EOF", Literal: "EOF", Line: 8, Column: 1},
+	}
+
+	p := New(NewFakeLexer(toks))
+	program, err := p.Parse()
+	list, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("Expected an error list, got %v", err)
+	}
+
+	expected := []string{
+		"2:1: expected STRING as argument 1 - Got Set",
+		"3:1: found unexpected identifier 'bogus'",
+		"4:14: invalid timeout 'soon' - time: invalid duration \"soon\"",
+		"6:1: found 'End' without a matching 'Become'",
+		"7:1: missing 'End' for 'Become root'",
+	}
+	if len(list) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(expected), len(list), list)
+	}
+	for i, e := range expected {
+		if list[i].Error() != e {
+			t.Errorf("Error %d: expected '%s', got '%s'", i, e, list[i].Error())
+		}
+	}
+	if !strings.HasSuffix(err.Error(), "(and 4 more errors)") {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	//
+	// The statements which parsed are still present, and the prefixes
+	// of the broken statement were discarded.
+	//
+	if len(program.Statements) != 3 {
+		t.Fatalf("Expected three statements, got %d", len(program.Statements))
+	}
+	if program.Statements[0].Keyword().Type != "Set" {
+		t.Fatalf("Unexpected statement %v", program.Statements[0])
+	}
+	if prefixes(program.Statements[1]).Sudo {
+		t.Fatalf("Prefix applied after an error")
 	}
 }
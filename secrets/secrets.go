@@ -0,0 +1,103 @@
+// Package secrets loads encrypted key/value files.
+//
+// A secrets file is encrypted with age, either to a passphrase or to
+// one or more age recipients, and may be ASCII-armored.  Once decrypted
+// it contains simple lines of the form:
+//
+//	API_KEY=s3cr3t
+//
+// Blank lines, and lines beginning with "#", are ignored.
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// nameRE matches valid variable-names.
+var nameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Load reads the named file, decrypts it with the given identities, and
+// returns the key/value pairs it contains.
+func Load(file string, identities ...age.Identity) (map[string]string, error) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := Decrypt(data, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %s", file, err.Error())
+	}
+
+	vals, err := Parse(plain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", file, err.Error())
+	}
+	return vals, nil
+}
+
+// Decrypt decrypts the given age-encrypted data, which may be armored.
+func Decrypt(data []byte, identities ...age.Identity) ([]byte, error) {
+
+	var src io.Reader = bytes.NewReader(data)
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header)) {
+		src = armor.NewReader(bytes.NewReader(bytes.TrimSpace(data)))
+	}
+
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// Parse parses the given decrypted content into key/value pairs.
+//
+// Values may optionally be surrounded by single or double quotes, which
+// are removed.  Errors only report the line-number of a bogus line, never
+// its content, to avoid leaking secrets.
+func Parse(data []byte) (map[string]string, error) {
+	vals := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		txt := strings.TrimSpace(scanner.Text())
+		if txt == "" || strings.HasPrefix(txt, "#") {
+			continue
+		}
+
+		eq := strings.Index(txt, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d is not of the form KEY=value", line)
+		}
+
+		key := strings.TrimSpace(txt[:eq])
+		val := strings.TrimSpace(txt[eq+1:])
+
+		if !nameRE.MatchString(key) {
+			return nil, fmt.Errorf("line %d has an invalid variable name", line)
+		}
+
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+
+		vals[key] = val
+	}
+
+	return vals, scanner.Err()
+}
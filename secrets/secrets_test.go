@@ -0,0 +1,127 @@
+package secrets
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// encrypt is a helper which encrypts the given text to the passphrase.
+func encrypt(t *testing.T, text string, passphrase string, armored bool) []byte {
+
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		t.Fatalf("Failed to create recipient: %s", err.Error())
+	}
+
+	// Keep our tests fast.
+	recipient.SetWorkFactor(10)
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, recipient)
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %s", err.Error())
+	}
+	w.Write([]byte(text))
+	w.Close()
+
+	if !armored {
+		return buf.Bytes()
+	}
+
+	out := &bytes.Buffer{}
+	aw := armor.NewWriter(out)
+	aw.Write(buf.Bytes())
+	aw.Close()
+	return out.Bytes()
+}
+
+// TestParse tests parsing decrypted content.
+func TestParse(t *testing.T) {
+
+	input := `
+# A comment
+API_KEY=s3cr3t
+QUOTED = "hello world"
+SINGLE='single'
+EMPTY=
+`
+	vals, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := map[string]string{
+		"API_KEY": "s3cr3t",
+		"QUOTED":  "hello world",
+		"SINGLE":  "single",
+		"EMPTY":   "",
+	}
+
+	if len(vals) != len(expected) {
+		t.Fatalf("Wrong number of values, got %d", len(vals))
+	}
+	for k, v := range expected {
+		if vals[k] != v {
+			t.Fatalf("Wrong value for %s, got '%s'", k, vals[k])
+		}
+	}
+}
+
+// TestParseErrors tests that bogus lines are reported, without their
+// content.
+func TestParseErrors(t *testing.T) {
+
+	tests := []string{
+		"API_KEY=ok\nhunter2\n",
+		"1BAD=hunter2\n",
+	}
+
+	for _, tst := range tests {
+		_, err := Parse([]byte(tst))
+		if err == nil {
+			t.Fatalf("Expected an error parsing '%s'", tst)
+		}
+		if strings.Contains(err.Error(), "hunter2") {
+			t.Fatalf("Our error leaked the content: %s", err.Error())
+		}
+	}
+}
+
+// TestLoad tests loading both binary and armored files.
+func TestLoad(t *testing.T) {
+
+	for _, armored := range []bool{false, true} {
+
+		tmpfile, err := ioutil.TempFile("", "secrets")
+		if err != nil {
+			t.Fatalf("Failed to create temporary file: %s", err.Error())
+		}
+		defer os.Remove(tmpfile.Name())
+
+		ioutil.WriteFile(tmpfile.Name(), encrypt(t, "TOKEN=abc123\n", "passphrase", armored), 0600)
+
+		identity, _ := age.NewScryptIdentity("passphrase")
+		vals, err := Load(tmpfile.Name(), identity)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if vals["TOKEN"] != "abc123" {
+			t.Fatalf("Wrong value, got '%s'", vals["TOKEN"])
+		}
+
+		//
+		// The wrong passphrase is an error.
+		//
+		identity, _ = age.NewScryptIdentity("wrong")
+		_, err = Load(tmpfile.Name(), identity)
+		if err == nil {
+			t.Fatalf("Expected an error with the wrong passphrase")
+		}
+	}
+}
@@ -2,6 +2,11 @@
 // and which our parser understands.
 package token
 
+import (
+	"fmt"
+	"sort"
+)
+
 // Type is a string
 type Type string
 
@@ -9,34 +14,101 @@ type Type string
 type Token struct {
 	Type    Type
 	Literal string
+
+	// Line and Column record where the token was found in the
+	// input, starting from 1.
+	Line   int
+	Column int
+
+	// Raw holds the source-text of the token, before any
+	// escape-processing.
+	Raw string
+}
+
+// String returns the type and literal value of the token.
+func (t Token) String() string {
+	return fmt.Sprintf("{%s %s}", t.Type, t.Literal)
 }
 
 // pre-defined TokenTypes
 const (
+	COMMENT = "COMMENT"
 	EOF     = "EOF"
 	IDENT   = "IDENT"
 	ILLEGAL = "ILLEGAL"
 	STRING  = "STRING"
 
 	// Our keywords.
+	BECOME       = "Become"
+	BECOMEMETHOD = "BecomeMethod"
+	BLOCKINFILE  = "BlockInFile"
 	COPYFILE     = "CopyFile"
 	COPYTEMPLATE = "CopyTemplate"
 	DEPLOYTO     = "DeployTo"
+	DIRECTORY    = "Directory"
+	DOWNLOAD     = "Download"
+	END          = "End"
+	ENV          = "Env"
+	FETCH        = "Fetch"
+	GROUP        = "Group"
 	IFCHANGED    = "IfChanged"
+	LINEINFILE   = "LineInFile"
+	LOADSECRETS  = "LoadSecrets"
+	LOCAL        = "Local"
+	REMOVE       = "Remove"
+	PACKAGE      = "Package"
 	RUN          = "Run"
+	RUNSCRIPT    = "RunScript"
+	SECRET       = "Secret"
+	SERVICE      = "Service"
 	SET          = "Set"
 	SUDO         = "Sudo"
+	SYMLINK      = "Symlink"
+	TIMEOUT      = "Timeout"
+	USER         = "User"
+	WRITEFILE    = "WriteFile"
 )
 
 // keywords holds our reversed keywords
 var keywords = map[string]Type{
+	"Become":       BECOME,
+	"BecomeMethod": BECOMEMETHOD,
+	"BlockInFile":  BLOCKINFILE,
 	"CopyFile":     COPYFILE,
 	"CopyTemplate": COPYTEMPLATE,
 	"DeployTo":     DEPLOYTO,
+	"Directory":    DIRECTORY,
+	"Download":     DOWNLOAD,
+	"End":          END,
+	"Env":          ENV,
+	"Fetch":        FETCH,
+	"Group":        GROUP,
 	"IfChanged":    IFCHANGED,
+	"LineInFile":   LINEINFILE,
+	"LoadSecrets":  LOADSECRETS,
+	"Local":        LOCAL,
+	"Remove":       REMOVE,
+	"Package":      PACKAGE,
 	"Run":          RUN,
+	"RunScript":    RUNSCRIPT,
+	"Secret":       SECRET,
+	"Service":      SERVICE,
 	"Set":          SET,
 	"Sudo":         SUDO,
+	"Symlink":      SYMLINK,
+	"Timeout":      TIMEOUT,
+	"User":         USER,
+	"WriteFile":    WRITEFILE,
+}
+
+// Keywords returns the names of all our keywords, sorted.
+func Keywords() []string {
+	var names []string
+	for name := range keywords {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // LookupIdentifier used to determinate whether identifier is keyword nor not
@@ -22,3 +22,20 @@ func TestLookup(t *testing.T) {
 		}
 	}
 }
+
+// TestKeywords tests that all our keywords are returned, in order.
+func TestKeywords(t *testing.T) {
+
+	names := Keywords()
+	if len(names) != len(keywords) {
+		t.Fatalf("Expected %d keywords, got %d", len(keywords), len(names))
+	}
+	for i, name := range names {
+		if LookupIdentifier(name) == IDENT {
+			t.Errorf("%s is not a keyword", name)
+		}
+		if i > 0 && names[i-1] >= name {
+			t.Errorf("Keywords are not sorted: %v", names)
+		}
+	}
+}